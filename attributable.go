@@ -0,0 +1,248 @@
+package sphinx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// holdTimeSize is the size in bytes of the hold time each hop reports
+	// within the attribution data.
+	holdTimeSize = 4
+
+	// numCoveredSlots is the number of leading slots covered by the HMAC
+	// of each hop. As a path holds at most NumMaxHops hops, the hold times
+	// and HMACs of the hop and of every hop downstream of it all lie
+	// within these slots.
+	numCoveredSlots = NumMaxHops
+
+	// numAttributionSlots is the number of hold time and HMAC slots within
+	// the attribution data. Every hop which handles the failure shifts the
+	// slots to the right by one, dropping the last slot, so a hop's slots
+	// are shifted up to NumMaxHops-1 times before reaching the sender.
+	// Enough slots are reserved for the covered slots of every hop to
+	// survive these shifts, so the sender is always able to reconstruct the
+	// data covered by each HMAC.
+	numAttributionSlots = numCoveredSlots + NumMaxHops - 1
+
+	// attributionDataSize is the fixed size of the attribution data which
+	// is appended to an attributable failure. It consists of a hold time
+	// for each slot, followed by an HMAC for each slot.
+	attributionDataSize = numAttributionSlots * (holdTimeSize + hmacSize)
+
+	// holdTimesSize is the size of the hold time portion of the
+	// attribution data.
+	holdTimesSize = numAttributionSlots * holdTimeSize
+)
+
+// AttributionError is returned by DeobfuscateAttributable when the failure
+// has been corrupted on its way back to the sender. The HMAC chain allows the
+// sender to pinpoint the first hop whose attribution data doesn't verify.
+type AttributionError struct {
+	// HopIdx is the index within the payment path of the first hop whose
+	// HMAC didn't verify. The failure has been corrupted either by this hop
+	// or by the hop preceding it, so path-finding should penalize the
+	// pair.
+	HopIdx int
+
+	// HoldTimes are the hold times in milliseconds reported by the hops
+	// preceding HopIdx, whose attribution data did verify.
+	HoldTimes []uint32
+}
+
+// Error returns a human readable description of the attribution error.
+func (e *AttributionError) Error() string {
+	return fmt.Sprintf("onion failure corrupted at hop %v", e.HopIdx)
+}
+
+// AttributedFailure is the result of successfully deobfuscating an
+// attributable failure.
+type AttributedFailure struct {
+	DecryptedFailure
+
+	// HoldTimes are the hold times in milliseconds reported by every hop
+	// from the first hop up to and including the sender of the failure.
+	HoldTimes []uint32
+}
+
+// attributionMac calculates the HMAC a hop adds to the attribution data. The
+// HMAC commits to the failure, along with the hold times and HMACs of the
+// first numCoveredSlots slots, excluding the hop's own HMAC in the first
+// slot. It therefore covers the attribution data of every downstream hop, so
+// a hop tampering with any of it is detected by the HMAC of the hop right
+// behind it, rather than shifting the blame onto hops further downstream.
+// The HMAC is keyed with its own "am" key, so it can't be confused with the
+// HMAC of the failure message, which is keyed with the "um" key.
+func attributionMac(sharedSecret [sha256.Size]byte, failure,
+	attrData []byte) []byte {
+
+	amKey := generateKey("am", sharedSecret)
+	h := hmac.New(sha256.New, amKey[:])
+	h.Write(failure)
+	h.Write(attrData[:numCoveredSlots*holdTimeSize])
+	h.Write(attrData[holdTimesSize+hmacSize : holdTimesSize+
+		numCoveredSlots*hmacSize])
+
+	return h.Sum(nil)
+}
+
+// shiftAttributionData shifts the hold times and HMACs within the
+// attribution data one slot to the right, zeroing the first slot.
+func shiftAttributionData(attrData []byte) {
+	holdTimes := attrData[:holdTimesSize]
+	hmacs := attrData[holdTimesSize:]
+
+	rightShift(holdTimes, holdTimeSize)
+	rightShift(hmacs, hmacSize)
+}
+
+// unshiftAttributionData reverses shiftAttributionData, shifting the hold
+// times and HMACs one slot to the left. The contents of the last slot can't
+// be recovered and are zeroed.
+func unshiftAttributionData(attrData []byte) {
+	holdTimes := attrData[:holdTimesSize]
+	hmacs := attrData[holdTimesSize:]
+
+	copy(holdTimes, holdTimes[holdTimeSize:])
+	copy(holdTimes[holdTimesSize-holdTimeSize:], make([]byte, holdTimeSize))
+
+	copy(hmacs, hmacs[hmacSize:])
+	copy(hmacs[len(hmacs)-hmacSize:], make([]byte, hmacSize))
+}
+
+// ObfuscateAttributable is the attributable counterpart of Obfuscate. On top
+// of the regular failure obfuscation, every hop reports the time in
+// milliseconds it held the HTLC and adds an HMAC to the attribution data
+// which is carried along with the failure. This allows the sender to detect
+// which hop corrupted the failure, even if the failure itself is unreadable.
+//
+// If initial is true, data is the failure message which should be sent back,
+// and ErrFailureTooLarge is returned if it's larger than math.MaxUint16
+// bytes. Otherwise data is the attributable failure received from the
+// downstream hop.
+func (o *OnionObfuscator) ObfuscateAttributable(initial bool, data []byte,
+	holdTime uint32) ([]byte, error) {
+
+	var failure, attrData []byte
+	switch {
+	case initial:
+		umKey := generateKey("um", o.sharedSecret)
+		payload, err := encodeFailureMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		h := hmac.New(sha256.New, umKey[:])
+		h.Write(payload)
+
+		failure = append(h.Sum(nil), payload...)
+		attrData = make([]byte, attributionDataSize)
+
+	// If the downstream hop sent us something which can't even hold the
+	// attribution data, we'll still add our own attribution so the sender
+	// is able to determine where the failure was corrupted.
+	case len(data) < attributionDataSize:
+		failure = data
+		attrData = make([]byte, attributionDataSize)
+
+	default:
+		split := len(data) - attributionDataSize
+		failure = data[:split]
+		attrData = make([]byte, attributionDataSize)
+		copy(attrData, data[split:])
+		shiftAttributionData(attrData)
+	}
+
+	binary.BigEndian.PutUint32(attrData[:holdTimeSize], holdTime)
+	mac := attributionMac(o.sharedSecret, failure, attrData)
+	copy(attrData[holdTimesSize:], mac)
+
+	blob := make([]byte, 0, len(failure)+len(attrData))
+	blob = append(blob, failure...)
+	blob = append(blob, attrData...)
+
+	return onionObfuscation(o.sharedSecret, blob), nil
+}
+
+// DeobfuscateAttributable deobfuscates a failure created with
+// ObfuscateAttributable. The HMAC added by each hop is verified in path
+// order, and if one of them doesn't check out an *AttributionError is
+// returned identifying the hop which corrupted the failure. Otherwise the
+// originating node, the failure message and the hold times reported by each
+// hop up to the originating node are returned.
+func (o *OnionDeobfuscator) DeobfuscateAttributable(
+	obfuscatedData []byte) (*AttributedFailure, error) {
+
+	paymentPath := o.circuit.PaymentPath
+	sharedSecrets := generateSharedSecrets(paymentPath, o.circuit.SessionKey)
+
+	// If the failure isn't large enough to hold the attribution data,
+	// then the first hop has already tampered with it.
+	if len(obfuscatedData) < attributionDataSize+sha256.Size {
+		return nil, &AttributionError{HopIdx: 0}
+	}
+
+	var (
+		holdTimes []uint32
+		data      = obfuscatedData
+	)
+	for i, sharedSecret := range sharedSecrets {
+		data = onionObfuscation(sharedSecret, data)
+
+		split := len(data) - attributionDataSize
+		failure := data[:split]
+		attrData := data[split:]
+
+		// Verify the HMAC this hop added to the attribution data. If
+		// it doesn't match, then either this hop or the one before it
+		// corrupted the failure.
+		expectedMac := attrData[holdTimesSize : holdTimesSize+hmacSize]
+		realMac := attributionMac(sharedSecret, failure, attrData)
+		if !hmac.Equal(realMac, expectedMac) {
+			return nil, &AttributionError{
+				HopIdx:    i,
+				HoldTimes: holdTimes,
+			}
+		}
+
+		holdTime := binary.BigEndian.Uint32(attrData[:holdTimeSize])
+		holdTimes = append(holdTimes, holdTime)
+
+		// With the attribution verified, check whether this hop is the
+		// one which originated the failure.
+		umKey := generateKey("um", sharedSecret)
+		h := hmac.New(sha256.New, umKey[:])
+		h.Write(failure[sha256.Size:])
+		if hmac.Equal(h.Sum(nil), failure[:sha256.Size]) {
+			msg, ok := decodeFailureMessage(failure[sha256.Size:])
+			if !ok {
+				return nil, &AttributionError{
+					HopIdx:    i,
+					HoldTimes: holdTimes,
+				}
+			}
+
+			return &AttributedFailure{
+				DecryptedFailure: DecryptedFailure{
+					Sender:    paymentPath[i],
+					SenderIdx: i,
+					Message:   msg,
+				},
+				HoldTimes: holdTimes,
+			}, nil
+		}
+
+		// Otherwise, undo the shift of the attribution data performed
+		// by this hop, so we're left with the data as it was sent by
+		// the next hop.
+		unshiftAttributionData(attrData)
+	}
+
+	// Every hop added valid attribution data, but none of them originated
+	// the failure. The final hop must therefore have sent us garbage.
+	return nil, &AttributionError{
+		HopIdx:    len(paymentPath) - 1,
+		HoldTimes: holdTimes,
+	}
+}
@@ -0,0 +1,269 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+// newAttributableTestPath creates a random payment path of numHops nodes
+// along with the shared secrets of each hop.
+func newAttributableTestPath(t *testing.T, numHops int) ([]*btcec.PublicKey,
+	*btcec.PrivateKey, [][32]byte) {
+
+	paymentPath := make([]*btcec.PublicKey, numHops)
+	for i := 0; i < len(paymentPath); i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate random key for sphinx "+
+				"node: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+
+	return paymentPath, sessionKey, generateSharedSecrets(paymentPath,
+		sessionKey)
+}
+
+// TestAttributableFailure checks that the sender is able to decrypt an
+// attributable failure, and learns the hold times of every hop up to the
+// originating node.
+func TestAttributableFailure(t *testing.T) {
+	for _, test := range []struct {
+		numHops   int
+		originIdx int
+	}{
+		{numHops: 1, originIdx: 0},
+		{numHops: 5, originIdx: 3},
+		{numHops: NumMaxHops, originIdx: NumMaxHops - 1},
+	} {
+		paymentPath, sessionKey, sharedSecrets := newAttributableTestPath(
+			t, test.numHops,
+		)
+
+		failureData := []byte("some kek-error data")
+		obfuscator := &OnionObfuscator{
+			sharedSecret: sharedSecrets[test.originIdx],
+		}
+		data, err := obfuscator.ObfuscateAttributable(
+			true, failureData, uint32(test.originIdx*100),
+		)
+		if err != nil {
+			t.Fatalf("unable to obfuscate failure: %v", err)
+		}
+
+		// Propagate the failure back to the sender, each hop reporting
+		// a distinct hold time.
+		for i := test.originIdx - 1; i >= 0; i-- {
+			obfuscator := &OnionObfuscator{
+				sharedSecret: sharedSecrets[i],
+			}
+			data, err = obfuscator.ObfuscateAttributable(
+				false, data, uint32(i*100),
+			)
+			if err != nil {
+				t.Fatalf("unable to obfuscate failure: %v", err)
+			}
+		}
+
+		deobfuscator := NewOnionDeobfuscator(&Circuit{
+			SessionKey:  sessionKey,
+			PaymentPath: paymentPath,
+		})
+		failure, err := deobfuscator.DeobfuscateAttributable(data)
+		if err != nil {
+			t.Fatalf("unable to deobfuscate attributable "+
+				"failure: %v", err)
+		}
+
+		if failure.SenderIdx != test.originIdx {
+			t.Fatalf("expected failure from hop %v, got %v",
+				test.originIdx, failure.SenderIdx)
+		}
+		if !failure.Sender.IsEqual(paymentPath[test.originIdx]) {
+			t.Fatalf("wrong failure sender")
+		}
+		if !bytes.Equal(failure.Message, failureData) {
+			t.Fatalf("data not equals, expected: \"%v\", "+
+				"real: \"%v\"", string(failureData),
+				string(failure.Message))
+		}
+
+		expectedHoldTimes := make([]uint32, test.originIdx+1)
+		for i := range expectedHoldTimes {
+			expectedHoldTimes[i] = uint32(i * 100)
+		}
+		if !reflect.DeepEqual(failure.HoldTimes, expectedHoldTimes) {
+			t.Fatalf("expected hold times %v, got %v",
+				expectedHoldTimes, failure.HoldTimes)
+		}
+	}
+}
+
+// TestAttributableFailureCorruption checks that the sender is able to
+// pinpoint the hop which corrupted an attributable failure.
+func TestAttributableFailureCorruption(t *testing.T) {
+	const (
+		numHops    = 5
+		originIdx  = 4
+		corruptIdx = 2
+	)
+
+	paymentPath, sessionKey, sharedSecrets := newAttributableTestPath(
+		t, numHops,
+	)
+
+	obfuscator := &OnionObfuscator{
+		sharedSecret: sharedSecrets[originIdx],
+	}
+	data, err := obfuscator.ObfuscateAttributable(true, []byte("failure"), 1)
+	if err != nil {
+		t.Fatalf("unable to obfuscate failure: %v", err)
+	}
+
+	for i := originIdx - 1; i >= 0; i-- {
+		obfuscator := &OnionObfuscator{
+			sharedSecret: sharedSecrets[i],
+		}
+		data, err = obfuscator.ObfuscateAttributable(false, data, 1)
+		if err != nil {
+			t.Fatalf("unable to obfuscate failure: %v", err)
+		}
+
+		// The misbehaving hop flips a bit of the failure after having
+		// added its attribution data.
+		if i == corruptIdx {
+			data[0] ^= 0x01
+		}
+	}
+
+	deobfuscator := NewOnionDeobfuscator(&Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	})
+	_, err = deobfuscator.DeobfuscateAttributable(data)
+	attrErr, ok := err.(*AttributionError)
+	if !ok {
+		t.Fatalf("expected attribution error, got %v", err)
+	}
+
+	if attrErr.HopIdx != corruptIdx {
+		t.Fatalf("expected corruption at hop %v, got %v", corruptIdx,
+			attrErr.HopIdx)
+	}
+	if len(attrErr.HoldTimes) != corruptIdx {
+		t.Fatalf("expected %v hold times, got %v", corruptIdx,
+			len(attrErr.HoldTimes))
+	}
+
+	// A failure which is too short to hold the attribution data is blamed
+	// on the first hop.
+	_, err = deobfuscator.DeobfuscateAttributable(data[:100])
+	attrErr, ok = err.(*AttributionError)
+	if !ok || attrErr.HopIdx != 0 {
+		t.Fatalf("expected attribution error at first hop, got %v",
+			err)
+	}
+}
+
+// TestAttributableFailureDownstreamTampering checks that a hop which tampers
+// with the hold times or HMACs of hops further downstream is blamed, rather
+// than an innocent pair of hops behind it.
+func TestAttributableFailureDownstreamTampering(t *testing.T) {
+	const (
+		numHops    = 5
+		originIdx  = 4
+		corruptIdx = 1
+	)
+
+	paymentPath, sessionKey, sharedSecrets := newAttributableTestPath(
+		t, numHops,
+	)
+
+	for _, test := range []struct {
+		name   string
+		offset int
+	}{
+		{"hold time slot 2", 2 * holdTimeSize},
+		{"hold time slot 3", 3 * holdTimeSize},
+		{"hmac slot 2", holdTimesSize + 2*hmacSize},
+		{"hmac slot 3", holdTimesSize + 3*hmacSize},
+	} {
+		obfuscator := &OnionObfuscator{
+			sharedSecret: sharedSecrets[originIdx],
+		}
+		data, err := obfuscator.ObfuscateAttributable(
+			true, []byte("failure"), 1,
+		)
+		if err != nil {
+			t.Fatalf("unable to obfuscate failure: %v", err)
+		}
+
+		for i := originIdx - 1; i >= 0; i-- {
+			// The misbehaving hop flips a bit within the
+			// attribution data of the hops behind the next one,
+			// before adding its own.
+			if i == corruptIdx {
+				split := len(data) - attributionDataSize
+				data[split+test.offset] ^= 0x01
+			}
+
+			obfuscator := &OnionObfuscator{
+				sharedSecret: sharedSecrets[i],
+			}
+			data, err = obfuscator.ObfuscateAttributable(false, data, 1)
+			if err != nil {
+				t.Fatalf("unable to obfuscate failure: %v", err)
+			}
+		}
+
+		deobfuscator := NewOnionDeobfuscator(&Circuit{
+			SessionKey:  sessionKey,
+			PaymentPath: paymentPath,
+		})
+		_, err = deobfuscator.DeobfuscateAttributable(data)
+		attrErr, ok := err.(*AttributionError)
+		if !ok {
+			t.Fatalf("%v: expected attribution error, got %v",
+				test.name, err)
+		}
+
+		// The tampering is detected by the HMAC of the hop right
+		// behind the misbehaving one, so the pair including it is
+		// blamed.
+		if attrErr.HopIdx != corruptIdx+1 {
+			t.Fatalf("%v: expected corruption at hop %v, got %v",
+				test.name, corruptIdx+1, attrErr.HopIdx)
+		}
+	}
+}
+
+// TestAttributionMacKey checks that the HMAC of the attribution data isn't
+// keyed with the "um" key of the failure HMAC, so the two HMACs can't be
+// substituted for each other.
+func TestAttributionMacKey(t *testing.T) {
+	var sharedSecret [sha256.Size]byte
+	copy(sharedSecret[:], bytes.Repeat([]byte{'B'}, sha256.Size))
+
+	failure := []byte("failure")
+	attrData := make([]byte, attributionDataSize)
+
+	umKey := generateKey("um", sharedSecret)
+	h := hmac.New(sha256.New, umKey[:])
+	h.Write(failure)
+	h.Write(attrData[:numCoveredSlots*holdTimeSize])
+	h.Write(attrData[holdTimesSize+hmacSize : holdTimesSize+
+		numCoveredSlots*hmacSize])
+
+	if hmac.Equal(attributionMac(sharedSecret, failure, attrData),
+		h.Sum(nil)) {
+
+		t.Fatalf("attribution HMAC is keyed with the um key")
+	}
+}
@@ -0,0 +1,318 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+const (
+	// circuitVersion is the current version of the serialized Circuit.
+	//
+	// NOTE: Circuits serialized before the introduction of versioning
+	// start with the length of the session key, which is always 32. Any
+	// future version MUST therefore be distinct from legacyCircuitMarker.
+	circuitVersion = 1
+
+	// legacyCircuitMarker is the first byte of an unversioned, legacy
+	// serialized Circuit.
+	legacyCircuitMarker = 32
+
+	// multiPathCircuitVersion is the current version of the serialized
+	// MultiPathCircuit.
+	multiPathCircuitVersion = 0
+
+	// privKeySize is the size in bytes of a serialized private key.
+	privKeySize = 32
+)
+
+// HopMetadata is sender-side information about a hop within the payment
+// path, which isn't required to decrypt failures, but allows the sender to
+// interpret them, e.g. to determine which channel a failure refers to.
+type HopMetadata struct {
+	// ChannelID is the short channel ID of the channel the HTLC was
+	// forwarded over towards this hop.
+	ChannelID uint64
+
+	// Amount is the amount in milli-satoshis this hop received.
+	Amount uint64
+}
+
+// Circuit is used encapsulate the data which is needed for data deobfuscation.
+type Circuit struct {
+	// SessionKey is the key which have been used during generation of the
+	// shared secrets.
+	SessionKey *btcec.PrivateKey
+
+	// PaymentPath is the pub keys of the nodes in the payment path.
+	PaymentPath []*btcec.PublicKey
+
+	// HopMetadata optionally holds additional information for each hop
+	// in the payment path. If set, it MUST have the same length as
+	// PaymentPath.
+	HopMetadata []HopMetadata
+}
+
+// validate checks that the circuit can be serialized and is usable to
+// decrypt failures.
+func (c *Circuit) validate() error {
+	if c.SessionKey == nil {
+		return ErrInvalidSessionKey
+	}
+
+	if len(c.PaymentPath) == 0 || len(c.PaymentPath) > NumMaxHops {
+		return ErrInvalidCircuitPathLength
+	}
+
+	for _, pubKey := range c.PaymentPath {
+		if pubKey == nil {
+			return ErrInvalidCircuitPubKey
+		}
+	}
+
+	if len(c.HopMetadata) != 0 && len(c.HopMetadata) != len(c.PaymentPath) {
+		return ErrInvalidCircuitMetadata
+	}
+
+	return nil
+}
+
+// readSessionKey reads a serialized session key from the passed io.Reader,
+// ensuring that it's a valid scalar on the secp256k1 curve.
+func readSessionKey(r io.Reader) (*btcec.PrivateKey, error) {
+	var keyBytes [privKeySize]byte
+	if _, err := io.ReadFull(r, keyBytes[:]); err != nil {
+		return nil, err
+	}
+
+	d := new(big.Int).SetBytes(keyBytes[:])
+	if d.Sign() == 0 || d.Cmp(btcec.S256().N) >= 0 {
+		return nil, ErrInvalidSessionKey
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), keyBytes[:])
+	return sessionKey, nil
+}
+
+// readPaymentPath reads the number of hops followed by the serialized pub key
+// of each hop from the passed io.Reader.
+func readPaymentPath(r io.Reader) ([]*btcec.PublicKey, error) {
+	var pathLength [1]byte
+	if _, err := io.ReadFull(r, pathLength[:]); err != nil {
+		return nil, err
+	}
+
+	numHops := int(pathLength[0])
+	if numHops == 0 || numHops > NumMaxHops {
+		return nil, ErrInvalidCircuitPathLength
+	}
+
+	paymentPath := make([]*btcec.PublicKey, numHops)
+	for i := 0; i < len(paymentPath); i++ {
+		var pubKeyData [btcec.PubKeyBytesLenCompressed]byte
+		if _, err := io.ReadFull(r, pubKeyData[:]); err != nil {
+			return nil, err
+		}
+
+		pubKey, err := btcec.ParsePubKey(pubKeyData[:], btcec.S256())
+		if err != nil {
+			return nil, ErrInvalidCircuitPubKey
+		}
+		paymentPath[i] = pubKey
+	}
+
+	return paymentPath, nil
+}
+
+// Decode initializes the circuit from the byte stream. Both the current
+// versioned serialization and the legacy unversioned serialization are
+// supported. Every field is validated, and an error is returned if the
+// stream is truncated or contains invalid data.
+func (c *Circuit) Decode(r io.Reader) error {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return err
+	}
+
+	switch version[0] {
+	// The legacy serialization merely consists of the length-prefixed
+	// session key and payment path.
+	case legacyCircuitMarker:
+		sessionKey, err := readSessionKey(r)
+		if err != nil {
+			return err
+		}
+
+		paymentPath, err := readPaymentPath(r)
+		if err != nil {
+			return err
+		}
+
+		c.SessionKey = sessionKey
+		c.PaymentPath = paymentPath
+		c.HopMetadata = nil
+
+		return nil
+
+	case circuitVersion:
+
+	default:
+		return ErrUnknownCircuitVersion
+	}
+
+	sessionKey, err := readSessionKey(r)
+	if err != nil {
+		return err
+	}
+
+	paymentPath, err := readPaymentPath(r)
+	if err != nil {
+		return err
+	}
+
+	var hasMetadata [1]byte
+	if _, err := io.ReadFull(r, hasMetadata[:]); err != nil {
+		return err
+	}
+
+	var hopMetadata []HopMetadata
+	switch hasMetadata[0] {
+	case 0:
+
+	case 1:
+		hopMetadata = make([]HopMetadata, len(paymentPath))
+		for i := range hopMetadata {
+			err := binary.Read(r, binary.BigEndian, &hopMetadata[i].ChannelID)
+			if err != nil {
+				return err
+			}
+
+			err = binary.Read(r, binary.BigEndian, &hopMetadata[i].Amount)
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		return ErrInvalidCircuitMetadata
+	}
+
+	c.SessionKey = sessionKey
+	c.PaymentPath = paymentPath
+	c.HopMetadata = hopMetadata
+
+	return nil
+}
+
+// Encode writes converted circuit in the byte stream. The circuit is
+// validated before being written, and an error is returned if it couldn't be
+// decoded again.
+func (c *Circuit) Encode(w io.Writer) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte{circuitVersion}); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(c.SessionKey.Serialize()); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte{uint8(len(c.PaymentPath))}); err != nil {
+		return err
+	}
+
+	for _, pubKey := range c.PaymentPath {
+		if _, err := w.Write(pubKey.SerializeCompressed()); err != nil {
+			return err
+		}
+	}
+
+	if len(c.HopMetadata) == 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+
+	if _, err := w.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	for _, metadata := range c.HopMetadata {
+		err := binary.Write(w, binary.BigEndian, metadata.ChannelID)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(w, binary.BigEndian, metadata.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MultiPathCircuit groups the circuits of all the parts of a multi-path
+// payment, so they can be stored and retrieved as a single unit.
+type MultiPathCircuit struct {
+	// Circuits are the circuits of the individual parts of the payment.
+	Circuits []*Circuit
+}
+
+// Encode writes the serialized multi-path circuit into the passed
+// io.Writer. Each circuit is serialized using Circuit.Encode.
+func (m *MultiPathCircuit) Encode(w io.Writer) error {
+	if len(m.Circuits) > math.MaxUint16 {
+		return ErrTooManyCircuits
+	}
+
+	if _, err := w.Write([]byte{multiPathCircuitVersion}); err != nil {
+		return err
+	}
+
+	err := binary.Write(w, binary.BigEndian, uint16(len(m.Circuits)))
+	if err != nil {
+		return err
+	}
+
+	for _, circuit := range m.Circuits {
+		if err := circuit.Encode(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode initializes the multi-path circuit from the byte stream.
+func (m *MultiPathCircuit) Decode(r io.Reader) error {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return err
+	}
+
+	if version[0] != multiPathCircuitVersion {
+		return ErrUnknownCircuitVersion
+	}
+
+	var numCircuits uint16
+	if err := binary.Read(r, binary.BigEndian, &numCircuits); err != nil {
+		return err
+	}
+
+	circuits := make([]*Circuit, numCircuits)
+	for i := range circuits {
+		circuits[i] = &Circuit{}
+		if err := circuits[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	m.Circuits = circuits
+
+	return nil
+}
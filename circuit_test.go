@@ -0,0 +1,236 @@
+package sphinx
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/roasbeef/btcd/btcec"
+)
+
+// newTestCircuit creates a circuit with a random payment path of numHops
+// nodes, optionally including hop metadata.
+func newTestCircuit(t *testing.T, numHops int, withMetadata bool) *Circuit {
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("unable to generate session key: %v", err)
+	}
+
+	circuit := &Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: make([]*btcec.PublicKey, numHops),
+	}
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		circuit.PaymentPath[i] = privKey.PubKey()
+
+		if withMetadata {
+			circuit.HopMetadata = append(circuit.HopMetadata,
+				HopMetadata{
+					ChannelID: uint64(i) << 40,
+					Amount:    uint64(1000 * (numHops - i)),
+				})
+		}
+	}
+
+	return circuit
+}
+
+// assertCircuitsEqual fails the test if the two circuits differ.
+func assertCircuitsEqual(t *testing.T, expected, actual *Circuit) {
+	if !bytes.Equal(expected.SessionKey.Serialize(),
+		actual.SessionKey.Serialize()) {
+		t.Fatalf("session keys don't match")
+	}
+
+	if len(expected.PaymentPath) != len(actual.PaymentPath) {
+		t.Fatalf("expected path of %v hops, got %v",
+			len(expected.PaymentPath), len(actual.PaymentPath))
+	}
+	for i := range expected.PaymentPath {
+		if !expected.PaymentPath[i].IsEqual(actual.PaymentPath[i]) {
+			t.Fatalf("hop %v of payment path doesn't match", i)
+		}
+	}
+
+	if !reflect.DeepEqual(expected.HopMetadata, actual.HopMetadata) {
+		t.Fatalf("hop metadata doesn't match: expected %v, got %v",
+			spew.Sdump(expected.HopMetadata),
+			spew.Sdump(actual.HopMetadata))
+	}
+}
+
+// TestCircuitEncodeDecode checks that circuits, with and without hop
+// metadata, survive a round trip through their serialization.
+func TestCircuitEncodeDecode(t *testing.T) {
+	for _, withMetadata := range []bool{false, true} {
+		circuit := newTestCircuit(t, 5, withMetadata)
+
+		var b bytes.Buffer
+		if err := circuit.Encode(&b); err != nil {
+			t.Fatalf("unable to encode circuit: %v", err)
+		}
+
+		decodedCircuit := &Circuit{}
+		if err := decodedCircuit.Decode(&b); err != nil {
+			t.Fatalf("unable to decode circuit: %v", err)
+		}
+
+		assertCircuitsEqual(t, circuit, decodedCircuit)
+	}
+}
+
+// TestCircuitDecodeLegacy checks that circuits serialized in the legacy
+// unversioned format can still be decoded.
+func TestCircuitDecodeLegacy(t *testing.T) {
+	circuit := newTestCircuit(t, 3, false)
+
+	var b bytes.Buffer
+	b.WriteByte(legacyCircuitMarker)
+	b.Write(circuit.SessionKey.Serialize())
+	b.WriteByte(uint8(len(circuit.PaymentPath)))
+	for _, pubKey := range circuit.PaymentPath {
+		b.Write(pubKey.SerializeCompressed())
+	}
+
+	decodedCircuit := &Circuit{}
+	if err := decodedCircuit.Decode(&b); err != nil {
+		t.Fatalf("unable to decode legacy circuit: %v", err)
+	}
+
+	assertCircuitsEqual(t, circuit, decodedCircuit)
+}
+
+// TestCircuitDecodeInvalid checks that truncated or otherwise invalid
+// serialized circuits are rejected.
+func TestCircuitDecodeInvalid(t *testing.T) {
+	circuit := newTestCircuit(t, 3, true)
+
+	var b bytes.Buffer
+	if err := circuit.Encode(&b); err != nil {
+		t.Fatalf("unable to encode circuit: %v", err)
+	}
+	encoded := b.Bytes()
+
+	// Every truncation of the serialized circuit must be rejected.
+	for i := 0; i < len(encoded); i++ {
+		err := (&Circuit{}).Decode(bytes.NewReader(encoded[:i]))
+		if err == nil {
+			t.Fatalf("circuit truncated to %v bytes was accepted", i)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		err    error
+	}{
+		{
+			name:   "unknown version",
+			modify: func(b []byte) { b[0] = 0xff },
+			err:    ErrUnknownCircuitVersion,
+		},
+		{
+			name: "zero session key",
+			modify: func(b []byte) {
+				copy(b[1:1+privKeySize], make([]byte, privKeySize))
+			},
+			err: ErrInvalidSessionKey,
+		},
+		{
+			name:   "empty path",
+			modify: func(b []byte) { b[1+privKeySize] = 0 },
+			err:    ErrInvalidCircuitPathLength,
+		},
+		{
+			name: "path too long",
+			modify: func(b []byte) {
+				b[1+privKeySize] = NumMaxHops + 1
+			},
+			err: ErrInvalidCircuitPathLength,
+		},
+		{
+			name:   "invalid pub key",
+			modify: func(b []byte) { b[2+privKeySize] = 0x05 },
+			err:    ErrInvalidCircuitPubKey,
+		},
+	}
+	for _, test := range tests {
+		modified := append([]byte(nil), encoded...)
+		test.modify(modified)
+
+		err := (&Circuit{}).Decode(bytes.NewReader(modified))
+		if err != test.err {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.err,
+				err)
+		}
+	}
+}
+
+// TestCircuitEncodeInvalid checks that circuits which couldn't be decoded
+// again are refused during encoding.
+func TestCircuitEncodeInvalid(t *testing.T) {
+	noSessionKey := newTestCircuit(t, 2, false)
+	noSessionKey.SessionKey = nil
+
+	emptyPath := newTestCircuit(t, 2, false)
+	emptyPath.PaymentPath = nil
+
+	nilPubKey := newTestCircuit(t, 2, false)
+	nilPubKey.PaymentPath[1] = nil
+
+	metadataMismatch := newTestCircuit(t, 2, true)
+	metadataMismatch.HopMetadata = metadataMismatch.HopMetadata[:1]
+
+	tests := []struct {
+		circuit *Circuit
+		err     error
+	}{
+		{noSessionKey, ErrInvalidSessionKey},
+		{emptyPath, ErrInvalidCircuitPathLength},
+		{nilPubKey, ErrInvalidCircuitPubKey},
+		{metadataMismatch, ErrInvalidCircuitMetadata},
+	}
+	for i, test := range tests {
+		var b bytes.Buffer
+		if err := test.circuit.Encode(&b); err != test.err {
+			t.Fatalf("test #%v: expected %v, got %v", i, test.err,
+				err)
+		}
+	}
+}
+
+// TestMultiPathCircuitEncodeDecode checks that the circuits of a multi-path
+// payment survive a round trip through their serialization.
+func TestMultiPathCircuitEncodeDecode(t *testing.T) {
+	mpCircuit := &MultiPathCircuit{
+		Circuits: []*Circuit{
+			newTestCircuit(t, 1, false),
+			newTestCircuit(t, 4, true),
+			newTestCircuit(t, NumMaxHops, true),
+		},
+	}
+
+	var b bytes.Buffer
+	if err := mpCircuit.Encode(&b); err != nil {
+		t.Fatalf("unable to encode multi-path circuit: %v", err)
+	}
+
+	decodedCircuit := &MultiPathCircuit{}
+	if err := decodedCircuit.Decode(&b); err != nil {
+		t.Fatalf("unable to decode multi-path circuit: %v", err)
+	}
+
+	if len(decodedCircuit.Circuits) != len(mpCircuit.Circuits) {
+		t.Fatalf("expected %v circuits, got %v",
+			len(mpCircuit.Circuits), len(decodedCircuit.Circuits))
+	}
+	for i := range mpCircuit.Circuits {
+		assertCircuitsEqual(t, mpCircuit.Circuits[i],
+			decodedCircuit.Circuits[i])
+	}
+}
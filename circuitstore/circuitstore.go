@@ -0,0 +1,421 @@
+package circuitstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	sphinx "github.com/Crypt-iQ/lightning-onion"
+	"github.com/boltdb/bolt"
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/roasbeef/btcd/btcec"
+)
+
+const (
+	// defaultDbDirectory is the default directory where the circuit store
+	// will persist its circuits.
+	defaultDbDirectory = "circuits"
+
+	// circuitKeySize is the size in bytes of the serialized CircuitKey,
+	// consisting of the payment hash followed by the attempt ID.
+	circuitKeySize = 32 + 8
+)
+
+var (
+	// circuitBucket is a bucket which houses the serialized CircuitKey as
+	// the key, and the expiry height followed by the serialized circuit
+	// as the value.
+	circuitBucket = []byte("circuits")
+
+	// expiryIndexBucket is a bucket which indexes the circuits of
+	// circuitBucket by their expiry height. Its keys are the big-endian
+	// expiry height followed by the serialized CircuitKey, and its values
+	// are empty. As bolt sorts keys bytewise, the garbage collector only
+	// needs to visit the circuits which have expired.
+	expiryIndexBucket = []byte("circuit-expiry-index")
+
+	// ErrCircuitNotFound is returned when no circuit is stored for the
+	// requested CircuitKey.
+	ErrCircuitNotFound = fmt.Errorf("circuit not found")
+)
+
+// CircuitKey uniquely identifies a single attempt to route a payment, and
+// hence the circuit of the onion packet created for that attempt.
+type CircuitKey struct {
+	// PaymentHash is the payment hash of the HTLC.
+	PaymentHash [32]byte
+
+	// AttemptID distinguishes multiple attempts to route the same payment.
+	AttemptID uint64
+}
+
+// encode serializes the CircuitKey into the key used within circuitBucket.
+func (k CircuitKey) encode() []byte {
+	var key [circuitKeySize]byte
+	copy(key[:], k.PaymentHash[:])
+	binary.BigEndian.PutUint64(key[32:], k.AttemptID)
+
+	return key[:]
+}
+
+// expiryIndexKey returns the key of the expiryIndexBucket entry of the
+// circuit stored under the passed serialized CircuitKey.
+func expiryIndexKey(expiry uint32, key []byte) []byte {
+	indexKey := make([]byte, 4+len(key))
+	binary.BigEndian.PutUint32(indexKey[:4], expiry)
+	copy(indexKey[4:], key)
+
+	return indexKey
+}
+
+// CircuitStore persists the circuits of onion packets created by a sender,
+// so that the failures returned for them can be decrypted, even across
+// restarts. Each circuit is stored along with the expiry height of its HTLC,
+// after which no failure can be returned anymore. Similar to the DecayedLog,
+// a garbage collector removes the circuits whose expiry height has passed. If
+// no Notifier is supplied, the caller is responsible for calling Prune as new
+// blocks arrive.
+type CircuitStore struct {
+	db       *channeldb.DB
+	wg       sync.WaitGroup
+	quit     chan (struct{})
+	Notifier chainntnfs.ChainNotifier
+
+	// StartHeight is the current best height of the chain at the time
+	// the CircuitStore is started. It's optional, and if set, circuits
+	// which expired before this height are garbage collected on Start.
+	StartHeight uint32
+
+	// OnPrune is called by the garbage collector with the height of every
+	// block epoch it has pruned the CircuitStore at. It's optional, and
+	// allows tests to wait for garbage collection to complete. It MUST NOT
+	// block or call Stop.
+	OnPrune func(height uint32)
+
+	// OnError is called with the failures of the garbage collector. It's
+	// optional, and MUST NOT block or call Stop.
+	OnError func(error)
+
+	// mtx guards started, which ensures the CircuitStore is only started
+	// and stopped once.
+	mtx     sync.Mutex
+	started bool
+}
+
+// garbageCollector deletes circuits from circuitBucket whose expiry height
+// has already past. Failures are reported through OnError. This function
+// MUST be run as a goroutine.
+func (s *CircuitStore) garbageCollector(
+	epochClient *chainntnfs.BlockEpochEvent) {
+
+	defer s.wg.Done()
+	defer epochClient.Cancel()
+
+	for {
+		select {
+		case epoch, ok := <-epochClient.Epochs:
+			if !ok {
+				s.reportError(fmt.Errorf("Epoch client " +
+					"shutting down"))
+				return
+			}
+
+			// A failed garbage collection is retried with the
+			// next block, as Prune removes every expired circuit.
+			if err := s.Prune(uint32(epoch.Height)); err != nil {
+				s.reportError(fmt.Errorf("Unable to prune "+
+					"circuits: %v", err))
+				continue
+			}
+
+			if s.OnPrune != nil {
+				s.OnPrune(uint32(epoch.Height))
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// reportError passes an error of the garbage collector to OnError, if set.
+func (s *CircuitStore) reportError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// Prune deletes every circuit whose expiry height is below the passed
+// height. Using the expiry index, only the expired circuits are visited.
+func (s *CircuitStore) Prune(height uint32) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		circuits := tx.Bucket(circuitBucket)
+		if circuits == nil {
+			return fmt.Errorf("circuitBucket is nil")
+		}
+		expiryIndex := tx.Bucket(expiryIndexBucket)
+		if expiryIndex == nil {
+			return fmt.Errorf("expiryIndexBucket is nil")
+		}
+
+		// The index is sorted by expiry height, so we can stop at the
+		// first circuit which hasn't expired yet.
+		var expired [][]byte
+		c := expiryIndex.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if binary.BigEndian.Uint32(k[:4]) >= height {
+				break
+			}
+
+			expired = append(expired, k)
+		}
+
+		// Delete every expired circuit from both buckets. This must be
+		// done explicitly outside of the cursor iteration for safety
+		// reasons.
+		for _, k := range expired {
+			if err := circuits.Delete(k[4:]); err != nil {
+				return err
+			}
+
+			if err := expiryIndex.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// deleteCircuit removes the circuit stored under the passed serialized
+// CircuitKey from the passed buckets, along with its index entry.
+func deleteCircuit(circuits, expiryIndex *bolt.Bucket, key []byte) error {
+	v := circuits.Get(key)
+	if v == nil {
+		return nil
+	}
+
+	expiry := binary.BigEndian.Uint32(v[:4])
+	if err := expiryIndex.Delete(expiryIndexKey(expiry, key)); err != nil {
+		return err
+	}
+
+	return circuits.Delete(key)
+}
+
+// Put stores the circuit under the given key. The circuit will be removed by
+// the garbage collector once the block height exceeds expiry.
+func (s *CircuitStore) Put(key CircuitKey, expiry uint32,
+	circuit *sphinx.Circuit) error {
+
+	var b bytes.Buffer
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], expiry)
+	b.Write(scratch[:])
+
+	if err := circuit.Encode(&b); err != nil {
+		return err
+	}
+
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		circuits, expiryIndex, err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		// Replace a circuit previously stored under the same key,
+		// along with its index entry.
+		encodedKey := key.encode()
+		if err := deleteCircuit(circuits, expiryIndex, encodedKey); err != nil {
+			return err
+		}
+
+		err = expiryIndex.Put(expiryIndexKey(expiry, encodedKey), nil)
+		if err != nil {
+			return err
+		}
+
+		return circuits.Put(encodedKey, b.Bytes())
+	})
+}
+
+// createBuckets returns the circuitBucket and expiryIndexBucket, creating
+// them if they don't exist yet.
+func createBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	circuits, err := tx.CreateBucketIfNotExists(circuitBucket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to create bucket "+
+			"circuits: %v", err)
+	}
+
+	expiryIndex, err := tx.CreateBucketIfNotExists(expiryIndexBucket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to create bucket "+
+			"expiry index: %v", err)
+	}
+
+	return circuits, expiryIndex, nil
+}
+
+// Get retrieves the circuit stored under the given key. If no such circuit
+// exists, ErrCircuitNotFound is returned.
+func (s *CircuitStore) Get(key CircuitKey) (*sphinx.Circuit, error) {
+	circuit := &sphinx.Circuit{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		circuits := tx.Bucket(circuitBucket)
+		if circuits == nil {
+			return fmt.Errorf("circuitBucket is nil, could " +
+				"not retrieve circuit")
+		}
+
+		v := circuits.Get(key.encode())
+		if v == nil {
+			return ErrCircuitNotFound
+		}
+
+		// The first 4 bytes represent the expiry height, the circuit
+		// follows.
+		return circuit.Decode(bytes.NewReader(v[4:]))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return circuit, nil
+}
+
+// Delete removes the circuit stored under the given key. It should be called
+// once the HTLC of the circuit has been settled.
+func (s *CircuitStore) Delete(key CircuitKey) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		circuits, expiryIndex, err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		return deleteCircuit(circuits, expiryIndex, key.encode())
+	})
+}
+
+// NewOnionPacket creates a new onion packet using sphinx.NewOnionPacket, and
+// stores the circuit of the packet under the given key, so failures returned
+// for the packet can later be decrypted with DecryptFailure. The expiry is
+// the block height after which the circuit may be garbage collected, usually
+// the CLTV expiry of the HTLC offered to the first hop.
+func (s *CircuitStore) NewOnionPacket(key CircuitKey, expiry uint32,
+	paymentPath []*btcec.PublicKey, sessionKey *btcec.PrivateKey,
+	hopsData []sphinx.HopData, assocData []byte) (*sphinx.OnionPacket,
+	error) {
+
+	pkt, err := sphinx.NewOnionPacket(paymentPath, sessionKey, hopsData,
+		assocData)
+	if err != nil {
+		return nil, err
+	}
+
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+	if err := s.Put(key, expiry, circuit); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// DecryptFailure looks up the circuit stored under the given key, and uses
+// it to decrypt the failure returned for the onion packet.
+func (s *CircuitStore) DecryptFailure(key CircuitKey,
+	obfuscatedData []byte) (*sphinx.DecryptedFailure, error) {
+
+	circuit, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sphinx.NewOnionDeobfuscator(circuit).Deobfuscate(obfuscatedData)
+}
+
+// Start opens the database we will be using to store circuits. It
+// immediately deletes the circuits which expired before StartHeight, and
+// starts the garbage collector in a goroutine to remove expired circuits.
+// Calling Start on a started CircuitStore has no effect.
+func (s *CircuitStore) Start(dbDir string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.started {
+		return nil
+	}
+
+	// Create the quit channel
+	s.quit = make(chan struct{})
+
+	directory := dbDir
+	if directory == "" {
+		directory = defaultDbDirectory
+	}
+
+	// Open the channeldb for use.
+	var err error
+	if s.db, err = channeldb.Open(directory); err != nil {
+		return fmt.Errorf("Could not open channeldb: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		_, _, err := createBuckets(tx)
+		return err
+	})
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+
+	// Catch up on the circuits which expired while we were offline.
+	if s.StartHeight > 0 {
+		if err := s.Prune(s.StartHeight); err != nil {
+			s.db.Close()
+			return fmt.Errorf("Unable to prune circuits: %v", err)
+		}
+	}
+
+	// Start garbage collector.
+	if s.Notifier != nil {
+		epochClient, err := s.Notifier.RegisterBlockEpochNtfn()
+		if err != nil {
+			s.db.Close()
+			return fmt.Errorf("Unable to register for epoch "+
+				"notification: %v", err)
+		}
+
+		s.wg.Add(1)
+		go s.garbageCollector(epochClient)
+	}
+
+	s.started = true
+
+	return nil
+}
+
+// Stop halts the garbage collector and closes channeldb. Calling Stop on a
+// CircuitStore which isn't started has no effect.
+func (s *CircuitStore) Stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.started {
+		return
+	}
+
+	// Stop garbage collector.
+	close(s.quit)
+	s.wg.Wait()
+
+	// Close channeldb.
+	s.db.Close()
+	s.started = false
+}
@@ -0,0 +1,336 @@
+package circuitstore
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	sphinx "github.com/Crypt-iQ/lightning-onion"
+	"github.com/Crypt-iQ/lightning-onion/mockchain"
+	"github.com/roasbeef/btcd/btcec"
+	"github.com/roasbeef/btcd/chaincfg"
+)
+
+const (
+	testDir = "tempcircuits"
+
+	expiry uint32 = 100000
+)
+
+// startup creates and starts a CircuitStore backed by a temporary database,
+// whose garbage collections are recorded by the returned GCTracker.
+func startup(t *testing.T) (*CircuitStore, *mockchain.Notifier,
+	*mockchain.GCTracker) {
+
+	notifier := mockchain.NewNotifier(0)
+	tracker := mockchain.NewGCTracker()
+	store := &CircuitStore{
+		Notifier: notifier,
+		OnPrune:  tracker.OnPrune,
+		OnError:  tracker.OnError,
+	}
+	if err := store.Start(testDir); err != nil {
+		t.Fatalf("unable to start circuit store: %v", err)
+	}
+
+	return store, notifier, tracker
+}
+
+// shutdown stops the CircuitStore and deletes its temporary database.
+func shutdown(store *CircuitStore) {
+	store.Stop()
+	os.RemoveAll(testDir)
+}
+
+// newTestPath creates a random payment path of numHops nodes, returning the
+// private keys of the nodes along with their public keys.
+func newTestPath(t *testing.T, numHops int) ([]*btcec.PrivateKey,
+	[]*btcec.PublicKey) {
+
+	privKeys := make([]*btcec.PrivateKey, numHops)
+	paymentPath := make([]*btcec.PublicKey, numHops)
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		privKeys[i] = privKey
+		paymentPath[i] = privKey.PubKey()
+	}
+
+	return privKeys, paymentPath
+}
+
+// TestCircuitStorePutGetDelete checks that stored circuits can be retrieved
+// until they are deleted.
+func TestCircuitStorePutGetDelete(t *testing.T) {
+	store, _, _ := startup(t)
+	defer shutdown(store)
+
+	_, paymentPath := newTestPath(t, 3)
+	sessionKey, _ := btcec.NewPrivateKey(btcec.S256())
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+
+	key := CircuitKey{AttemptID: 1}
+	copy(key.PaymentHash[:], bytes.Repeat([]byte{0x01}, 32))
+
+	if err := store.Put(key, expiry, circuit); err != nil {
+		t.Fatalf("unable to store circuit: %v", err)
+	}
+
+	// A different attempt for the same payment must not be found.
+	otherKey := key
+	otherKey.AttemptID = 2
+	if _, err := store.Get(otherKey); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+
+	storedCircuit, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("unable to retrieve circuit: %v", err)
+	}
+	if !bytes.Equal(storedCircuit.SessionKey.Serialize(),
+		sessionKey.Serialize()) {
+		t.Fatalf("session key doesn't match")
+	}
+	if len(storedCircuit.PaymentPath) != len(paymentPath) {
+		t.Fatalf("expected path of %v hops, got %v", len(paymentPath),
+			len(storedCircuit.PaymentPath))
+	}
+	for i, pubKey := range storedCircuit.PaymentPath {
+		if !pubKey.IsEqual(paymentPath[i]) {
+			t.Fatalf("hop %v of payment path doesn't match", i)
+		}
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("unable to delete circuit: %v", err)
+	}
+	if _, err := store.Get(key); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+}
+
+// TestCircuitStoreDecryptFailure checks that the circuit stored when creating
+// an onion packet can be used to decrypt a failure after a restart.
+func TestCircuitStoreDecryptFailure(t *testing.T) {
+	store, _, _ := startup(t)
+	defer shutdown(store)
+
+	privKeys, paymentPath := newTestPath(t, 3)
+	hopsData := make([]sphinx.HopData, len(paymentPath))
+	sessionKey, _ := btcec.NewPrivateKey(btcec.S256())
+
+	key := CircuitKey{AttemptID: 7}
+	pkt, err := store.NewOnionPacket(key, expiry, paymentPath, sessionKey,
+		hopsData, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// Let each hop process the packet in order to obtain its shared
+	// secret, from which it can encrypt failures.
+	encrypters := make([]*sphinx.ErrorEncrypter, len(paymentPath))
+	for i, privKey := range privKeys {
+		router := sphinx.NewRouter(privKey, &chaincfg.MainNetParams, nil)
+		if err := router.Start(); err != nil {
+			t.Fatalf("unable to start router: %v", err)
+		}
+
+		processedPacket, err := router.ProcessOnionPacket(pkt, nil)
+		router.Stop()
+		os.RemoveAll("sharedhashes")
+		if err != nil {
+			t.Fatalf("hop %v unable to process packet: %v", i, err)
+		}
+		pkt = processedPacket.NextPacket
+
+		encrypters[i], err = sphinx.NewErrorEncrypter(
+			processedPacket.SharedSecret,
+			sphinx.ErrorEncrypterTypeSphinx,
+		)
+		if err != nil {
+			t.Fatalf("hop %v unable to create encrypter: %v", i, err)
+		}
+	}
+
+	// Restart the store, so the circuit has to be read back from disk.
+	store.Stop()
+	if err := store.Start(testDir); err != nil {
+		t.Fatalf("unable to restart circuit store: %v", err)
+	}
+
+	// The final hop creates a failure, which is wrapped by the other hops
+	// on its way back.
+	failureData := []byte("some kek-error data")
+	data, err := encrypters[len(encrypters)-1].EncryptError(
+		true, failureData, 0,
+	)
+	if err != nil {
+		t.Fatalf("unable to encrypt failure: %v", err)
+	}
+	for i := len(encrypters) - 2; i >= 0; i-- {
+		data, err = encrypters[i].EncryptError(false, data, 0)
+		if err != nil {
+			t.Fatalf("unable to encrypt failure: %v", err)
+		}
+	}
+
+	failure, err := store.DecryptFailure(key, data)
+	if err != nil {
+		t.Fatalf("unable to decrypt failure: %v", err)
+	}
+	if failure.SenderIdx != len(paymentPath)-1 {
+		t.Fatalf("expected failure from hop %v, got %v",
+			len(paymentPath)-1, failure.SenderIdx)
+	}
+	if !bytes.Equal(failure.Message, failureData) {
+		t.Fatalf("expected failure %x, got %x", failureData,
+			failure.Message)
+	}
+}
+
+// TestCircuitStoreGarbageCollector checks that circuits are removed once
+// their expiry height has passed.
+func TestCircuitStoreGarbageCollector(t *testing.T) {
+	store, notifier, tracker := startup(t)
+	defer shutdown(store)
+
+	_, paymentPath := newTestPath(t, 1)
+	sessionKey, _ := btcec.NewPrivateKey(btcec.S256())
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+
+	key := CircuitKey{AttemptID: 1}
+	if err := store.Put(key, expiry, circuit); err != nil {
+		t.Fatalf("unable to store circuit: %v", err)
+	}
+
+	// The circuit must survive the block at its expiry height.
+	notifier.NotifyBlock(int32(expiry))
+	if err := tracker.WaitForHeight(expiry, 5*time.Second); err != nil {
+		t.Fatalf("garbage collector didn't prune: %v", err)
+	}
+
+	if _, err := store.Get(key); err != nil {
+		t.Fatalf("circuit incorrectly garbage collected: %v", err)
+	}
+
+	notifier.NotifyBlock(int32(expiry + 1))
+	if err := tracker.WaitForHeight(expiry+1, 5*time.Second); err != nil {
+		t.Fatalf("garbage collector didn't prune: %v", err)
+	}
+
+	if _, err := store.Get(key); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+}
+
+// TestCircuitStoreReplaceExpiry checks that replacing a circuit with one of a
+// later expiry height protects it from the garbage collection of the former.
+func TestCircuitStoreReplaceExpiry(t *testing.T) {
+	store, notifier, tracker := startup(t)
+	defer shutdown(store)
+
+	_, paymentPath := newTestPath(t, 1)
+	sessionKey, _ := btcec.NewPrivateKey(btcec.S256())
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+
+	key := CircuitKey{AttemptID: 1}
+	if err := store.Put(key, expiry, circuit); err != nil {
+		t.Fatalf("unable to store circuit: %v", err)
+	}
+	if err := store.Put(key, expiry+10, circuit); err != nil {
+		t.Fatalf("unable to replace circuit: %v", err)
+	}
+
+	notifier.NotifyBlock(int32(expiry + 1))
+	if err := tracker.WaitForHeight(expiry+1, 5*time.Second); err != nil {
+		t.Fatalf("garbage collector didn't prune: %v", err)
+	}
+
+	if _, err := store.Get(key); err != nil {
+		t.Fatalf("circuit incorrectly garbage collected: %v", err)
+	}
+
+	notifier.NotifyBlock(int32(expiry + 11))
+	if err := tracker.WaitForHeight(expiry+11, 5*time.Second); err != nil {
+		t.Fatalf("garbage collector didn't prune: %v", err)
+	}
+
+	if _, err := store.Get(key); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+}
+
+// TestCircuitStoreStartStop checks that starting or stopping a CircuitStore
+// more than once has no effect.
+func TestCircuitStoreStartStop(t *testing.T) {
+	store, _, _ := startup(t)
+	defer os.RemoveAll(testDir)
+
+	if err := store.Start(testDir); err != nil {
+		t.Fatalf("unable to restart circuit store: %v", err)
+	}
+
+	store.Stop()
+	store.Stop()
+}
+
+// TestCircuitStoreStartHeight checks that circuits which expired while the
+// CircuitStore was stopped are removed on Start, and that a CircuitStore
+// without a Notifier can be pruned by the caller.
+func TestCircuitStoreStartHeight(t *testing.T) {
+	defer os.RemoveAll(testDir)
+
+	store := &CircuitStore{}
+	if err := store.Start(testDir); err != nil {
+		t.Fatalf("unable to start circuit store: %v", err)
+	}
+
+	_, paymentPath := newTestPath(t, 1)
+	sessionKey, _ := btcec.NewPrivateKey(btcec.S256())
+	circuit := &sphinx.Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+
+	expiredKey := CircuitKey{AttemptID: 1}
+	if err := store.Put(expiredKey, expiry, circuit); err != nil {
+		t.Fatalf("unable to store circuit: %v", err)
+	}
+	key := CircuitKey{AttemptID: 2}
+	if err := store.Put(key, expiry+10, circuit); err != nil {
+		t.Fatalf("unable to store circuit: %v", err)
+	}
+	store.Stop()
+
+	store = &CircuitStore{StartHeight: expiry + 1}
+	if err := store.Start(testDir); err != nil {
+		t.Fatalf("unable to restart circuit store: %v", err)
+	}
+	defer store.Stop()
+
+	if _, err := store.Get(expiredKey); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+	if _, err := store.Get(key); err != nil {
+		t.Fatalf("circuit incorrectly garbage collected: %v", err)
+	}
+
+	if err := store.Prune(expiry + 11); err != nil {
+		t.Fatalf("unable to prune circuits: %v", err)
+	}
+	if _, err := store.Get(key); err != ErrCircuitNotFound {
+		t.Fatalf("expected ErrCircuitNotFound, got %v", err)
+	}
+}
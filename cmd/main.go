@@ -9,14 +9,16 @@ import (
 	"os"
 	"strings"
 
-	sphinx "github.com/lightningnetwork/lightning-onion"
+	sphinx "github.com/Crypt-iQ/lightning-onion"
+	"github.com/Crypt-iQ/lightning-onion/persistlog"
 	"github.com/roasbeef/btcd/btcec"
 	"github.com/roasbeef/btcd/chaincfg"
 )
 
 // main implements a simple command line utility that can be used in order to
 // either generate a fresh mix-header or decode and fully process an existing
-// one given a private key.
+// one given a private key. It can also export the replay log of a node to a
+// snapshot on stdout, or import such a snapshot from stdin.
 func main() {
 	args := os.Args
 
@@ -24,33 +26,33 @@ func main() {
 
 	if len(args) == 1 {
 		fmt.Printf("Usage: %s (generate|decode) <private-keys>\n", args[0])
+		fmt.Printf("       %s (export|import) <replay-log-dir>\n", args[0])
 	} else if args[1] == "generate" {
 		var privKeys []*btcec.PrivateKey
-		var route []*btcec.PublicKey
+		var hops []sphinx.RouteHop
 		for i, hexKey := range args[2:] {
 			binKey, err := hex.DecodeString(hexKey)
 			if err != nil || len(binKey) != 32 {
 				log.Fatalf("%s is not a valid hex privkey %s", hexKey, err)
 			}
 			privkey, pubkey := btcec.PrivKeyFromBytes(btcec.S256(), binKey)
-			route = append(route, pubkey)
+			hops = append(hops, sphinx.RouteHop{
+				PubKey:    pubkey,
+				ChannelID: uint64(i),
+			})
 			privKeys = append(privKeys, privkey)
 			fmt.Fprintf(os.Stderr, "Node %d pubkey %x\n", i, pubkey.SerializeCompressed())
 		}
 
 		sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{'A'}, 32))
 
-		var hopsData []sphinx.HopData
-		for i := 0; i < len(route); i++ {
-			hopsData = append(hopsData, sphinx.HopData{
-				Realm:         0x00,
-				ForwardAmount: uint32(i),
-				OutgoingCltv:  uint32(i),
-			})
-			copy(hopsData[i].NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
+		route, err := sphinx.BuildRoute(1000, 100, hops)
+		if err != nil {
+			log.Fatalf("Error building route: %v", err)
 		}
 
-		msg, err := sphinx.NewOnionPacket(route, sessionKey, hopsData, assocData)
+		msg, err := sphinx.NewOnionPacket(route.PaymentPath, sessionKey,
+			route.HopsData, assocData)
 		if err != nil {
 			log.Fatalf("Error creating message: %v", err)
 		}
@@ -77,6 +79,10 @@ func main() {
 
 		privkey, _ := btcec.PrivKeyFromBytes(btcec.S256(), binKey)
 		s := sphinx.NewRouter(privkey, &chaincfg.TestNet3Params, nil)
+		if err := s.Start(); err != nil {
+			log.Fatalf("Unable to start router: %v", err)
+		}
+		defer s.Stop()
 
 		var packet sphinx.OnionPacket
 		err = packet.Decode(bytes.NewBuffer(binMsg))
@@ -89,12 +95,41 @@ func main() {
 			log.Fatalf("Failed to decode message: %s", err)
 		}
 
+		// The exit hop has no packet to forward.
+		if p.Action == sphinx.ExitNode {
+			fmt.Println("Reached the exit node")
+			return
+		}
+
 		w := bytes.NewBuffer([]byte{})
-		err = p.Packet.Encode(w)
+		err = p.NextPacket.Encode(w)
 
 		if err != nil {
 			log.Fatalf("Error serializing message: %v", err)
 		}
 		fmt.Printf("%x\n", w.Bytes())
+	} else if args[1] == "export" || args[1] == "import" {
+		if len(args) != 3 {
+			log.Fatalf("Missing replay log directory")
+		}
+
+		d := &persistlog.DecayedLog{}
+		if err := d.Start(args[2]); err != nil {
+			log.Fatalf("Unable to open replay log: %v", err)
+		}
+		defer d.Stop()
+
+		if args[1] == "export" {
+			if err := d.Export(os.Stdout); err != nil {
+				log.Fatalf("Unable to export replay log: %v", err)
+			}
+			return
+		}
+
+		numImported, err := d.Import(os.Stdin)
+		if err != nil {
+			log.Fatalf("Unable to import replay log: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d entries\n", numImported)
 	}
 }
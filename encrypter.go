@@ -0,0 +1,135 @@
+package sphinx
+
+import (
+	"io"
+)
+
+// ErrorEncrypterType identifies the scheme an ErrorEncrypter uses to
+// encrypt failures. The type is serialized along with the encrypter, so a
+// restored encrypter continues to produce failures in the same format.
+type ErrorEncrypterType byte
+
+const (
+	// ErrorEncrypterTypeSphinx denotes an encrypter producing regular
+	// BOLT 04 onion failures, as created by OnionObfuscator.Obfuscate.
+	ErrorEncrypterTypeSphinx ErrorEncrypterType = 1
+
+	// ErrorEncrypterTypeAttributable denotes an encrypter producing
+	// attributable failures, as created by
+	// OnionObfuscator.ObfuscateAttributable.
+	ErrorEncrypterTypeAttributable ErrorEncrypterType = 2
+)
+
+// String returns a human readable string for each of the
+// ErrorEncrypterTypes.
+func (t ErrorEncrypterType) String() string {
+	switch t {
+	case ErrorEncrypterTypeSphinx:
+		return "Sphinx"
+	case ErrorEncrypterTypeAttributable:
+		return "Attributable"
+	default:
+		return "Unknown"
+	}
+}
+
+// valid returns whether the ErrorEncrypterType is known.
+func (t ErrorEncrypterType) valid() bool {
+	switch t {
+	case ErrorEncrypterTypeSphinx, ErrorEncrypterTypeAttributable:
+		return true
+	default:
+		return false
+	}
+}
+
+// errorEncrypterVersion is the current version of the serialized
+// ErrorEncrypter.
+const errorEncrypterVersion = 0
+
+// ErrorEncrypter is used by a relaying node to create failures, or to wrap
+// the failures sent back by downstream nodes, for an HTLC it has forwarded.
+// Unlike OnionObfuscator, an ErrorEncrypter only requires the shared secret
+// of the hop, which is available within the ProcessedPacket. This allows the
+// encrypter to be persisted alongside the circuit of the HTLC and restored
+// after a restart, without requiring access to the node's onion key.
+type ErrorEncrypter struct {
+	encType    ErrorEncrypterType
+	obfuscator OnionObfuscator
+}
+
+// NewErrorEncrypter creates a new ErrorEncrypter of the given type from the
+// shared secret of the hop. ErrUnknownErrorEncrypterType is returned if the
+// type is unknown.
+func NewErrorEncrypter(sharedSecret [sharedSecretSize]byte,
+	encType ErrorEncrypterType) (*ErrorEncrypter, error) {
+
+	if !encType.valid() {
+		return nil, ErrUnknownErrorEncrypterType
+	}
+
+	return &ErrorEncrypter{
+		encType: encType,
+		obfuscator: OnionObfuscator{
+			sharedSecret: sharedSecret,
+		},
+	}, nil
+}
+
+// Type returns the scheme the encrypter uses to encrypt failures.
+func (e *ErrorEncrypter) Type() ErrorEncrypterType {
+	return e.encType
+}
+
+// EncryptError encrypts the failure data. If initial is true, the data is a
+// failure message originating at this node. Otherwise the data is the
+// encrypted failure received from the downstream node, which is wrapped in
+// another layer of encryption. The holdTime in milliseconds is only used by
+// encrypters of type ErrorEncrypterTypeAttributable, and ignored otherwise.
+// ErrFailureTooLarge is returned if an initial failure message is larger
+// than math.MaxUint16 bytes.
+func (e *ErrorEncrypter) EncryptError(initial bool, data []byte,
+	holdTime uint32) ([]byte, error) {
+
+	if e.encType == ErrorEncrypterTypeAttributable {
+		return e.obfuscator.ObfuscateAttributable(initial, data, holdTime)
+	}
+
+	return e.obfuscator.Obfuscate(initial, data)
+}
+
+// Encode writes the serialized encrypter, prefixed by its version and type,
+// into the passed io.Writer.
+func (e *ErrorEncrypter) Encode(w io.Writer) error {
+	if _, err := w.Write([]byte{errorEncrypterVersion}); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte{byte(e.encType)}); err != nil {
+		return err
+	}
+
+	return e.obfuscator.Encode(w)
+}
+
+// Decode restores the encrypter from the serialized form read from the
+// passed io.Reader. An error is returned if the version or the type of the
+// serialized encrypter is unknown.
+func (e *ErrorEncrypter) Decode(r io.Reader) error {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+
+	if header[0] != errorEncrypterVersion {
+		return ErrUnknownErrorEncrypterVersion
+	}
+
+	encType := ErrorEncrypterType(header[1])
+	if !encType.valid() {
+		return ErrUnknownErrorEncrypterType
+	}
+	e.encType = encType
+
+	return e.obfuscator.Decode(r)
+}
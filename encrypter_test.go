@@ -0,0 +1,170 @@
+package sphinx
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+// TestErrorEncrypterRestore checks that the relaying nodes are able to create
+// and wrap failures using encrypters restored from the shared secrets of the
+// processed packets, and that the sender is able to decrypt the result.
+func TestErrorEncrypterRestore(t *testing.T) {
+	const numHops = 3
+
+	nodes, _, fwdMsg, err := newTestRoute(numHops)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	for _, encType := range []ErrorEncrypterType{
+		ErrorEncrypterTypeSphinx, ErrorEncrypterTypeAttributable,
+	} {
+		// Let each node process the packet, persisting an encrypter
+		// for each of them as a switch would.
+		pkt := fwdMsg
+		encodedEncrypters := make([][]byte, numHops)
+		for i, node := range nodes {
+			tempDir := strconv.Itoa(i)
+			if err := node.d.Start(tempDir); err != nil {
+				t.Fatalf("unable to start decayed log: %v", err)
+			}
+
+			processedPacket, err := node.ProcessOnionPacket(pkt, nil)
+			shutdown(tempDir, node.d)
+			if err != nil {
+				t.Fatalf("node %v unable to process packet: %v",
+					i, err)
+			}
+			pkt = processedPacket.NextPacket
+
+			encrypter, err := NewErrorEncrypter(
+				processedPacket.SharedSecret, encType,
+			)
+			if err != nil {
+				t.Fatalf("unable to create encrypter: %v", err)
+			}
+
+			var b bytes.Buffer
+			if err := encrypter.Encode(&b); err != nil {
+				t.Fatalf("unable to encode encrypter: %v", err)
+			}
+			encodedEncrypters[i] = b.Bytes()
+		}
+
+		// After a "restart", the final node creates a failure which is
+		// wrapped by every node on its way back.
+		failureData := []byte("some kek-error data")
+		var data []byte
+		for i := numHops - 1; i >= 0; i-- {
+			var encrypter ErrorEncrypter
+			err := encrypter.Decode(bytes.NewReader(encodedEncrypters[i]))
+			if err != nil {
+				t.Fatalf("unable to decode encrypter: %v", err)
+			}
+			if encrypter.Type() != encType {
+				t.Fatalf("expected encrypter type %v, got %v",
+					encType, encrypter.Type())
+			}
+
+			if i == numHops-1 {
+				data, err = encrypter.EncryptError(true, failureData, 0)
+				if err != nil {
+					t.Fatalf("unable to encrypt failure: %v", err)
+				}
+			} else {
+				data, err = encrypter.EncryptError(false, data, 0)
+				if err != nil {
+					t.Fatalf("unable to encrypt failure: %v", err)
+				}
+			}
+		}
+
+		paymentPath := make([]*btcec.PublicKey, numHops)
+		for i, node := range nodes {
+			paymentPath[i] = node.onionKey.PubKey()
+		}
+		sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+			bytes.Repeat([]byte{'A'}, 32))
+		deobfuscator := NewOnionDeobfuscator(&Circuit{
+			SessionKey:  sessionKey,
+			PaymentPath: paymentPath,
+		})
+
+		var failure *DecryptedFailure
+		if encType == ErrorEncrypterTypeAttributable {
+			attrFailure, err := deobfuscator.DeobfuscateAttributable(data)
+			if err != nil {
+				t.Fatalf("unable to deobfuscate failure: %v", err)
+			}
+			failure = &attrFailure.DecryptedFailure
+		} else {
+			failure, err = deobfuscator.Deobfuscate(data)
+			if err != nil {
+				t.Fatalf("unable to deobfuscate failure: %v", err)
+			}
+		}
+
+		if failure.SenderIdx != numHops-1 {
+			t.Fatalf("expected failure from hop %v, got %v",
+				numHops-1, failure.SenderIdx)
+		}
+		if !bytes.Equal(failure.Message, failureData) {
+			t.Fatalf("data not equals, expected: \"%v\", "+
+				"real: \"%v\"", string(failureData),
+				string(failure.Message))
+		}
+	}
+}
+
+// TestErrorEncrypterDecodeInvalid checks that serialized encrypters with an
+// unknown version or type are rejected.
+func TestErrorEncrypterDecodeInvalid(t *testing.T) {
+	var sharedSecret [sharedSecretSize]byte
+	encrypter, err := NewErrorEncrypter(sharedSecret,
+		ErrorEncrypterTypeSphinx)
+	if err != nil {
+		t.Fatalf("unable to create encrypter: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := encrypter.Encode(&b); err != nil {
+		t.Fatalf("unable to encode encrypter: %v", err)
+	}
+	encoded := b.Bytes()
+
+	unknownVersion := append([]byte(nil), encoded...)
+	unknownVersion[0] = errorEncrypterVersion + 1
+	err = (&ErrorEncrypter{}).Decode(bytes.NewReader(unknownVersion))
+	if err != ErrUnknownErrorEncrypterVersion {
+		t.Fatalf("expected ErrUnknownErrorEncrypterVersion, got %v", err)
+	}
+
+	unknownType := append([]byte(nil), encoded...)
+	unknownType[1] = 0xff
+	err = (&ErrorEncrypter{}).Decode(bytes.NewReader(unknownType))
+	if err != ErrUnknownErrorEncrypterType {
+		t.Fatalf("expected ErrUnknownErrorEncrypterType, got %v", err)
+	}
+
+	// A truncated shared secret must not be silently accepted.
+	err = (&ErrorEncrypter{}).Decode(bytes.NewReader(encoded[:10]))
+	if err == nil {
+		t.Fatalf("expected truncated encrypter to be rejected")
+	}
+}
+
+// TestNewErrorEncrypterInvalid checks that encrypters of an unknown type
+// can't be created.
+func TestNewErrorEncrypterInvalid(t *testing.T) {
+	var sharedSecret [sharedSecretSize]byte
+	for _, encType := range []ErrorEncrypterType{0, 0xff} {
+		_, err := NewErrorEncrypter(sharedSecret, encType)
+		if err != ErrUnknownErrorEncrypterType {
+			t.Fatalf("expected ErrUnknownErrorEncrypterType for "+
+				"type %d, got %v", encType, err)
+		}
+	}
+}
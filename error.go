@@ -8,6 +8,10 @@ var (
 	// attempt.
 	ErrReplayedPacket = fmt.Errorf("sphinx packet replay attempted")
 
+	// ErrExpiredPacket is returned when a packet is rejected during
+	// processing because its outgoing CLTV has already expired.
+	ErrExpiredPacket = fmt.Errorf("sphinx packet has expired")
+
 	// ErrInvalidOnionVersion is returned during decoding of the onion
 	// packet, when the received packet has an unknown version byte.
 	ErrInvalidOnionVersion = fmt.Errorf("invalid onion packet version")
@@ -20,4 +24,69 @@ var (
 	// onion key is invalid.
 	ErrInvalidOnionKey = fmt.Errorf("invalid onion key: pubkey isn't on " +
 		"secp256k1 curve")
+
+	// ErrFailureTooLarge is returned when creating an onion failure whose
+	// message is too large for its two byte length prefix.
+	ErrFailureTooLarge = fmt.Errorf("onion failure message too large")
+
+	// ErrUnknownErrorEncrypterVersion is returned when decoding an
+	// ErrorEncrypter which was serialized with an unknown version.
+	ErrUnknownErrorEncrypterVersion = fmt.Errorf("unknown error " +
+		"encrypter version")
+
+	// ErrUnknownErrorEncrypterType is returned when creating or decoding
+	// an ErrorEncrypter of an unknown type.
+	ErrUnknownErrorEncrypterType = fmt.Errorf("unknown error encrypter " +
+		"type")
+
+	// ErrUnknownCircuitVersion is returned when decoding a circuit which
+	// was serialized with an unknown version.
+	ErrUnknownCircuitVersion = fmt.Errorf("unknown circuit version")
+
+	// ErrInvalidSessionKey is returned when a session key is missing or
+	// isn't a valid secp256k1 scalar.
+	ErrInvalidSessionKey = fmt.Errorf("invalid session key")
+
+	// ErrInvalidCircuitPathLength is returned when the payment path of a
+	// circuit is empty or exceeds NumMaxHops.
+	ErrInvalidCircuitPathLength = fmt.Errorf("invalid circuit payment " +
+		"path length")
+
+	// ErrInvalidCircuitPubKey is returned when the payment path of a
+	// circuit contains a missing or invalid pub key.
+	ErrInvalidCircuitPubKey = fmt.Errorf("invalid circuit pub key")
+
+	// ErrInvalidCircuitMetadata is returned when the hop metadata of a
+	// circuit doesn't match its payment path.
+	ErrInvalidCircuitMetadata = fmt.Errorf("invalid circuit hop metadata")
+
+	// ErrTooManyCircuits is returned when a multi-path circuit consists of
+	// more circuits than can be serialized.
+	ErrTooManyCircuits = fmt.Errorf("too many circuits in multi-path " +
+		"circuit")
+
+	// ErrInvalidRoutePubKey is returned when building a route or an onion
+	// packet for a payment path containing a missing pub key, or one which
+	// isn't on the secp256k1 curve.
+	ErrInvalidRoutePubKey = fmt.Errorf("invalid route pub key")
+
+	// ErrRouteOverflow is returned when the amount or time-lock of a route
+	// overflows while adding the fees and CLTV deltas of its hops.
+	ErrRouteOverflow = fmt.Errorf("route amount or time-lock overflows")
+
+	// ErrEmptyPaymentPath is returned when building a route or an onion
+	// packet for an empty payment path. A payment path with more than
+	// NumMaxHops hops is rejected with a *PayloadOverflowError instead, as
+	// its per-hop payloads don't fit within the routing info.
+	ErrEmptyPaymentPath = fmt.Errorf("payment path is empty")
+
+	// ErrHopDataMismatch is returned when constructing an onion packet
+	// whose number of per-hop payloads differs from the number of hops of
+	// its payment path.
+	ErrHopDataMismatch = fmt.Errorf("number of per-hop payloads doesn't " +
+		"match the payment path")
+
+	// ErrInvalidRootKey is returned when deriving a session key from a
+	// root secret shorter than MinRootKeySize.
+	ErrInvalidRootKey = fmt.Errorf("root secret is too short")
 )
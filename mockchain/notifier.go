@@ -0,0 +1,181 @@
+package mockchain
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/roasbeef/btcd/chaincfg/chainhash"
+	"github.com/roasbeef/btcd/wire"
+)
+
+// epochClient is a registered receiver of the block epochs of a Notifier.
+type epochClient struct {
+	epochs chan *chainntnfs.BlockEpoch
+	cancel chan struct{}
+}
+
+// Notifier is a chainntnfs.ChainNotifier whose blocks are driven by the
+// caller, allowing the garbage collectors of the replay logs to be tested
+// deterministically. Only block epoch notifications are supported.
+type Notifier struct {
+	// notifyMtx serializes NotifyBlock and Stop, so epochs are never sent
+	// on closed channels.
+	notifyMtx sync.Mutex
+
+	mtx      sync.Mutex
+	height   int32
+	nextID   uint64
+	clients  map[uint64]*epochClient
+	shutdown bool
+}
+
+// A compile time check to see if Notifier adheres to the ChainNotifier
+// interface.
+var _ chainntnfs.ChainNotifier = (*Notifier)(nil)
+
+// NewNotifier creates a Notifier whose best height is the passed height.
+func NewNotifier(height int32) *Notifier {
+	return &Notifier{
+		height:  height,
+		clients: make(map[uint64]*epochClient),
+	}
+}
+
+// RegisterBlockEpochNtfn registers a receiver of the block epochs sent by
+// NotifyBlock. The epochs channel is closed by Stop.
+func (n *Notifier) RegisterBlockEpochNtfn() (*chainntnfs.BlockEpochEvent,
+	error) {
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	client := &epochClient{
+		epochs: make(chan *chainntnfs.BlockEpoch),
+		cancel: make(chan struct{}),
+	}
+	if n.shutdown {
+		close(client.epochs)
+	}
+
+	id := n.nextID
+	n.nextID++
+	n.clients[id] = client
+
+	var once sync.Once
+	return &chainntnfs.BlockEpochEvent{
+		Epochs: client.epochs,
+		Cancel: func() {
+			once.Do(func() {
+				n.mtx.Lock()
+				delete(n.clients, id)
+				n.mtx.Unlock()
+
+				close(client.cancel)
+			})
+		},
+	}, nil
+}
+
+// RegisterConfirmationsNtfn isn't supported, and returns an event which never
+// fires.
+func (n *Notifier) RegisterConfirmationsNtfn(txid *chainhash.Hash, numConfs,
+	heightHint uint32) (*chainntnfs.ConfirmationEvent, error) {
+
+	return &chainntnfs.ConfirmationEvent{
+		Confirmed:    make(chan *chainntnfs.TxConfirmation),
+		NegativeConf: make(chan int32),
+	}, nil
+}
+
+// RegisterSpendNtfn isn't supported, and returns an event which never fires.
+func (n *Notifier) RegisterSpendNtfn(outpoint *wire.OutPoint,
+	heightHint uint32) (*chainntnfs.SpendEvent, error) {
+
+	return &chainntnfs.SpendEvent{
+		Spend: make(chan *chainntnfs.SpendDetail),
+	}, nil
+}
+
+// Start does nothing.
+func (n *Notifier) Start() error {
+	return nil
+}
+
+// Stop closes the epochs channels of every registered receiver, which
+// simulates a shutdown of the chain backend.
+func (n *Notifier) Stop() error {
+	n.notifyMtx.Lock()
+	defer n.notifyMtx.Unlock()
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.shutdown {
+		return nil
+	}
+	n.shutdown = true
+
+	for _, client := range n.clients {
+		close(client.epochs)
+	}
+
+	return nil
+}
+
+// Height returns the height of the last block sent by NotifyBlock, or the
+// initial height.
+func (n *Notifier) Height() int32 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.height
+}
+
+// NotifyBlock sends a block epoch of the passed height to every registered
+// receiver, blocking until each of them has either received it or canceled
+// its registration.
+func (n *Notifier) NotifyBlock(height int32) {
+	n.notifyMtx.Lock()
+	defer n.notifyMtx.Unlock()
+
+	n.mtx.Lock()
+	if n.shutdown {
+		n.mtx.Unlock()
+		return
+	}
+	n.height = height
+
+	clients := make([]*epochClient, 0, len(n.clients))
+	for _, client := range n.clients {
+		clients = append(clients, client)
+	}
+	n.mtx.Unlock()
+
+	var hash chainhash.Hash
+	binary.BigEndian.PutUint32(hash[:4], uint32(height))
+
+	for _, client := range clients {
+		epoch := &chainntnfs.BlockEpoch{
+			Hash:   &hash,
+			Height: height,
+		}
+
+		select {
+		case client.epochs <- epoch:
+		case <-client.cancel:
+		}
+	}
+}
+
+// MineBlocks notifies the passed number of blocks on top of the current
+// height, returning the new height.
+func (n *Notifier) MineBlocks(numBlocks int32) int32 {
+	height := n.Height()
+	for i := int32(0); i < numBlocks; i++ {
+		height++
+		n.NotifyBlock(height)
+	}
+
+	return height
+}
@@ -0,0 +1,66 @@
+package mockchain
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNotifierEpochs checks that every registered receiver gets the notified
+// blocks in order, and that Stop closes their epochs channels.
+func TestNotifierEpochs(t *testing.T) {
+	n := NewNotifier(100)
+
+	var events []<-chan struct{}
+	for i := 0; i < 2; i++ {
+		epochClient, err := n.RegisterBlockEpochNtfn()
+		if err != nil {
+			t.Fatalf("unable to register for epochs: %v", err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			want := int32(101)
+			for epoch := range epochClient.Epochs {
+				if epoch.Height != want {
+					t.Errorf("expected height %v, got %v",
+						want, epoch.Height)
+				}
+				want++
+			}
+		}()
+		events = append(events, done)
+	}
+
+	if height := n.MineBlocks(3); height != 103 {
+		t.Fatalf("expected height 103, got %v", height)
+	}
+
+	n.Stop()
+	for _, done := range events {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("epochs channel wasn't closed")
+		}
+	}
+}
+
+// TestNotifierCancel checks that NotifyBlock doesn't block on receivers which
+// canceled their registration.
+func TestNotifierCancel(t *testing.T) {
+	n := NewNotifier(0)
+
+	epochClient, err := n.RegisterBlockEpochNtfn()
+	if err != nil {
+		t.Fatalf("unable to register for epochs: %v", err)
+	}
+	epochClient.Cancel()
+	epochClient.Cancel()
+
+	n.NotifyBlock(1)
+	if n.Height() != 1 {
+		t.Fatalf("expected height 1, got %v", n.Height())
+	}
+}
@@ -0,0 +1,91 @@
+package mockchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GCTracker records the heights a garbage collector has pruned at, allowing
+// tests to wait for garbage collection to complete instead of sleeping. Its
+// OnPrune and OnError methods are meant to be installed as the OnPrune and
+// OnError hooks of a replay log or CircuitStore.
+type GCTracker struct {
+	mtx     sync.Mutex
+	height  uint32
+	err     error
+	updated chan struct{}
+}
+
+// NewGCTracker creates a GCTracker which hasn't observed any height yet.
+func NewGCTracker() *GCTracker {
+	return &GCTracker{
+		updated: make(chan struct{}),
+	}
+}
+
+// OnPrune records that garbage collection at the passed height has completed,
+// waking up the callers of WaitForHeight.
+func (t *GCTracker) OnPrune(height uint32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if height > t.height {
+		t.height = height
+	}
+
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+// OnError records a failure of the garbage collector, waking up the callers
+// of WaitForHeight so that they fail with it instead of timing out.
+func (t *GCTracker) OnError(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.err = err
+
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+// Height returns the highest height garbage collection has completed at.
+func (t *GCTracker) Height() uint32 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.height
+}
+
+// WaitForHeight blocks until garbage collection has completed at the passed
+// height or above. An error is returned if this doesn't happen within the
+// passed timeout, or if the garbage collector reported a failure before
+// reaching the height.
+func (t *GCTracker) WaitForHeight(height uint32, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		t.mtx.Lock()
+		reached := t.height >= height
+		err := t.err
+		updated := t.updated
+		t.mtx.Unlock()
+
+		if reached {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("garbage collection failed before "+
+				"reaching height %v: %v", height, err)
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return fmt.Errorf("garbage collection didn't reach "+
+				"height %v within %v", height, timeout)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package mockchain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGCTrackerWaitForHeight checks that WaitForHeight returns once the
+// height is reached, and times out otherwise.
+func TestGCTrackerWaitForHeight(t *testing.T) {
+	tracker := NewGCTracker()
+
+	go func() {
+		for height := uint32(1); height <= 5; height++ {
+			tracker.OnPrune(height)
+		}
+	}()
+
+	if err := tracker.WaitForHeight(5, 5*time.Second); err != nil {
+		t.Fatalf("unable to wait for height: %v", err)
+	}
+
+	if err := tracker.WaitForHeight(6, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout waiting for unreached height")
+	}
+}
+
+// TestGCTrackerOnError checks that a reported failure makes WaitForHeight
+// return promptly with the error, unless the height has been reached.
+func TestGCTrackerOnError(t *testing.T) {
+	tracker := NewGCTracker()
+	tracker.OnPrune(1)
+	tracker.OnError(errors.New("prune failed"))
+
+	if err := tracker.WaitForHeight(1, 5*time.Second); err != nil {
+		t.Fatalf("unable to wait for reached height: %v", err)
+	}
+
+	start := time.Now()
+	err := tracker.WaitForHeight(2, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "prune failed") {
+		t.Fatalf("expected the reported failure, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("WaitForHeight didn't return promptly")
+	}
+}
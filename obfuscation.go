@@ -3,12 +3,75 @@ package sphinx
 import (
 	"crypto/hmac"
 	"crypto/sha256"
-	"errors"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 
 	"github.com/roasbeef/btcd/btcec"
 )
 
+const (
+	// failureMessageMinSize is the minimum size of the failure message
+	// and its padding, excluding the two length prefixes. BOLT 04 requires
+	// every failure to be padded to at least this size so that the
+	// length of the encrypted blob doesn't reveal the type of the failure.
+	failureMessageMinSize = 256
+
+	// failureLenSize is the size of the length prefixes used for both the
+	// failure message and the padding.
+	failureLenSize = 2
+)
+
+// encodeFailureMessage serializes the failure message into the format
+// mandated by BOLT 04: the message length, the message itself, the length of
+// the padding and finally the zero padding which brings the message up to
+// failureMessageMinSize bytes. ErrFailureTooLarge is returned if the length
+// of the message doesn't fit its length prefix.
+func encodeFailureMessage(msg []byte) ([]byte, error) {
+	if len(msg) > math.MaxUint16 {
+		return nil, ErrFailureTooLarge
+	}
+
+	padLen := 0
+	if len(msg) < failureMessageMinSize {
+		padLen = failureMessageMinSize - len(msg)
+	}
+
+	payload := make([]byte, 2*failureLenSize+len(msg)+padLen)
+	binary.BigEndian.PutUint16(payload[:failureLenSize], uint16(len(msg)))
+	copy(payload[failureLenSize:], msg)
+
+	offset := failureLenSize + len(msg)
+	binary.BigEndian.PutUint16(payload[offset:], uint16(padLen))
+
+	return payload, nil
+}
+
+// decodeFailureMessage strips the length prefixes and padding from a
+// serialized failure, returning the original failure message. False is
+// returned if the encoded lengths don't add up to the size of the payload, or
+// if the message has been padded to less than failureMessageMinSize bytes.
+func decodeFailureMessage(payload []byte) ([]byte, bool) {
+	if len(payload) < 2*failureLenSize+failureMessageMinSize {
+		return nil, false
+	}
+
+	msgLen := int(binary.BigEndian.Uint16(payload[:failureLenSize]))
+	if failureLenSize+msgLen+failureLenSize > len(payload) {
+		return nil, false
+	}
+	msg := payload[failureLenSize : failureLenSize+msgLen]
+
+	offset := failureLenSize + msgLen
+	padLen := int(binary.BigEndian.Uint16(payload[offset:]))
+	if offset+failureLenSize+padLen != len(payload) {
+		return nil, false
+	}
+
+	return msg, true
+}
+
 // onionObfuscation obfuscates the data with compliance with BOLT#4.
 //
 // In context of Lightning Network this function is used by sender to obfuscate
@@ -58,21 +121,34 @@ func NewOnionObfuscator(router *Router, ephemeralKey *btcec.PublicKey) (*OnionOb
 // valuable information. The reason for using onion obfuscation is to not give
 // away to the nodes in the payment path the information about the exact failure
 // and its origin.
-func (o *OnionObfuscator) Obfuscate(initial bool, data []byte) []byte {
+//
+// During the initial obfuscation the failure message is length-prefixed and
+// padded to at least failureMessageMinSize bytes before the hmac is
+// prepended, so all failures of a typical size are indistinguishable by their
+// length. ErrFailureTooLarge is returned if the failure message is larger
+// than math.MaxUint16 bytes.
+func (o *OnionObfuscator) Obfuscate(initial bool, data []byte) ([]byte,
+	error) {
+
 	if initial {
+		payload, err := encodeFailureMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
 		umKey := generateKey("um", o.sharedSecret)
 		hash := hmac.New(sha256.New, umKey[:])
-		hash.Write(data)
+		hash.Write(payload)
 		h := hash.Sum(nil)
-		data = append(h, data...)
+		data = append(h, payload...)
 	}
 
-	return onionObfuscation(o.sharedSecret, data)
+	return onionObfuscation(o.sharedSecret, data), nil
 }
 
 // Decode initializes the obfuscator from the byte stream.
 func (o *OnionObfuscator) Decode(r io.Reader) error {
-	_, err := r.Read(o.sharedSecret[:])
+	_, err := io.ReadFull(r, o.sharedSecret[:])
 	return err
 }
 
@@ -82,78 +158,6 @@ func (o *OnionObfuscator) Encode(w io.Writer) error {
 	return err
 }
 
-// Circuit is used encapsulate the data which is needed for data deobfuscation.
-type Circuit struct {
-	// SessionKey is the key which have been used during generation of the
-	// shared secrets.
-	SessionKey *btcec.PrivateKey
-
-	// PaymentPath is the pub keys of the nodes in the payment path.
-	PaymentPath []*btcec.PublicKey
-}
-
-// Decode initializes the circuit from the byte stream.
-func (c *Circuit) Decode(r io.Reader) error {
-	var keyLength [1]byte
-	if _, err := r.Read(keyLength[:]); err != nil {
-		return err
-	}
-
-	sessionKeyData := make([]byte, uint8(keyLength[0]))
-	if _, err := r.Read(sessionKeyData[:]); err != nil {
-		return err
-	}
-
-	c.SessionKey, _ = btcec.PrivKeyFromBytes(btcec.S256(), sessionKeyData)
-	var pathLength [1]byte
-	if _, err := r.Read(pathLength[:]); err != nil {
-		return err
-	}
-	c.PaymentPath = make([]*btcec.PublicKey, uint8(pathLength[0]))
-
-	for i := 0; i < len(c.PaymentPath); i++ {
-		var pubKeyData [btcec.PubKeyBytesLenCompressed]byte
-		if _, err := r.Read(pubKeyData[:]); err != nil {
-			return err
-		}
-
-		pubKey, err := btcec.ParsePubKey(pubKeyData[:], btcec.S256())
-		if err != nil {
-			return err
-		}
-		c.PaymentPath[i] = pubKey
-	}
-
-	return nil
-}
-
-// Encode writes converted circuit in the byte stream.
-func (c *Circuit) Encode(w io.Writer) error {
-	var keyLength [1]byte
-	keyLength[0] = uint8(len(c.SessionKey.Serialize()))
-	if _, err := w.Write(keyLength[:]); err != nil {
-		return err
-	}
-
-	if _, err := w.Write(c.SessionKey.Serialize()); err != nil {
-		return err
-	}
-
-	var pathLength [1]byte
-	pathLength[0] = uint8(len(c.PaymentPath))
-	if _, err := w.Write(pathLength[:]); err != nil {
-		return err
-	}
-
-	for _, pubKey := range c.PaymentPath {
-		if _, err := w.Write(pubKey.SerializeCompressed()); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 // OnionDeobfuscator represents the serializable object which encapsulate the
 // all necessary data to properly de-obfuscate previously obfuscated data.
 // In context of Lightning Network the data which have to be deobfuscated
@@ -169,11 +173,77 @@ func NewOnionDeobfuscator(circuit *Circuit) *OnionDeobfuscator {
 	}
 }
 
+// DecryptedFailure is the result of successfully deobfuscating an onion
+// failure.
+type DecryptedFailure struct {
+	// Sender is the node which originated the failure.
+	Sender *btcec.PublicKey
+
+	// SenderIdx is the index of the originating node within the payment
+	// path. An index of zero denotes the first hop of the route.
+	SenderIdx int
+
+	// Message is the failure message with its padding stripped.
+	Message []byte
+}
+
+// UnreadableFailureError is returned when the sender is unable to make sense
+// of an onion failure. The fields of the error carry hints which allow
+// path-finding to penalize the nodes which are most likely responsible.
+type UnreadableFailureError struct {
+	// HopIdx is the index within the payment path of the hop which is
+	// known to have produced the unreadable failure, or -1 if no hop could
+	// be identified. In the latter case the failure was corrupted by one
+	// of the hops while travelling back, and the sender is unable to
+	// determine which one.
+	HopIdx int
+
+	// LengthViolation is true if the failure, or the message within it,
+	// didn't have a length that an honest node would produce.
+	LengthViolation bool
+}
+
+// Error returns a human readable description of the unreadable failure.
+func (e *UnreadableFailureError) Error() string {
+	switch {
+	case e.HopIdx >= 0 && e.LengthViolation:
+		return fmt.Sprintf("unreadable onion failure from hop %v: "+
+			"invalid failure length", e.HopIdx)
+
+	case e.HopIdx >= 0:
+		return fmt.Sprintf("unreadable onion failure from hop %v",
+			e.HopIdx)
+
+	case e.LengthViolation:
+		return "unable to retrieve onion failure: invalid failure length"
+
+	default:
+		return "unable to retrieve onion failure"
+	}
+}
+
 // Deobfuscate makes data deobfuscation. The onion failure is obfuscated in
 // backward manner, starting from the node where error have occurred, so in
 // order to deobfuscate the error we need get all shared secret and apply
-// obfuscation in reverse order.
-func (o *OnionDeobfuscator) Deobfuscate(obfuscatedData []byte) (*btcec.PublicKey, []byte, error) {
+// obfuscation in reverse order. The returned message is the failure with its
+// length prefixes and padding stripped. If the failure can't be read, an
+// *UnreadableFailureError is returned.
+func (o *OnionDeobfuscator) Deobfuscate(obfuscatedData []byte) (*DecryptedFailure,
+	error) {
+
+	// Every honest node pads its failure to the minimum size, so anything
+	// shorter has been tampered with on its way back to us.
+	lengthViolation := len(obfuscatedData) <
+		sha256.Size+2*failureLenSize+failureMessageMinSize
+
+	// The obfuscated data must at least be able to hold the hmac, otherwise
+	// we'd be unable to split it below.
+	if len(obfuscatedData) < sha256.Size {
+		return nil, &UnreadableFailureError{
+			HopIdx:          -1,
+			LengthViolation: true,
+		}
+	}
 
 	for i, sharedSecret := range generateSharedSecrets(o.circuit.PaymentPath,
 		o.circuit.SessionKey) {
@@ -189,12 +259,31 @@ func (o *OnionDeobfuscator) Deobfuscate(obfuscatedData []byte) (*btcec.PublicKey
 		h.Write(data)
 		realMac := h.Sum(nil)
 
-		if hmac.Equal(realMac, expectedMac) {
-			return o.circuit.PaymentPath[i], data, nil
+		if !hmac.Equal(realMac, expectedMac) {
+			continue
 		}
+
+		// The failure has been authenticated by this hop, so if the
+		// padding turns out to be malformed, this hop is to blame.
+		msg, ok := decodeFailureMessage(data)
+		if !ok {
+			return nil, &UnreadableFailureError{
+				HopIdx:          i,
+				LengthViolation: true,
+			}
+		}
+
+		return &DecryptedFailure{
+			Sender:    o.circuit.PaymentPath[i],
+			SenderIdx: i,
+			Message:   msg,
+		}, nil
 	}
 
-	return nil, nil, errors.New("unable to retrieve onion failure")
+	return nil, &UnreadableFailureError{
+		HopIdx:          -1,
+		LengthViolation: lengthViolation,
+	}
 }
 
 // Decode writes converted deobfucator in the byte stream.
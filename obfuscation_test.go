@@ -2,7 +2,10 @@ package sphinx
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
+	"math"
 	"testing"
 
 	"github.com/roasbeef/btcd/btcec"
@@ -37,7 +40,10 @@ func TestOnionFailure(t *testing.T) {
 
 	// Emulate the situation when last hop creates the onion failure
 	// message and send it back.
-	obfuscatedData := obfuscator.Obfuscate(true, failureData)
+	obfuscatedData, err := obfuscator.Obfuscate(true, failureData)
+	if err != nil {
+		t.Fatalf("unable to obfuscate failure: %v", err)
+	}
 
 	// Emulate that failure message is backward obfuscated on every hop.
 	for i := len(errorPath) - 2; i >= 0; i-- {
@@ -46,7 +52,10 @@ func TestOnionFailure(t *testing.T) {
 		obfuscator = &OnionObfuscator{
 			sharedSecret: sharedSecrets[i],
 		}
-		obfuscatedData = obfuscator.Obfuscate(false, obfuscatedData)
+		obfuscatedData, err = obfuscator.Obfuscate(false, obfuscatedData)
+		if err != nil {
+			t.Fatalf("unable to obfuscate failure: %v", err)
+		}
 	}
 
 	// Emulate creation of the deobfuscator on the receiving onion error side.
@@ -57,22 +66,174 @@ func TestOnionFailure(t *testing.T) {
 
 	// Emulate that sender node receive the failure message and trying to
 	// unwrap it, by applying obfuscation and checking the hmac.
-	pubKey, deobfuscatedData, err := deobfuscator.Deobfuscate(obfuscatedData)
+	failure, err := deobfuscator.Deobfuscate(obfuscatedData)
 	if err != nil {
 		t.Fatalf("unable to de-obfuscate the onion failure: %v", err)
 	}
 
 	// We should understand the node from which error have been received.
-	if !bytes.Equal(pubKey.SerializeCompressed(),
+	if !bytes.Equal(failure.Sender.SerializeCompressed(),
 		errorPath[len(errorPath)-1].SerializeCompressed()) {
 		t.Fatalf("unable to properly conclude from which node in " +
 			"the path we received an error")
 	}
 
+	// The index of the failing node should point at the same node.
+	if failure.SenderIdx != len(errorPath)-1 {
+		t.Fatalf("expected failure from hop %v, got %v",
+			len(errorPath)-1, failure.SenderIdx)
+	}
+
 	// Check that message have been properly de-obfuscated.
-	if !bytes.Equal(deobfuscatedData, failureData) {
+	if !bytes.Equal(failure.Message, failureData) {
 		t.Fatalf("data not equals, expected: \"%v\", real: \"%v\"",
-			string(failureData), string(deobfuscatedData))
+			string(failureData), string(failure.Message))
+	}
+}
+
+// TestOnionFailurePadding checks that failures of different sizes are padded
+// to the same length, and that failures which exceed the minimum size are
+// still encoded and decoded correctly.
+func TestOnionFailurePadding(t *testing.T) {
+	var sharedSecret [sha256.Size]byte
+	copy(sharedSecret[:], bytes.Repeat([]byte{0x01}, sha256.Size))
+	obfuscator := &OnionObfuscator{
+		sharedSecret: sharedSecret,
+	}
+
+	expectedLen := sha256.Size + 2*failureLenSize + failureMessageMinSize
+	for _, msgLen := range []int{0, 2, 100, failureMessageMinSize} {
+		obfuscatedData, err := obfuscator.Obfuscate(true, make([]byte, msgLen))
+		if err != nil {
+			t.Fatalf("unable to obfuscate failure: %v", err)
+		}
+		if len(obfuscatedData) != expectedLen {
+			t.Fatalf("failure of %v bytes has length %v, expected %v",
+				msgLen, len(obfuscatedData), expectedLen)
+		}
+	}
+
+	// A failure larger than the minimum size isn't padded at all.
+	msg := bytes.Repeat([]byte{0x02}, failureMessageMinSize+10)
+	payload, err := encodeFailureMessage(msg)
+	if err != nil {
+		t.Fatalf("unable to encode failure message: %v", err)
+	}
+	if len(payload) != len(msg)+2*failureLenSize {
+		t.Fatalf("large failure has length %v, expected %v",
+			len(payload), len(msg)+2*failureLenSize)
+	}
+
+	decodedMsg, ok := decodeFailureMessage(payload)
+	if !ok {
+		t.Fatalf("unable to decode failure message")
+	}
+	if !bytes.Equal(decodedMsg, msg) {
+		t.Fatalf("decoded failure doesn't match: expected %x, got %x",
+			msg, decodedMsg)
+	}
+
+	// The largest failure which fits its length prefix can still be
+	// decoded, while anything larger is refused.
+	msg = make([]byte, math.MaxUint16)
+	payload, err = encodeFailureMessage(msg)
+	if err != nil {
+		t.Fatalf("unable to encode failure message: %v", err)
+	}
+	if decodedMsg, ok := decodeFailureMessage(payload); !ok ||
+		len(decodedMsg) != len(msg) {
+
+		t.Fatalf("unable to decode largest failure message")
+	}
+
+	msg = make([]byte, math.MaxUint16+1)
+	if _, err := obfuscator.Obfuscate(true, msg); err != ErrFailureTooLarge {
+		t.Fatalf("expected ErrFailureTooLarge, got %v", err)
+	}
+	_, err = obfuscator.ObfuscateAttributable(true, msg, 0)
+	if err != ErrFailureTooLarge {
+		t.Fatalf("expected ErrFailureTooLarge, got %v", err)
+	}
+}
+
+// TestOnionFailureInvalidLength checks that authenticated failures with
+// malformed length prefixes or padding are reported as unreadable, blaming
+// the hop which authenticated them.
+func TestOnionFailureInvalidLength(t *testing.T) {
+	paymentPath, err := getSpecPubKeys()
+	if err != nil {
+		t.Fatalf("unable to get specification public keys: %v", err)
+	}
+
+	sessionKey, err := getSpecSessionKey()
+	if err != nil {
+		t.Fatalf("unable to get specification session key: %v", err)
+	}
+	sharedSecrets := generateSharedSecrets(paymentPath, sessionKey)
+
+	validPayload, err := encodeFailureMessage([]byte{0x20, 0x02})
+	if err != nil {
+		t.Fatalf("unable to encode failure message: %v", err)
+	}
+
+	// Claim a message length which runs past the end of the payload.
+	overflowPayload := append([]byte(nil), validPayload...)
+	overflowPayload[0] = 0xff
+
+	// Strip a single byte of padding without adjusting the pad length.
+	shortPadPayload := append([]byte(nil), validPayload[:len(validPayload)-1]...)
+
+	// Produce a payload which isn't padded to the minimum size.
+	unpaddedPayload := []byte{0x00, 0x02, 0x20, 0x02, 0x00, 0x00}
+
+	tests := [][]byte{
+		overflowPayload,
+		shortPadPayload,
+		unpaddedPayload,
+	}
+
+	deobfuscator := NewOnionDeobfuscator(&Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	})
+
+	for i, payload := range tests {
+		// Authenticate the malformed payload correctly, so only the
+		// length checks can cause the failure to be rejected.
+		umKey := generateKey("um", sharedSecrets[0])
+		h := hmac.New(sha256.New, umKey[:])
+		h.Write(payload)
+		data := append(h.Sum(nil), payload...)
+		obfuscatedData := onionObfuscation(sharedSecrets[0], data)
+
+		_, err := deobfuscator.Deobfuscate(obfuscatedData)
+		unreadableErr, ok := err.(*UnreadableFailureError)
+		if !ok {
+			t.Fatalf("test #%v: expected unreadable failure, got %v",
+				i, err)
+		}
+		if unreadableErr.HopIdx != 0 || !unreadableErr.LengthViolation {
+			t.Fatalf("test #%v: expected length violation at hop 0, "+
+				"got %v", i, unreadableErr)
+		}
+	}
+
+	// Data which can't even hold the hmac must also be rejected, though
+	// we're unable to tell which hop is responsible.
+	_, err = deobfuscator.Deobfuscate([]byte{0x01})
+	unreadableErr, ok := err.(*UnreadableFailureError)
+	if !ok || unreadableErr.HopIdx != -1 || !unreadableErr.LengthViolation {
+		t.Fatalf("expected unattributed length violation, got %v", err)
+	}
+
+	// A correctly sized failure which none of the hops authenticated is
+	// unreadable, but doesn't violate the length requirements.
+	garbage := make([]byte, sha256.Size+len(validPayload))
+	_, err = deobfuscator.Deobfuscate(garbage)
+	unreadableErr, ok = err.(*UnreadableFailureError)
+	if !ok || unreadableErr.HopIdx != -1 || unreadableErr.LengthViolation {
+		t.Fatalf("expected unattributed unreadable failure, got %v",
+			err)
 	}
 }
 
@@ -162,8 +323,11 @@ func getSpecSessionKey() (*btcec.PrivateKey, error) {
 	return privKey, nil
 }
 
+// getSpecOnionErrorData returns the raw failure message used within the
+// specification test vectors. The vectors themselves encode this message
+// along with its length prefixes and padding.
 func getSpecOnionErrorData() ([]byte, error) {
-	sData := "0002200200fe0000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+	sData := "2002"
 	return hex.DecodeString(sData)
 }
 
@@ -210,11 +374,17 @@ func TestOnionFailureSpecVector(t *testing.T) {
 		if i == 0 {
 			// Emulate the situation when last hop creates the onion failure
 			// message and send it back.
-			obfuscatedData = obfuscator.Obfuscate(true, failureData)
+			obfuscatedData, err = obfuscator.Obfuscate(true, failureData)
+			if err != nil {
+				t.Fatalf("unable to obfuscate failure: %v", err)
+			}
 		} else {
 			// Emulate the situation when forward node obfuscates
 			// the onion failure.
-			obfuscatedData = obfuscator.Obfuscate(false, obfuscatedData)
+			obfuscatedData, err = obfuscator.Obfuscate(false, obfuscatedData)
+			if err != nil {
+				t.Fatalf("unable to obfuscate failure: %v", err)
+			}
 		}
 
 		// Decode the obfuscated data and check that it matches the
@@ -238,19 +408,19 @@ func TestOnionFailureSpecVector(t *testing.T) {
 
 	// Emulate that sender node receives the failure message and trying to
 	// unwrap it, by applying obfuscation and checking the hmac.
-	pubKey, deobfuscatedData, err := deobfuscator.Deobfuscate(obfuscatedData)
+	failure, err := deobfuscator.Deobfuscate(obfuscatedData)
 	if err != nil {
 		t.Fatalf("unable to de-obfuscate the onion failure: %v", err)
 	}
 
 	// Check that message have been properly de-obfuscated.
-	if !bytes.Equal(deobfuscatedData, failureData) {
+	if !bytes.Equal(failure.Message, failureData) {
 		t.Fatalf("data not equals, expected: \"%v\", real: \"%v\"",
-			string(failureData), string(deobfuscatedData))
+			string(failureData), string(failure.Message))
 	}
 
 	// We should understand the node from which error have been received.
-	if !bytes.Equal(pubKey.SerializeCompressed(),
+	if !bytes.Equal(failure.Sender.SerializeCompressed(),
 		paymentPath[len(paymentPath)-1].SerializeCompressed()) {
 		t.Fatalf("unable to properly conclude from which node in " +
 			"the path we received an error")
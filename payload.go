@@ -0,0 +1,107 @@
+package sphinx
+
+import "fmt"
+
+// PayloadOverflowError is returned when the per-hop payloads of a route don't
+// fit within the routing info of an onion packet.
+type PayloadOverflowError struct {
+	// NumHops is the number of hops of the route.
+	NumHops int
+
+	// Required is the number of bytes of routing info the per-hop
+	// payloads of the route require.
+	Required int
+
+	// Capacity is the size in bytes of the routing info of an onion
+	// packet.
+	Capacity int
+}
+
+// Error returns a human readable description of the overflow.
+func (e *PayloadOverflowError) Error() string {
+	return fmt.Sprintf("payloads of %v hops require %v bytes of routing "+
+		"info, exceeding its capacity of %v bytes", e.NumHops,
+		e.Required, e.Capacity)
+}
+
+// PayloadBudget describes how much of the routing info of an onion packet the
+// payloads of a route consume. Every per-hop payload occupies a fixed frame of
+// hopDataSize bytes, and the routing info following the frame of the final hop
+// can carry custom data for the final hop, see
+// NewOnionPacketWithFinalHopData.
+type PayloadBudget struct {
+	// NumHops is the number of hops of the route.
+	NumHops int
+
+	// UsedBytes is the number of bytes of routing info occupied by the
+	// per-hop payloads and the final hop data.
+	UsedBytes int
+
+	// RemainingBytes is the number of bytes of routing info left unused
+	// by the route.
+	RemainingBytes int
+
+	// MaxFinalHopData is the maximum number of bytes of custom data which
+	// can be placed at the final hop of the route. It's zero for a route
+	// without hops.
+	MaxFinalHopData int
+}
+
+// maxFinalHopData returns the maximum number of bytes of final hop data a
+// route with the passed number of hops can carry.
+func maxFinalHopData(numHops int) int {
+	if numHops == 0 || numHops*hopDataSize > routingInfoSize {
+		return 0
+	}
+
+	return routingInfoSize - numHops*hopDataSize
+}
+
+// checkPayloadSize returns a *PayloadOverflowError if the per-hop payloads of
+// a route with the passed number of hops, along with the passed number of
+// bytes of final hop data, don't fit within the routing info of an onion
+// packet.
+func checkPayloadSize(numHops, finalHopDataSize int) error {
+	required := numHops*hopDataSize + finalHopDataSize
+	if required > routingInfoSize {
+		return &PayloadOverflowError{
+			NumHops:  numHops,
+			Required: required,
+			Capacity: routingInfoSize,
+		}
+	}
+
+	return nil
+}
+
+// NewPayloadBudget computes the PayloadBudget of a route with the passed
+// per-hop payloads and the custom data planned for its final hop, which may
+// be nil. If the payloads don't fit within the routing info of an onion
+// packet, a *PayloadOverflowError is returned. Final hop data can't be placed
+// on a route without hops, which results in ErrEmptyPaymentPath.
+func NewPayloadBudget(hopsData []HopData,
+	finalHopData []byte) (*PayloadBudget, error) {
+
+	numHops := len(hopsData)
+	if numHops == 0 && len(finalHopData) > 0 {
+		return nil, ErrEmptyPaymentPath
+	}
+	if err := checkPayloadSize(numHops, len(finalHopData)); err != nil {
+		return nil, err
+	}
+
+	used := numHops*hopDataSize + len(finalHopData)
+
+	return &PayloadBudget{
+		NumHops:         numHops,
+		UsedBytes:       used,
+		RemainingBytes:  routingInfoSize - used,
+		MaxFinalHopData: maxFinalHopData(numHops),
+	}, nil
+}
+
+// Budget returns the PayloadBudget of the route carrying the passed final hop
+// data, which may be nil.
+func (r *Route) Budget(finalHopData []byte) (*PayloadBudget, error) {
+	return NewPayloadBudget(r.HopsData, finalHopData)
+}
@@ -0,0 +1,167 @@
+package sphinx
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+func TestPayloadBudget(t *testing.T) {
+	budget, err := NewPayloadBudget(make([]HopData, 5), nil)
+	if err != nil {
+		t.Fatalf("unable to compute payload budget: %v", err)
+	}
+
+	if budget.UsedBytes != 5*hopDataSize {
+		t.Fatalf("expected %v used bytes, got %v", 5*hopDataSize,
+			budget.UsedBytes)
+	}
+	if budget.UsedBytes+budget.RemainingBytes != routingInfoSize {
+		t.Fatalf("used and remaining bytes don't add up to %v",
+			routingInfoSize)
+	}
+	if budget.MaxFinalHopData != budget.RemainingBytes {
+		t.Fatalf("expected %v bytes of final hop data, got %v",
+			budget.RemainingBytes, budget.MaxFinalHopData)
+	}
+
+	// Final hop data is accounted, but doesn't change the capacity of
+	// the final hop.
+	finalHopData := make([]byte, 100)
+	budget, err = NewPayloadBudget(make([]HopData, 5), finalHopData)
+	if err != nil {
+		t.Fatalf("unable to compute payload budget: %v", err)
+	}
+	if budget.UsedBytes != 5*hopDataSize+len(finalHopData) ||
+		budget.MaxFinalHopData != routingInfoSize-5*hopDataSize {
+
+		t.Fatalf("final hop data wasn't accounted: %+v", budget)
+	}
+
+	_, err = NewPayloadBudget(make([]HopData, 5),
+		make([]byte, budget.MaxFinalHopData+1))
+	if _, ok := err.(*PayloadOverflowError); !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+
+	_, err = NewPayloadBudget(nil, finalHopData)
+	if err != ErrEmptyPaymentPath {
+		t.Fatalf("expected ErrEmptyPaymentPath, got %v", err)
+	}
+
+	// A full route leaves no routing info unused.
+	budget, err = NewPayloadBudget(make([]HopData, NumMaxHops), nil)
+	if err != nil {
+		t.Fatalf("unable to compute payload budget: %v", err)
+	}
+	if budget.RemainingBytes != 0 || budget.MaxFinalHopData != 0 {
+		t.Fatalf("expected a full budget, got %+v", budget)
+	}
+
+	_, err = NewPayloadBudget(make([]HopData, NumMaxHops+1), nil)
+	overflow, ok := err.(*PayloadOverflowError)
+	if !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+	if overflow.Required != (NumMaxHops+1)*hopDataSize ||
+		overflow.Capacity != routingInfoSize {
+
+		t.Fatalf("unexpected overflow error: %+v", overflow)
+	}
+}
+
+func TestNewOnionPacketOverflow(t *testing.T) {
+	// Constructing a packet for a route which exceeds the routing info
+	// should fail with a typed error instead of panicking.
+	numHops := NumMaxHops + 1
+	route := make([]*btcec.PublicKey, numHops)
+	for i := range route {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		route[i] = privKey.PubKey()
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+	_, err := NewOnionPacket(route, sessionKey, make([]HopData, numHops),
+		nil)
+	overflow, ok := err.(*PayloadOverflowError)
+	if !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+	if overflow.NumHops != numHops {
+		t.Fatalf("expected overflow of %v hops, got %v", numHops,
+			overflow.NumHops)
+	}
+}
+
+// TestFinalHopData checks that custom data of the maximum size reaches the
+// final hop intact, and that larger data is rejected.
+func TestFinalHopData(t *testing.T) {
+	nodes, hopsData, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	paymentPath := make([]*btcec.PublicKey, len(nodes))
+	for i, node := range nodes {
+		paymentPath[i] = node.onionKey.PubKey()
+	}
+
+	budget, err := NewPayloadBudget(*hopsData, nil)
+	if err != nil {
+		t.Fatalf("unable to compute payload budget: %v", err)
+	}
+	finalHopData := make([]byte, budget.MaxFinalHopData)
+	for i := range finalHopData {
+		finalHopData[i] = byte(i)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+	_, err = NewOnionPacketWithFinalHopData(paymentPath, sessionKey,
+		*hopsData, append(finalHopData, 0), nil)
+	if _, ok := err.(*PayloadOverflowError); !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+
+	fwdMsg, err := NewOnionPacketWithFinalHopData(paymentPath, sessionKey,
+		*hopsData, finalHopData, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		tempDir := strconv.Itoa(i)
+		if err := node.d.Start(tempDir); err != nil {
+			t.Fatalf("unable to start replay log: %v", err)
+		}
+		defer shutdown(tempDir, node.d)
+
+		processed, err := node.ProcessOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %v was unable to process the packet: %v",
+				i, err)
+		}
+
+		if i < len(nodes)-1 {
+			if processed.FinalHopData != nil {
+				t.Fatalf("final hop data revealed at hop %v", i)
+			}
+			fwdMsg = processed.NextPacket
+			continue
+		}
+
+		if processed.Action != ExitNode {
+			t.Fatalf("final hop doesn't recognize itself")
+		}
+		received := processed.FinalHopData[:len(finalHopData)]
+		if !bytes.Equal(received, finalHopData) {
+			t.Fatalf("final hop data mismatch: expected %x, got %x",
+				finalHopData, received)
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package persistlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/lightningnetwork/lnd/channeldb"
+)
+
+const (
+	// defaultBucketedDbDirectory is the default directory where the
+	// BucketedLog will store its entries.
+	defaultBucketedDbDirectory = "bucketedhashes"
+
+	// defaultBucketRange is the default number of consecutive CLTV
+	// heights sharing a single height bucket, roughly a day of blocks.
+	defaultBucketRange = 144
+
+	// bucketedLogVersion is the schema version of the BucketedLog.
+	bucketedLogVersion = 1
+)
+
+var (
+	// heightBucketsBucket is a bucket which houses a nested bucket per
+	// range of CLTV heights. The key of each nested bucket is the
+	// big-endian first height of its range, and the nested bucket maps
+	// the keyed hashes of shared secrets to their CLTV.
+	heightBucketsBucket = []byte("height-buckets")
+)
+
+// BucketedLog implements the PersistLog interface. Like the DecayedLog, it
+// stores the keyed hashes of shared secrets along with their CLTV, but
+// partitions the entries into nested buckets, each covering BucketRange
+// consecutive CLTV heights. Garbage collection therefore consists of dropping
+// whole buckets, rather than deleting individual entries.
+//
+// An entry is only removed once every CLTV of its bucket has expired, so it
+// may outlive its CLTV by up to BucketRange-1 blocks. Lookups have to visit
+// every live bucket, so BucketRange trades lookup cost against the delay of
+// garbage collection.
+type BucketedLog struct {
+	// hits, lastPurged and totalPurged are the counters reported by
+	// Stats. They MUST be used atomically.
+	hits        uint64
+	lastPurged  uint64
+	totalPurged uint64
+
+	// bestHeight is the highest block height the BucketedLog has been
+	// garbage collected at. It MUST be used atomically.
+	bestHeight uint32
+
+	db       *channeldb.DB
+	wg       sync.WaitGroup
+	quit     chan (struct{})
+	Notifier chainntnfs.ChainNotifier
+
+	// lifecycleMtx serializes Start and Stop. opsMtx is held for reading
+	// by every operation on the database, and for writing while it's
+	// being closed. started is guarded by opsMtx.
+	lifecycleMtx sync.Mutex
+	opsMtx       sync.RWMutex
+	started      bool
+
+	// StartHeight is the current best height of the chain at the time
+	// the BucketedLog is started. It's optional, and if set, buckets
+	// which expired before this height are dropped on Start.
+	StartHeight uint32
+
+	// OnPrune is called by the garbage collector with the height of every
+	// block epoch it has pruned the BucketedLog at, see
+	// DecayedLog.OnPrune.
+	OnPrune func(height uint32)
+
+	// OnError is called with the failures of the garbage collector, see
+	// DecayedLog.OnError.
+	OnError func(error)
+
+	// BucketRange is the number of consecutive CLTV heights sharing a
+	// single bucket. It can't be changed once the database has been
+	// created. If zero, the range of an existing database is used, or 144
+	// for a new one.
+	BucketRange uint32
+
+	// HashSize is the size in bytes the keyed hashes are truncated to,
+	// see DecayedLog.HashSize.
+	HashSize int
+
+	// bucketRange, salt and hashSize are read from the database on Start.
+	bucketRange uint32
+	salt        []byte
+	hashSize    int
+}
+
+// A compile time check to see if BucketedLog adheres to the PersistLog
+// interface.
+var _ PersistLog = (*BucketedLog)(nil)
+
+// bucketKey returns the key of the height bucket which holds entries with the
+// passed CLTV.
+func (b *BucketedLog) bucketKey(cltv uint32) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], cltv-cltv%b.bucketRange)
+
+	return key[:]
+}
+
+// garbageCollector drops height buckets whose CLTVs have all expired. This
+// function MUST be run as a goroutine.
+func (b *BucketedLog) garbageCollector(
+	epochClient *chainntnfs.BlockEpochEvent) {
+
+	defer b.wg.Done()
+	defer epochClient.Cancel()
+
+	for {
+		select {
+		case epoch, ok := <-epochClient.Epochs:
+			if !ok {
+				b.reportError(fmt.Errorf("Epoch client " +
+					"shutting down"))
+				return
+			}
+
+			// A failed garbage collection is retried with the
+			// next block, as Prune removes every expired entry.
+			if err := b.Prune(uint32(epoch.Height)); err != nil {
+				b.reportError(fmt.Errorf("Error pruning "+
+					"channeldb: %v", err))
+				continue
+			}
+
+			if b.OnPrune != nil {
+				b.OnPrune(uint32(epoch.Height))
+			}
+
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// reportError passes an error of the garbage collector to OnError, if set.
+func (b *BucketedLog) reportError(err error) {
+	if b.OnError != nil {
+		b.OnError(err)
+	}
+}
+
+// acquire ensures that the BucketedLog is started, and prevents it from
+// being stopped until release is called. ErrLogStopped is returned if the
+// BucketedLog isn't started.
+func (b *BucketedLog) acquire() error {
+	b.opsMtx.RLock()
+	if !b.started {
+		b.opsMtx.RUnlock()
+		return ErrLogStopped
+	}
+
+	return nil
+}
+
+// release allows the BucketedLog to be stopped again after acquire.
+func (b *BucketedLog) release() {
+	b.opsMtx.RUnlock()
+}
+
+// Prune drops every height bucket whose CLTVs are all below the passed
+// height. The height is persisted as the height of the last garbage
+// collection, unless a greater height has already been recorded.
+func (b *BucketedLog) Prune(height uint32) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	var numPurged uint64
+	err := b.db.Batch(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("metaBucket is nil")
+		}
+
+		if heightBytes := meta.Get(gcHeightKey); heightBytes == nil ||
+			binary.BigEndian.Uint32(heightBytes) < height {
+
+			var scratch [4]byte
+			binary.BigEndian.PutUint32(scratch[:], height)
+			if err := meta.Put(gcHeightKey, scratch[:]); err != nil {
+				return err
+			}
+		}
+
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		// The buckets are sorted by height, so we can stop at the
+		// first bucket which hasn't fully expired yet.
+		var expired [][]byte
+		c := heightBuckets.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			lastHeight := uint64(binary.BigEndian.Uint32(k)) +
+				uint64(b.bucketRange) - 1
+			if lastHeight >= uint64(height) {
+				break
+			}
+
+			expired = append(expired, k)
+		}
+
+		for _, k := range expired {
+			bucket := heightBuckets.Bucket(k)
+			numPurged += uint64(bucket.Stats().KeyN)
+
+			if err := heightBuckets.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&b.lastPurged, numPurged)
+	atomic.AddUint64(&b.totalPurged, numPurged)
+	updateBestHeight(&b.bestHeight, height)
+
+	return nil
+}
+
+// BestHeight returns the highest block height the BucketedLog knows of.
+func (b *BucketedLog) BestHeight() uint32 {
+	return atomic.LoadUint32(&b.bestHeight)
+}
+
+// retainedHeight returns the lowest CLTV the BucketedLog may still hold an
+// entry for, implementing the retentionLog interface. As whole buckets are
+// dropped, this is the start of the bucket of the best height.
+func (b *BucketedLog) retainedHeight() uint32 {
+	if b.bucketRange == 0 {
+		return 0
+	}
+
+	height := b.BestHeight()
+	return height - height%b.bucketRange
+}
+
+// HashSharedSecret returns the key under which the passed shared secret is
+// stored in the BucketedLog, see DecayedLog.HashSharedSecret.
+func (b *BucketedLog) HashSharedSecret(sharedSecret [sharedSecretSize]byte) []byte {
+	legacyHash := HashSharedSecret(sharedSecret)
+	return keyedHash(b.salt, legacyHash[:], b.hashSize)
+}
+
+// findEntry searches every height bucket for the passed hash, returning the
+// bucket holding it along with its CLTV. A nil bucket is returned if the hash
+// isn't stored.
+func findEntry(heightBuckets *bolt.Bucket, hash []byte) (*bolt.Bucket,
+	uint32) {
+
+	c := heightBuckets.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		bucket := heightBuckets.Bucket(k)
+		if valueBytes := bucket.Get(hash); valueBytes != nil {
+			return bucket, binary.BigEndian.Uint32(valueBytes)
+		}
+	}
+
+	return nil, 0
+}
+
+// Delete removes the entry of the passed hash from its height bucket.
+func (b *BucketedLog) Delete(hash []byte) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		bucket, _ := findEntry(heightBuckets, hash)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete(hash)
+	})
+}
+
+// Get retrieves the CLTV stored for the passed hash. If the hash isn't
+// stored, math.MaxUint32 is returned.
+func (b *BucketedLog) Get(hash []byte) (uint32, error) {
+	if err := b.acquire(); err != nil {
+		return 0, err
+	}
+	defer b.release()
+
+	var value uint32 = math.MaxUint32
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		if bucket, cltv := findEntry(heightBuckets, hash); bucket != nil {
+			value = cltv
+			atomic.AddUint64(&b.hits, 1)
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+// Put stores the passed hash along with its CLTV within the height bucket of
+// the CLTV. A previously stored entry for the same hash keeps the greater of
+// both CLTVs, moving to the height bucket of the new CLTV if needed. If the
+// CLTV has already expired according to the best known height,
+// ErrExpiredEntry is returned and nothing is stored.
+func (b *BucketedLog) Put(hash []byte, cltv uint32) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	if cltv < b.BestHeight() {
+		return ErrExpiredEntry
+	}
+
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], cltv)
+
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		oldBucket, oldCltv := findEntry(heightBuckets, hash)
+		if oldBucket != nil {
+			meta := tx.Bucket(metaBucket)
+			if meta == nil {
+				return fmt.Errorf("metaBucket is nil")
+			}
+
+			if err := incrementCollisions(meta); err != nil {
+				return err
+			}
+
+			if oldCltv >= cltv {
+				return nil
+			}
+
+			if err := oldBucket.Delete(hash); err != nil {
+				return err
+			}
+		}
+
+		bucket, err := heightBuckets.CreateBucketIfNotExists(
+			b.bucketKey(cltv),
+		)
+		if err != nil {
+			return fmt.Errorf("Unable to create height bucket:"+
+				" %v", err)
+		}
+
+		return bucket.Put(hash, scratch[:])
+	})
+}
+
+// ForEach calls the passed function with the hash and CLTV of every stored
+// entry, in ascending order of their height buckets. Iteration stops at the
+// first error returned by the function, which is then returned. The function
+// MUST NOT modify the BucketedLog.
+func (b *BucketedLog) ForEach(f func(hash []byte, cltv uint32) error) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		return heightBuckets.ForEach(func(k, _ []byte) error {
+			bucket := heightBuckets.Bucket(k)
+			return bucket.ForEach(func(hash, v []byte) error {
+				return f(hash, binary.BigEndian.Uint32(v))
+			})
+		})
+	})
+}
+
+// Stats returns a snapshot of statistics about the BucketedLog.
+func (b *BucketedLog) Stats() (*Stats, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	stats := &Stats{
+		BestHeight:  b.BestHeight(),
+		LastPurged:  atomic.LoadUint64(&b.lastPurged),
+		TotalPurged: atomic.LoadUint64(&b.totalPurged),
+		Hits:        atomic.LoadUint64(&b.hits),
+	}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stats.SizeOnDisk = tx.Size()
+
+		heightBuckets := tx.Bucket(heightBucketsBucket)
+		if heightBuckets == nil {
+			return fmt.Errorf("heightBucketsBucket is nil")
+		}
+
+		err := heightBuckets.ForEach(func(k, _ []byte) error {
+			bucket := heightBuckets.Bucket(k)
+			return bucket.ForEach(func(_, v []byte) error {
+				cltv := binary.BigEndian.Uint32(v)
+				if stats.NumEntries == 0 || cltv < stats.OldestCltv {
+					stats.OldestCltv = cltv
+				}
+				if cltv > stats.NewestCltv {
+					stats.NewestCltv = cltv
+				}
+				stats.NumEntries++
+
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("metaBucket is nil")
+		}
+		if collisionBytes := meta.Get(collisionsKey); collisionBytes != nil {
+			stats.Collisions = binary.BigEndian.Uint64(collisionBytes)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// init creates the buckets and metadata of a new database, or loads and
+// validates the metadata of an existing one.
+func (b *BucketedLog) init(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(heightBucketsBucket); err != nil {
+		return fmt.Errorf("Unable to create bucket heightBuckets:"+
+			" %v", err)
+	}
+
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return fmt.Errorf("Unable to create bucket meta:"+
+			" %v", err)
+	}
+
+	// A database without a version has just been created.
+	versionBytes := meta.Get(versionKey)
+	if versionBytes == nil {
+		bucketRange := b.BucketRange
+		if bucketRange == 0 {
+			bucketRange = defaultBucketRange
+		}
+
+		salt, hashSize, err := writeKeyedHashParams(meta, b.HashSize)
+		if err != nil {
+			return err
+		}
+
+		// bolt references the values until the transaction commits,
+		// so each of them needs its own buffer.
+		var rangeScratch, versionScratch [4]byte
+		binary.BigEndian.PutUint32(rangeScratch[:], bucketRange)
+		if err := meta.Put(bucketRangeKey, rangeScratch[:]); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(versionScratch[:], bucketedLogVersion)
+		if err := meta.Put(versionKey, versionScratch[:]); err != nil {
+			return err
+		}
+
+		b.bucketRange = bucketRange
+		b.salt = salt
+		b.hashSize = hashSize
+
+		return nil
+	}
+
+	if binary.BigEndian.Uint32(versionBytes) > bucketedLogVersion {
+		return ErrNewerDBVersion
+	}
+
+	rangeBytes := meta.Get(bucketRangeKey)
+	if len(rangeBytes) != 4 {
+		return fmt.Errorf("invalid bucket range metadata")
+	}
+	bucketRange := binary.BigEndian.Uint32(rangeBytes)
+	if b.BucketRange != 0 && b.BucketRange != bucketRange {
+		return ErrBucketRangeMismatch
+	}
+
+	salt, hashSize, err := readKeyedHashParams(meta, b.HashSize)
+	if err != nil {
+		return err
+	}
+
+	b.bucketRange = bucketRange
+	b.salt = salt
+	b.hashSize = hashSize
+
+	return nil
+}
+
+// Start opens the database we will be using to store hashed shared secrets.
+// It immediately drops the buckets which expired while the BucketedLog was
+// stopped, and starts the garbage collector in a goroutine. Calling Start on
+// a started BucketedLog has no effect.
+func (b *BucketedLog) Start(dbDir string) error {
+	b.lifecycleMtx.Lock()
+	defer b.lifecycleMtx.Unlock()
+
+	b.opsMtx.RLock()
+	started := b.started
+	b.opsMtx.RUnlock()
+	if started {
+		return nil
+	}
+
+	// Create the quit channel
+	b.quit = make(chan struct{})
+
+	directory := dbDir
+	if directory == "" {
+		directory = defaultBucketedDbDirectory
+	}
+
+	// Open the channeldb for use.
+	var err error
+	if b.db, err = channeldb.Open(directory); err != nil {
+		return fmt.Errorf("Could not open channeldb: %v", err)
+	}
+
+	var gcHeight uint32
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.init(tx); err != nil {
+			return err
+		}
+
+		heightBytes := tx.Bucket(metaBucket).Get(gcHeightKey)
+		if heightBytes != nil {
+			gcHeight = binary.BigEndian.Uint32(heightBytes)
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.db.Close()
+		return err
+	}
+
+	b.opsMtx.Lock()
+	b.started = true
+	b.opsMtx.Unlock()
+
+	// Catch up on the buckets which expired while we were offline, using
+	// the best height we know of.
+	atomic.StoreUint32(&b.bestHeight, 0)
+	atomic.StoreUint64(&b.hits, 0)
+	atomic.StoreUint64(&b.lastPurged, 0)
+	atomic.StoreUint64(&b.totalPurged, 0)
+	if b.StartHeight > gcHeight {
+		gcHeight = b.StartHeight
+	}
+	if gcHeight > 0 {
+		if err := b.Prune(gcHeight); err != nil {
+			b.close()
+			return fmt.Errorf("Unable to prune channeldb: %v", err)
+		}
+	}
+
+	// Start garbage collector.
+	if b.Notifier != nil {
+		epochClient, err := b.Notifier.RegisterBlockEpochNtfn()
+		if err != nil {
+			b.close()
+			return fmt.Errorf("Unable to register for epoch "+
+				"notification: %v", err)
+		}
+
+		b.wg.Add(1)
+		go b.garbageCollector(epochClient)
+	}
+
+	return nil
+}
+
+// Stop halts the garbage collector and closes channeldb. Operations on a
+// stopped BucketedLog fail with ErrLogStopped. Calling Stop on a BucketedLog
+// which isn't started has no effect.
+func (b *BucketedLog) Stop() {
+	b.lifecycleMtx.Lock()
+	defer b.lifecycleMtx.Unlock()
+
+	b.opsMtx.RLock()
+	started := b.started
+	b.opsMtx.RUnlock()
+	if !started {
+		return
+	}
+
+	// Stop garbage collector.
+	close(b.quit)
+	b.wg.Wait()
+
+	// Close channeldb.
+	b.close()
+}
+
+// close waits for the pending operations to complete, marks the BucketedLog
+// as stopped and closes channeldb.
+func (b *BucketedLog) close() {
+	b.opsMtx.Lock()
+	defer b.opsMtx.Unlock()
+
+	b.started = false
+	b.db.Close()
+}
@@ -0,0 +1,318 @@
+package persistlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"sync"
+	"testing"
+)
+
+// startupBucketed starts a BucketedLog with the given bucket range, backed by
+// a temporary database.
+func startupBucketed(t testing.TB, bucketRange uint32) *BucketedLog {
+	b := &BucketedLog{BucketRange: bucketRange}
+	if err := b.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start BucketedLog: %v", err)
+	}
+
+	return b
+}
+
+// TestBucketedLogStorageAndRetrieval checks that entries can be stored,
+// retrieved, moved to a different height bucket and deleted.
+func TestBucketedLogStorageAndRetrieval(t *testing.T) {
+	b := startupBucketed(t, 10)
+	defer shutdown(b)
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	hash := b.HashSharedSecret(secret)
+
+	if err := b.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	val, err := b.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+
+	// Storing the hash again with a CLTV of another bucket must move it.
+	if err := b.Put(hash, cltv+100); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	var numEntries int
+	err = b.ForEach(func(h []byte, c uint32) error {
+		numEntries++
+		if !bytes.Equal(h, hash) || c != cltv+100 {
+			t.Fatalf("Unexpected entry %x with cltv %v", h, c)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to iterate over entries: %v", err)
+	}
+	if numEntries != 1 {
+		t.Fatalf("Expected 1 entry, found %v", numEntries)
+	}
+
+	if err := b.Delete(hash); err != nil {
+		t.Fatalf("Unable to delete from channeldb: %v", err)
+	}
+	val, err = b.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("Entry was not deleted")
+	}
+}
+
+// TestBucketedLogPrune checks that a height bucket is only dropped once
+// every CLTV within its range has expired.
+func TestBucketedLogPrune(t *testing.T) {
+	const bucketRange = 10
+
+	b := startupBucketed(t, bucketRange)
+	defer shutdown(b)
+
+	// Store entries within the buckets starting at base and base+10.
+	base := cltv - cltv%bucketRange
+	hashes := make([][]byte, 4)
+	cltvs := []uint32{base, base + 9, base + 10, base + 15}
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		if err := b.Put(hashes[i], cltvs[i]); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	// At base+9, the first entry has expired, but its bucket still holds
+	// a live entry.
+	if err := b.Prune(base + 9); err != nil {
+		t.Fatalf("Unable to prune BucketedLog: %v", err)
+	}
+	if val, _ := b.Get(hashes[0]); val != cltvs[0] {
+		t.Fatalf("Bucket was dropped early")
+	}
+
+	// At base+10, the whole first bucket has expired.
+	if err := b.Prune(base + 10); err != nil {
+		t.Fatalf("Unable to prune BucketedLog: %v", err)
+	}
+	for i, hash := range hashes {
+		val, err := b.Get(hash)
+		if err != nil {
+			t.Fatalf("Get failed - received an error upon Get: %v",
+				err)
+		}
+
+		expired := i < 2
+		if expired && val != math.MaxUint32 {
+			t.Fatalf("entry %v was not pruned", i)
+		}
+		if !expired && val != cltvs[i] {
+			t.Fatalf("entry %v was incorrectly pruned", i)
+		}
+	}
+
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 2 || stats.LastPurged != 2 ||
+		stats.OldestCltv != base+10 || stats.NewestCltv != base+15 {
+
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Entries which have already expired are rejected.
+	if err := b.Put(hashes[0], base+9); err != ErrExpiredEntry {
+		t.Fatalf("Expected ErrExpiredEntry, got %v", err)
+	}
+}
+
+// TestBucketedLogRestart checks that entries, the salt and the bucket range
+// survive a restart, and that the bucket range can't be changed.
+func TestBucketedLogRestart(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	b := startupBucketed(t, 10)
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	hash := b.HashSharedSecret(secret)
+	if err := b.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	b.Stop()
+
+	b = &BucketedLog{BucketRange: 20}
+	if err := b.Start("tempdir"); err != ErrBucketRangeMismatch {
+		t.Fatalf("Expected ErrBucketRangeMismatch, got %v", err)
+	}
+
+	b = &BucketedLog{StartHeight: cltv}
+	if err := b.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart BucketedLog: %v", err)
+	}
+	defer b.Stop()
+
+	if !bytes.Equal(b.HashSharedSecret(secret), hash) {
+		t.Fatalf("Hash changed across restarts")
+	}
+	val, err := b.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+	if b.BestHeight() != cltv {
+		t.Fatalf("Expected best height %v, got %v", cltv,
+			b.BestHeight())
+	}
+}
+
+// fillLog concurrently stores perHeight entries for each of numHeights
+// consecutive CLTVs starting at base, so that writes are batched.
+func fillLog(tb testing.TB, log PersistLog, base, numHeights,
+	perHeight uint32) {
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, numHeights*perHeight)
+	for h := uint32(0); h < numHeights; h++ {
+		for i := uint32(0); i < perHeight; i++ {
+			wg.Add(1)
+			go func(cltv, i uint32) {
+				defer wg.Done()
+
+				hash := make([]byte, sharedHashSize)
+				binary.BigEndian.PutUint32(hash[:4], cltv)
+				binary.BigEndian.PutUint32(hash[4:8], i)
+				errChan <- log.Put(hash, cltv)
+			}(base+h, i)
+		}
+	}
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		if err != nil {
+			tb.Fatalf("Unable to store in log: %v", err)
+		}
+	}
+}
+
+// benchmarkPut measures the throughput of concurrent inserts.
+func benchmarkPut(b *testing.B, log PersistLog) {
+	defer shutdown(log)
+
+	var counter uint32
+	var mtx sync.Mutex
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mtx.Lock()
+			counter++
+			i := counter
+			mtx.Unlock()
+
+			hash := make([]byte, sharedHashSize)
+			binary.BigEndian.PutUint32(hash, i)
+			if err := log.Put(hash, cltv+i%1000); err != nil {
+				b.Fatalf("Unable to store in log: %v", err)
+			}
+		}
+	})
+}
+
+// benchmarkPrune measures the throughput of garbage collection, pruning one
+// block at a time over a range of heights with many entries each.
+func benchmarkPrune(b *testing.B, log PersistLog) {
+	defer shutdown(log)
+
+	const (
+		numHeights = 20
+		perHeight  = 100
+	)
+
+	for i := 0; i < b.N; i++ {
+		base := cltv + uint32(i)*numHeights
+
+		b.StopTimer()
+		fillLog(b, log, base, numHeights, perHeight)
+		b.StartTimer()
+
+		for h := base; h <= base+numHeights; h++ {
+			if err := log.Prune(h); err != nil {
+				b.Fatalf("Unable to prune log: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecayedLogPut(b *testing.B) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		b.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+
+	benchmarkPut(b, d)
+}
+
+func BenchmarkBucketedLogPut(b *testing.B) {
+	benchmarkPut(b, startupBucketed(b, 1))
+}
+
+func BenchmarkDecayedLogPrune(b *testing.B) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		b.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+
+	benchmarkPrune(b, d)
+}
+
+func BenchmarkBucketedLogPrune(b *testing.B) {
+	benchmarkPrune(b, startupBucketed(b, 1))
+}
+
+// TestBucketedLogStartStop checks that starting or stopping a BucketedLog
+// more than once has no effect.
+func TestBucketedLogStartStop(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	b := &BucketedLog{BucketRange: 10}
+	b.Stop()
+
+	if err := b.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start BucketedLog: %v", err)
+	}
+	if err := b.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start BucketedLog again: %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := b.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	b.Stop()
+	b.Stop()
+
+	// The BucketedLog can be started again after being stopped.
+	if err := b.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart BucketedLog: %v", err)
+	}
+	defer b.Stop()
+
+	if val, _ := b.Get(hash); val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+}
@@ -1,11 +1,15 @@
 package persistlog
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/lightningnetwork/lnd/chainntnfs"
@@ -24,6 +28,22 @@ const (
 
 	// sharedSecretSize is the size in bytes of the shared secrets.
 	sharedSecretSize = 32
+
+	// saltSize is the size in bytes of the random per-database salt used
+	// to key the hashes of shared secrets.
+	saltSize = 32
+
+	// defaultHashSize is the default size in bytes of the keyed hashes
+	// stored in the DecayedLog.
+	defaultHashSize = sharedHashSize
+
+	// minHashSize is the minimum size in bytes of the keyed hashes. Below
+	// this size, accidental collisions start to become a concern.
+	minHashSize = 16
+
+	// maxHashSize is the maximum size in bytes of the keyed hashes, which
+	// is the size of an untruncated HMAC-SHA256.
+	maxHashSize = sha256.Size
 )
 
 var (
@@ -31,100 +51,370 @@ var (
 	// bytes of a received HTLC's hashed shared secret as the key and the HTLC's
 	// CLTV expiry as the value.
 	sharedHashBucket = []byte("shared-hash")
+
+	// cltvIndexBucket is a bucket which indexes the entries of
+	// sharedHashBucket by their CLTV expiry. Its keys are the big-endian
+	// CLTV followed by the shared secret hash, and its values are empty.
+	// As bolt keeps keys sorted, this allows the garbage collector to only
+	// visit the entries which have actually expired.
+	cltvIndexBucket = []byte("cltv-index")
+
+	// metaBucket is a bucket which houses metadata about the DecayedLog
+	// itself, such as the height it was last garbage collected at.
+	metaBucket = []byte("metadata")
+
+	// gcHeightKey is the key within metaBucket under which the height of
+	// the last garbage collection is stored as a big-endian uint32.
+	gcHeightKey = []byte("gc-height")
+
+	// saltKey is the key within metaBucket under which the random salt
+	// used to key the hashes of shared secrets is stored. Databases which
+	// lack a salt store legacy unkeyed hashes.
+	saltKey = []byte("salt")
+
+	// hashSizeKey is the key within metaBucket under which the size of the
+	// stored keyed hashes is stored as a single byte.
+	hashSizeKey = []byte("hash-size")
+
+	// versionKey is the key within metaBucket under which the schema
+	// version of the database is stored as a big-endian uint32. Databases
+	// which lack a version are at version zero.
+	versionKey = []byte("version")
+
+	// bucketRangeKey is the key within metaBucket under which the
+	// BucketedLog stores its bucket range as a big-endian uint32.
+	bucketRangeKey = []byte("bucket-range")
+
+	// collisionsKey is the key within metaBucket under which the number of
+	// hash collisions detected by Put is stored as a big-endian uint64.
+	collisionsKey = []byte("collisions")
 )
 
+// cltvIndexKey returns the key of an entry within cltvIndexBucket.
+func cltvIndexKey(cltv uint32, hash []byte) []byte {
+	key := make([]byte, 4+len(hash))
+	binary.BigEndian.PutUint32(key[:4], cltv)
+	copy(key[4:], hash)
+
+	return key
+}
+
 // DecayedLog implements the PersistLog interface. It stores the first
 // sharedHashSize bytes of a sha256-hashed shared secret along with a node's
 // CLTV value. It is a decaying log meaning there will be a garbage collector
 // to collect entries which are expired according to their stored CLTV value
 // and the current block height. DecayedLog wraps channeldb for simplicity and
 // batches writes to the database to decrease write contention.
+//
+// Rather than the plain hash of a shared secret, the DecayedLog stores an
+// HMAC-SHA256 of it, keyed with a random salt which is generated when the
+// database is created. Keys MUST therefore be computed with the
+// HashSharedSecret method of the started DecayedLog. Entries of databases
+// created before the introduction of keyed hashes are rehashed on Start.
+//
+// The height of the last garbage collection is persisted. When started, the
+// DecayedLog immediately collects the entries which expired while it was
+// offline, using the greater of the persisted height and StartHeight. If no
+// Notifier is supplied, the caller is responsible for calling Prune as new
+// blocks arrive.
 type DecayedLog struct {
+	// hits, lastPurged and totalPurged are the counters reported by
+	// Stats. They MUST be used atomically.
+	hits        uint64
+	lastPurged  uint64
+	totalPurged uint64
+
+	// bestHeight is the highest block height the DecayedLog has been
+	// garbage collected at. It MUST be used atomically.
+	bestHeight uint32
+
 	db       *channeldb.DB
 	wg       sync.WaitGroup
 	quit     chan (struct{})
 	Notifier chainntnfs.ChainNotifier
+
+	// StartHeight is the current best height of the chain at the time
+	// the DecayedLog is started. It's optional, and if set, entries which
+	// expired before this height are garbage collected on Start.
+	StartHeight uint32
+
+	// HashSize is the size in bytes the keyed hashes are truncated to. It
+	// must lie between 16 and 32, and can't be changed once the database
+	// has been created. If zero, the size of an existing database is used,
+	// or 20 for a new one.
+	HashSize int
+
+	// salt and hashSize are read from the database on Start.
+	salt     []byte
+	hashSize int
+
+	// SyncPolicy determines when writes become durable, and hence which
+	// entries survive a crash. See the SyncPolicy constants for the crash
+	// semantics of each policy. Namespaces always write through to the
+	// database.
+	SyncPolicy SyncPolicy
+
+	// MaxBatchSize and MaxBatchDelay override the limits of the batched
+	// transactions used by Put, Delete and Prune, if non-zero. A larger
+	// size or delay increases throughput at the cost of latency.
+	MaxBatchSize  int
+	MaxBatchDelay time.Duration
+
+	// MaxBufferSize is the number of buffered entries which triggers a
+	// flush in SyncBuffered mode. If zero, 1000 is used.
+	MaxBufferSize int
+
+	// FlushInterval is the interval at which buffered entries are flushed
+	// in SyncBuffered mode. If zero, entries are only flushed explicitly,
+	// once MaxBufferSize is reached, and on Stop.
+	FlushInterval time.Duration
+
+	// buffer holds the entries which haven't been flushed yet in
+	// SyncBuffered mode, along with the number of collisions among them.
+	// inflight holds the entries of a flush which hasn't been committed
+	// yet, so they remain visible to Get.
+	bufMtx             sync.Mutex
+	buffer             map[string]uint32
+	inflight           map[string]uint32
+	bufferedCollisions int
+	flushMtx           sync.Mutex
+
+	// ExpiryMode determines whether entries expire at their CLTV, or a
+	// fixed duration after being stored. It can't be changed once the
+	// database holds entries.
+	ExpiryMode ExpiryMode
+
+	// EntryTTL is the duration entries are kept for in TimeExpiry mode. If
+	// zero, 24 hours are used.
+	EntryTTL time.Duration
+
+	// GCInterval is the interval at which expired entries are garbage
+	// collected in TimeExpiry mode. If zero, one minute is used.
+	GCInterval time.Duration
+
+	// Clock is the source of time in TimeExpiry mode. If nil, the system
+	// clock is used.
+	Clock Clock
+
+	// OnPrune is called by the garbage collector with the height of every
+	// block epoch it has pruned the DecayedLog at. It's optional, and
+	// allows tests to wait for garbage collection to complete. It MUST NOT
+	// block or call Stop.
+	OnPrune func(height uint32)
+
+	// OnError is called with the errors of the background goroutines,
+	// i.e. failures of the garbage collector and of periodic flushes. It's
+	// optional, and MUST NOT block or call Stop.
+	OnError func(error)
+
+	// lifecycleMtx serializes Start and Stop. opsMtx is held for reading
+	// by every operation on the database, and for writing while it's
+	// being closed. started is guarded by opsMtx.
+	lifecycleMtx sync.Mutex
+	opsMtx       sync.RWMutex
+	started      bool
+
+	// namespaces holds the views handed out by Namespace.
+	nsMtx      sync.Mutex
+	namespaces map[string]*namespaceLog
 }
 
 // garbageCollector deletes entries from sharedHashBucket whose expiry height
-// has already past. This function MUST be run as a goroutine.
-func (d *DecayedLog) garbageCollector() error {
-	defer d.wg.Done()
+// has already past. Failures are reported through OnError. This function MUST
+// be run as a goroutine.
+func (d *DecayedLog) garbageCollector(
+	epochClient *chainntnfs.BlockEpochEvent) {
 
-	epochClient, err := d.Notifier.RegisterBlockEpochNtfn()
-	if err != nil {
-		return fmt.Errorf("Unable to register for epoch "+
-			"notification: %v", err)
-	}
+	defer d.wg.Done()
 	defer epochClient.Cancel()
 
-outer:
 	for {
 		select {
 		case epoch, ok := <-epochClient.Epochs:
 			if !ok {
-				return fmt.Errorf("Epoch client shutting " +
-					"down")
+				d.reportError(fmt.Errorf("Epoch client " +
+					"shutting down"))
+				return
 			}
 
-			err := d.db.Batch(func(tx *bolt.Tx) error {
-				// Grab the shared hash bucket
-				sharedHashes := tx.Bucket(sharedHashBucket)
-				if sharedHashes == nil {
-					return fmt.Errorf("sharedHashBucket " +
-						"is nil")
-				}
-
-				var expiredCltv [][]byte
-				sharedHashes.ForEach(func(k, v []byte) error {
-					// The CLTV value in question.
-					cltv := uint32(binary.BigEndian.Uint32(v))
-
-					// Current blockheight
-					height := uint32(epoch.Height)
-
-					if cltv < height {
-						// This CLTV is expired. We must
-						// add it to an array which we'll
-						// loop over and delete every
-						// hash contained from the db.
-						expiredCltv = append(expiredCltv, k)
-					}
-
-					return nil
-				})
-
-				// Delete every item in the array. This must
-				// be done explicitly outside of the ForEach
-				// function for safety reasons.
-				for _, hash := range expiredCltv {
-					err := sharedHashes.Delete(hash)
-					if err != nil {
-						return err
-					}
-				}
-
-				return nil
-			})
+			// A failed garbage collection is retried with the
+			// next block, as Prune removes every expired entry.
+			err := d.Prune(uint32(epoch.Height))
 			if err != nil {
-				return fmt.Errorf("Error viewing channeldb: "+
-					"%v", err)
+				d.reportError(fmt.Errorf("Error pruning "+
+					"channeldb: %v", err))
+				continue
+			}
+
+			if d.OnPrune != nil {
+				d.OnPrune(uint32(epoch.Height))
 			}
 
 		case <-d.quit:
-			break outer
+			return
+		}
+	}
+}
+
+// reportError passes an error of a background goroutine to OnError, if set.
+func (d *DecayedLog) reportError(err error) {
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// acquire ensures that the DecayedLog is started, and prevents it from being
+// stopped until release is called. ErrLogStopped is returned if the
+// DecayedLog isn't started.
+func (d *DecayedLog) acquire() error {
+	d.opsMtx.RLock()
+	if !d.started {
+		d.opsMtx.RUnlock()
+		return ErrLogStopped
+	}
+
+	return nil
+}
+
+// release allows the DecayedLog to be stopped again after acquire.
+func (d *DecayedLog) release() {
+	d.opsMtx.RUnlock()
+}
+
+// Prune deletes every entry whose CLTV is below the passed height. Using the
+// CLTV index, only the expired entries are visited. The height is persisted
+// as the height of the last garbage collection, unless a greater height has
+// already been recorded. Prune is called by the garbage collector for every
+// new block, and can be called manually if the DecayedLog has no Notifier.
+func (d *DecayedLog) Prune(height uint32) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	var (
+		numPurged       uint64
+		namespacePurged map[string]uint64
+	)
+	err := d.db.Batch(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return fmt.Errorf("Unable to create bucket meta:"+
+				" %v", err)
+		}
+
+		if heightBytes := meta.Get(gcHeightKey); heightBytes == nil ||
+			binary.BigEndian.Uint32(heightBytes) < height {
+
+			var scratch [4]byte
+			binary.BigEndian.PutUint32(scratch[:], height)
+			if err := meta.Put(gcHeightKey, scratch[:]); err != nil {
+				return err
+			}
+		}
+
+		// Grab the shared hash bucket
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket " +
+				"is nil")
+		}
+
+		cltvIndex := tx.Bucket(cltvIndexBucket)
+		if cltvIndex == nil {
+			return fmt.Errorf("cltvIndexBucket is nil")
+		}
+
+		numPurged, err = pruneEntries(sharedHashes, cltvIndex, height)
+		if err != nil {
+			return err
 		}
+
+		namespacePurged, err = d.pruneNamespaces(tx, height)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
+	d.recordNamespacePurges(namespacePurged)
+	numPurged += d.bufferPrune(height)
+
+	atomic.StoreUint64(&d.lastPurged, numPurged)
+	atomic.AddUint64(&d.totalPurged, numPurged)
+	updateBestHeight(&d.bestHeight, height)
+
 	return nil
 }
 
+// pruneEntries deletes every entry whose CLTV is below the passed height from
+// the passed buckets, returning the number of deleted entries.
+func pruneEntries(sharedHashes, cltvIndex *bolt.Bucket,
+	height uint32) (uint64, error) {
+
+	// The index is sorted by CLTV, so we can stop at the first entry
+	// which hasn't expired yet.
+	var expired [][]byte
+	c := cltvIndex.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if binary.BigEndian.Uint32(k[:4]) >= height {
+			break
+		}
+
+		expired = append(expired, k)
+	}
+
+	// Delete every expired entry from both buckets. This must be done
+	// explicitly outside of the cursor iteration for safety reasons.
+	for _, k := range expired {
+		if err := sharedHashes.Delete(k[4:]); err != nil {
+			return 0, err
+		}
+
+		if err := cltvIndex.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+
+	return uint64(len(expired)), nil
+}
+
+// updateBestHeight raises the best height stored at the passed address to
+// the passed height, if it is higher than the current one. The best height
+// MUST only be accessed atomically.
+func updateBestHeight(bestHeight *uint32, height uint32) {
+	for {
+		current := atomic.LoadUint32(bestHeight)
+		if height <= current {
+			return
+		}
+
+		if atomic.CompareAndSwapUint32(bestHeight, current, height) {
+			return
+		}
+	}
+}
+
+// BestHeight returns the highest block height the DecayedLog knows of,
+// either through StartHeight, a block notification or a call to Prune. Zero
+// is returned if no height is known.
+func (d *DecayedLog) BestHeight() uint32 {
+	return atomic.LoadUint32(&d.bestHeight)
+}
+
+// retainedHeight returns the lowest CLTV the DecayedLog may still hold an
+// entry for, implementing the retentionLog interface.
+func (d *DecayedLog) retainedHeight() uint32 {
+	return d.BestHeight()
+}
+
 // A compile time check to see if DecayedLog adheres to the PersistLog
 // interface.
 var _ PersistLog = (*DecayedLog)(nil)
 
 // HashSharedSecret Sha-256 hashes the shared secret and returns the first
-// sharedHashSize bytes of the hash.
+// sharedHashSize bytes of the hash. This is the legacy unkeyed hash, the keys
+// of the DecayedLog are computed by DecayedLog.HashSharedSecret.
 func HashSharedSecret(sharedSecret [sharedSecretSize]byte) [sharedHashSize]byte {
 	// Sha256 hash of sharedSecret
 	h := sha256.New()
@@ -137,9 +427,74 @@ func HashSharedSecret(sharedSecret [sharedSecretSize]byte) [sharedHashSize]byte
 	return sharedHash
 }
 
+// HashSharedSecret returns the key under which the passed shared secret is
+// stored in the DecayedLog. It is the HMAC-SHA256, keyed with the salt of the
+// database, of the legacy unkeyed hash, truncated to the configured hash size.
+// Using the legacy hash as input allows existing entries to be migrated. It
+// MUST only be called after the DecayedLog has been started.
+func (d *DecayedLog) HashSharedSecret(sharedSecret [sharedSecretSize]byte) []byte {
+	legacyHash := HashSharedSecret(sharedSecret)
+
+	// The salt is replaced by Import while holding opsMtx for writing.
+	d.opsMtx.RLock()
+	defer d.opsMtx.RUnlock()
+
+	return keyedHash(d.salt, legacyHash[:], d.hashSize)
+}
+
+// keyedHash computes the HMAC-SHA256 of the passed legacy hash keyed with the
+// salt, and truncates it to hashSize bytes.
+func keyedHash(salt, legacyHash []byte, hashSize int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(legacyHash)
+
+	return mac.Sum(nil)[:hashSize]
+}
+
+// Collisions returns the number of times Put was called with a hash which
+// was already stored. As callers check for a stored hash before calling Put,
+// this indicates either a collision of truncated hashes, or a replay which
+// raced with the original packet.
+func (d *DecayedLog) Collisions() (uint64, error) {
+	if err := d.acquire(); err != nil {
+		return 0, err
+	}
+	defer d.release()
+
+	var collisions uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return nil
+		}
+
+		if collisionBytes := meta.Get(collisionsKey); collisionBytes != nil {
+			collisions = binary.BigEndian.Uint64(collisionBytes)
+		}
+
+		return nil
+	})
+
+	return collisions, err
+}
+
 // Delete removes a <shared secret hash, CLTV> key-pair from the
-// sharedHashBucket.
+// sharedHashBucket, along with its entry in the CLTV index.
 func (d *DecayedLog) Delete(hash []byte) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	// A concurrent flush could write the entry back after it has been
+	// deleted, so deletions are serialized with flushes.
+	if d.SyncPolicy == SyncBuffered {
+		d.flushMtx.Lock()
+		defer d.flushMtx.Unlock()
+	}
+
+	d.bufferDelete(hash)
+
 	return d.db.Batch(func(tx *bolt.Tx) error {
 		sharedHashes, err := tx.CreateBucketIfNotExists(sharedHashBucket)
 		if err != nil {
@@ -147,10 +502,31 @@ func (d *DecayedLog) Delete(hash []byte) error {
 				" %v", err)
 		}
 
-		return sharedHashes.Delete(hash)
+		cltvIndex, err := tx.CreateBucketIfNotExists(cltvIndexBucket)
+		if err != nil {
+			return fmt.Errorf("Unable to create cltvIndex bucket:"+
+				" %v", err)
+		}
+
+		return deleteEntry(sharedHashes, cltvIndex, hash)
 	})
 }
 
+// deleteEntry removes the entry of the passed hash from the passed buckets.
+func deleteEntry(sharedHashes, cltvIndex *bolt.Bucket, hash []byte) error {
+	valueBytes := sharedHashes.Get(hash)
+	if valueBytes == nil {
+		return nil
+	}
+
+	cltv := binary.BigEndian.Uint32(valueBytes)
+	if err := cltvIndex.Delete(cltvIndexKey(cltv, hash)); err != nil {
+		return err
+	}
+
+	return sharedHashes.Delete(hash)
+}
+
 // Get retrieves the CLTV of a processed HTLC given the first 20 bytes of the
 // Sha-256 hash of the shared secret.
 func (d *DecayedLog) Get(hash []byte) (uint32, error) {
@@ -158,6 +534,16 @@ func (d *DecayedLog) Get(hash []byte) (uint32, error) {
 	// This was chosen because it's not feasible for a CLTV to be this high.
 	var value uint32 = math.MaxUint32
 
+	if err := d.acquire(); err != nil {
+		return value, err
+	}
+	defer d.release()
+
+	if cltv, ok := d.bufferGet(hash); ok {
+		atomic.AddUint64(&d.hits, 1)
+		return cltv, nil
+	}
+
 	err := d.db.View(func(tx *bolt.Tx) error {
 		// Grab the shared hash bucket which stores the mapping from
 		// truncated sha-256 hashes of shared secrets to CLTV's.
@@ -175,6 +561,7 @@ func (d *DecayedLog) Get(hash []byte) (uint32, error) {
 
 		// The first 4 bytes represent the CLTV, store it in value.
 		value = uint32(binary.BigEndian.Uint32(valueBytes))
+		atomic.AddUint64(&d.hits, 1)
 
 		return nil
 	})
@@ -185,14 +572,31 @@ func (d *DecayedLog) Get(hash []byte) (uint32, error) {
 	return value, nil
 }
 
-// Put stores a shared secret hash as the key and the CLTV as the value.
+// Put stores a shared secret hash as the key and the CLTV as the value. The
+// entry is also added to the CLTV index. If the hash is already stored, it
+// keeps the greater of both CLTVs, so that storing it again never cuts its
+// replay protection short. If the CLTV has already expired
+// according to the best known height, ErrExpiredEntry is returned and
+// nothing is stored. In SyncBuffered mode, the entry is only buffered. In
+// TimeExpiry mode, the passed CLTV is ignored and the deadline of the entry
+// is stored instead, so storing a hash again extends its lifetime.
 func (d *DecayedLog) Put(hash []byte, cltv uint32) error {
-	// The CLTV will be stored into scratch and then stored into the
-	// sharedHashBucket.
-	var scratch [4]byte
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
 
-	// Store value into scratch
-	binary.BigEndian.PutUint32(scratch[:], cltv)
+	switch {
+	case d.ExpiryMode == TimeExpiry:
+		cltv = d.deadline()
+
+	case cltv < d.BestHeight():
+		return ErrExpiredEntry
+	}
+
+	if d.SyncPolicy == SyncBuffered {
+		return d.bufferPut(hash, cltv)
+	}
 
 	return d.db.Batch(func(tx *bolt.Tx) error {
 		sharedHashes, err := tx.CreateBucketIfNotExists(sharedHashBucket)
@@ -201,14 +605,288 @@ func (d *DecayedLog) Put(hash []byte, cltv uint32) error {
 				" %v", err)
 		}
 
-		return sharedHashes.Put(hash, scratch[:])
+		cltvIndex, err := tx.CreateBucketIfNotExists(cltvIndexBucket)
+		if err != nil {
+			return fmt.Errorf("Unable to create bucket cltvIndex:"+
+				" %v", err)
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return fmt.Errorf("Unable to create bucket meta:"+
+				" %v", err)
+		}
+
+		return putEntry(sharedHashes, cltvIndex, meta, hash, cltv)
+	})
+}
+
+// putEntry stores the passed hash and CLTV within the passed buckets. If the
+// hash is already stored, the collision counter within the passed metadata
+// bucket is incremented, and the entry keeps the greater of both CLTVs.
+func putEntry(sharedHashes, cltvIndex, meta *bolt.Bucket, hash []byte,
+	cltv uint32) error {
+
+	// If the hash is already stored, account for the collision and
+	// remove the index entry of the lower CLTV.
+	if oldValue := sharedHashes.Get(hash); oldValue != nil {
+		if err := incrementCollisions(meta); err != nil {
+			return err
+		}
+
+		oldCltv := binary.BigEndian.Uint32(oldValue)
+		if oldCltv >= cltv {
+			return nil
+		}
+
+		err := cltvIndex.Delete(cltvIndexKey(oldCltv, hash))
+		if err != nil {
+			return err
+		}
+	}
+
+	// The CLTV will be stored into scratch and then stored into the
+	// sharedHashBucket.
+	var scratch [4]byte
+
+	// Store value into scratch
+	binary.BigEndian.PutUint32(scratch[:], cltv)
+
+	if err := cltvIndex.Put(cltvIndexKey(cltv, hash), nil); err != nil {
+		return err
+	}
+
+	return sharedHashes.Put(hash, scratch[:])
+}
+
+// ForEach calls the passed function with the hash and CLTV of every stored
+// entry, in the order of their hashes. Iteration stops at the first error
+// returned by the function, which is then returned. The function MUST NOT
+// modify the DecayedLog. Buffered entries are flushed first.
+func (d *DecayedLog) ForEach(f func(hash []byte, cltv uint32) error) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	if err := d.flush(); err != nil {
+		return err
+	}
+
+	return d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+
+		return sharedHashes.ForEach(func(k, v []byte) error {
+			return f(k, binary.BigEndian.Uint32(v))
+		})
+	})
+}
+
+// Stats returns a snapshot of statistics about the DecayedLog. Buffered
+// entries are flushed first.
+func (d *DecayedLog) Stats() (*Stats, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.release()
+
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		BestHeight:  d.BestHeight(),
+		LastPurged:  atomic.LoadUint64(&d.lastPurged),
+		TotalPurged: atomic.LoadUint64(&d.totalPurged),
+		Hits:        atomic.LoadUint64(&d.hits),
+	}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+		cltvIndex := tx.Bucket(cltvIndexBucket)
+		if cltvIndex == nil {
+			return fmt.Errorf("cltvIndexBucket is nil")
+		}
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("metaBucket is nil")
+		}
+
+		stats.SizeOnDisk = tx.Size()
+		entryStats(sharedHashes, cltvIndex, meta, stats)
+
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// entryStats fills in the statistics about the entries of the passed buckets.
+func entryStats(sharedHashes, cltvIndex, meta *bolt.Bucket, stats *Stats) {
+	stats.NumEntries = uint64(sharedHashes.Stats().KeyN)
+
+	// The CLTV index is sorted by CLTV, so the oldest and newest entries
+	// are its first and last keys.
+	c := cltvIndex.Cursor()
+	if k, _ := c.First(); k != nil {
+		stats.OldestCltv = binary.BigEndian.Uint32(k[:4])
+	}
+	if k, _ := c.Last(); k != nil {
+		stats.NewestCltv = binary.BigEndian.Uint32(k[:4])
+	}
+
+	if collisionBytes := meta.Get(collisionsKey); collisionBytes != nil {
+		stats.Collisions = binary.BigEndian.Uint64(collisionBytes)
+	}
+}
+
+// incrementCollisions increments the collision counter within the passed
+// metadata bucket.
+func incrementCollisions(meta *bolt.Bucket) error {
+	var collisions uint64
+	if collisionBytes := meta.Get(collisionsKey); collisionBytes != nil {
+		collisions = binary.BigEndian.Uint64(collisionBytes)
+	}
+
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], collisions+1)
+
+	return meta.Put(collisionsKey, scratch[:])
+}
+
+// loadKeyedHashes loads the salt and hash size of the database, ensuring
+// that the configured hash size matches the stored one.
+func (d *DecayedLog) loadKeyedHashes(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return fmt.Errorf("metaBucket is nil")
+	}
+
+	salt, hashSize, err := readKeyedHashParams(meta, d.HashSize)
+	if err != nil {
+		return err
+	}
+
+	d.salt = salt
+	d.hashSize = hashSize
+
+	return nil
+}
+
+// readKeyedHashParams reads the salt and hash size stored within the passed
+// metadata bucket. If configuredSize is non-zero, it must match the stored
+// hash size.
+func readKeyedHashParams(meta *bolt.Bucket, configuredSize int) ([]byte, int,
+	error) {
+
+	salt := meta.Get(saltKey)
+	hashSize := meta.Get(hashSizeKey)
+	if len(salt) != saltSize || len(hashSize) != 1 {
+		return nil, 0, fmt.Errorf("invalid keyed hash metadata")
+	}
+
+	if configuredSize != 0 && configuredSize != int(hashSize[0]) {
+		return nil, 0, ErrHashSizeMismatch
+	}
+
+	return append([]byte(nil), salt...), int(hashSize[0]), nil
+}
+
+// writeKeyedHashParams generates a new random salt, and stores it within the
+// passed metadata bucket along with the hash size. The hash size defaults to
+// defaultHashSize if configuredSize is zero. The salt and hash size are
+// returned.
+func writeKeyedHashParams(meta *bolt.Bucket, configuredSize int) ([]byte,
+	int, error) {
+
+	if configuredSize != 0 &&
+		(configuredSize < minHashSize || configuredSize > maxHashSize) {
+
+		return nil, 0, ErrInvalidHashSize
+	}
+
+	hashSize := configuredSize
+	if hashSize == 0 {
+		hashSize = defaultHashSize
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, 0, err
+	}
+
+	if err := meta.Put(saltKey, salt); err != nil {
+		return nil, 0, err
+	}
+	if err := meta.Put(hashSizeKey, []byte{byte(hashSize)}); err != nil {
+		return nil, 0, err
+	}
+
+	return salt, hashSize, nil
+}
+
+// gcHeight returns the persisted height of the last garbage collection, or
+// zero if the DecayedLog has never been garbage collected.
+func (d *DecayedLog) gcHeight() (uint32, error) {
+	var height uint32
+	err := d.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return nil
+		}
+
+		if heightBytes := meta.Get(gcHeightKey); heightBytes != nil {
+			height = binary.BigEndian.Uint32(heightBytes)
+		}
+
+		return nil
+	})
+
+	return height, err
+}
+
+// catchUp garbage collects the entries which expired while the DecayedLog was
+// stopped, using the best height we know of.
+func (d *DecayedLog) catchUp() error {
+	gcHeight, err := d.gcHeight()
+	if err != nil {
+		return err
+	}
+	if d.StartHeight > gcHeight {
+		gcHeight = d.StartHeight
+	}
+	if gcHeight == 0 {
+		return nil
+	}
+
+	return d.Prune(gcHeight)
 }
 
 // Start opens the database we will be using to store hashed shared secrets.
-// It also starts the garbage collector in a goroutine to remove stale
-// database entries.
+// It immediately garbage collects the entries which expired while the
+// DecayedLog was stopped, and starts the garbage collector in a goroutine to
+// remove stale database entries as new blocks arrive, or periodically in
+// TimeExpiry mode. Calling Start on a started DecayedLog has no effect.
 func (d *DecayedLog) Start(dbDir string) error {
+	d.lifecycleMtx.Lock()
+	defer d.lifecycleMtx.Unlock()
+
+	d.opsMtx.RLock()
+	started := d.started
+	d.opsMtx.RUnlock()
+	if started {
+		return nil
+	}
+
 	// Create the quit channel
 	d.quit = make(chan struct{})
 
@@ -225,32 +903,124 @@ func (d *DecayedLog) Start(dbDir string) error {
 		return fmt.Errorf("Could not open channeldb: %v", err)
 	}
 
+	// Apply the durability and batching options.
+	if d.SyncPolicy > SyncDisabled {
+		d.db.Close()
+		return fmt.Errorf("unknown sync policy %v", d.SyncPolicy)
+	}
+	if d.ExpiryMode > TimeExpiry {
+		d.db.Close()
+		return fmt.Errorf("unknown expiry mode %v", d.ExpiryMode)
+	}
+	d.db.NoSync = d.SyncPolicy == SyncDisabled
+	if d.MaxBatchSize != 0 {
+		d.db.MaxBatchSize = d.MaxBatchSize
+	}
+	if d.MaxBatchDelay != 0 {
+		d.db.MaxBatchDelay = d.MaxBatchDelay
+	}
+	d.buffer = make(map[string]uint32)
+	d.inflight = nil
+	d.bufferedCollisions = 0
+
+	// Apply the migrations required to bring the database up to date,
+	// and load the salt used to key the hashes of shared secrets.
 	err = d.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(sharedHashBucket)
-		if err != nil {
-			return fmt.Errorf("Unable to create bucket sharedHashes:"+
-				" %v", err)
+		if err := d.migrate(tx); err != nil {
+			return err
 		}
-		return nil
+
+		if err := d.loadKeyedHashes(tx); err != nil {
+			return err
+		}
+
+		return d.loadExpiryMode(tx)
 	})
 	if err != nil {
+		d.db.Close()
 		return err
 	}
 
+	d.opsMtx.Lock()
+	d.started = true
+	d.opsMtx.Unlock()
+
+	// Catch up on the entries which expired while we were offline.
+	atomic.StoreUint32(&d.bestHeight, 0)
+	atomic.StoreUint64(&d.hits, 0)
+	atomic.StoreUint64(&d.lastPurged, 0)
+	atomic.StoreUint64(&d.totalPurged, 0)
+	if d.ExpiryMode == TimeExpiry {
+		err = d.PruneExpired(d.clock().Now())
+	} else {
+		err = d.catchUp()
+	}
+	if err != nil {
+		d.close()
+		return fmt.Errorf("Unable to prune channeldb: %v", err)
+	}
+
 	// Start garbage collector.
-	if d.Notifier != nil {
+	switch {
+	case d.ExpiryMode == TimeExpiry:
+		d.wg.Add(1)
+		go d.timeCollector()
+
+	case d.Notifier != nil:
+		epochClient, err := d.Notifier.RegisterBlockEpochNtfn()
+		if err != nil {
+			d.close()
+			return fmt.Errorf("Unable to register for epoch "+
+				"notification: %v", err)
+		}
+
 		d.wg.Add(1)
-		go d.garbageCollector()
+		go d.garbageCollector(epochClient)
+	}
+
+	// Start periodically flushing buffered entries.
+	if d.SyncPolicy == SyncBuffered && d.FlushInterval != 0 {
+		d.wg.Add(1)
+		go d.flusher()
 	}
 
 	return nil
 }
 
-// Stop halts the garbage collector and closes channeldb.
+// Stop halts the garbage collector and waits for it to exit, flushes any
+// buffered entries and closes channeldb. Operations on a stopped DecayedLog
+// fail with ErrLogStopped. Calling Stop on a DecayedLog which isn't started
+// has no effect.
 func (d *DecayedLog) Stop() {
+	d.lifecycleMtx.Lock()
+	defer d.lifecycleMtx.Unlock()
+
+	d.opsMtx.RLock()
+	started := d.started
+	d.opsMtx.RUnlock()
+	if !started {
+		return
+	}
+
 	// Stop garbage collector.
 	close(d.quit)
+	d.wg.Wait()
+
+	// Flush buffered entries.
+	if err := d.Flush(); err != nil {
+		d.reportError(err)
+	}
 
 	// Close channeldb.
+	d.close()
+}
+
+// close waits for the pending operations to complete, marks the DecayedLog
+// as stopped and closes channeldb.
+func (d *DecayedLog) close() {
+	d.opsMtx.Lock()
+	defer d.opsMtx.Unlock()
+
+	d.started = false
 	d.db.Close()
 }
@@ -1,16 +1,20 @@
 package persistlog
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"math"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
-	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/Crypt-iQ/lightning-onion/mockchain"
+	"github.com/boltdb/bolt"
+	"github.com/davecgh/go-spew/spew"
 	"github.com/roasbeef/btcd/btcec"
-	"github.com/roasbeef/btcd/chaincfg/chainhash"
-	"github.com/roasbeef/btcd/wire"
 )
 
 const (
@@ -27,34 +31,18 @@ var (
 	}
 )
 
-type mockNotifier struct {
-	confChannel chan *chainntnfs.TxConfirmation
-	epochChan   chan *chainntnfs.BlockEpoch
+// testChain is the chain backend of a DecayedLog created by startup. Its
+// tracker records the heights the garbage collector has pruned at.
+type testChain struct {
+	*mockchain.Notifier
+	tracker *mockchain.GCTracker
 }
 
-func (m *mockNotifier) RegisterBlockEpochNtfn() (*chainntnfs.BlockEpochEvent, error) {
-	return &chainntnfs.BlockEpochEvent{
-		Epochs: m.epochChan,
-		Cancel: func() {},
-	}, nil
-}
-
-func (m *mockNotifier) RegisterConfirmationsNtfn(txid *chainhash.Hash, numConfs,
-	heightHint uint32) (*chainntnfs.ConfirmationEvent, error) {
-	return nil, nil
-}
-
-func (m *mockNotifier) RegisterSpendNtfn(outpoint *wire.OutPoint,
-	heightHint uint32) (*chainntnfs.SpendEvent, error) {
-	return nil, nil
-}
-
-func (m *mockNotifier) Start() error {
-	return nil
-}
-
-func (m *mockNotifier) Stop() error {
-	return nil
+// waitForGC waits for the garbage collector to prune at the passed height.
+func (c *testChain) waitForGC(t *testing.T, height uint32) {
+	if err := c.tracker.WaitForHeight(height, 5*time.Second); err != nil {
+		t.Fatalf("Garbage collector didn't prune: %v", err)
+	}
 }
 
 // generateSharedSecret generates a shared secret given a public key and a
@@ -69,18 +57,23 @@ func generateSharedSecret(pub *btcec.PublicKey, priv *btcec.PrivateKey) [32]byte
 }
 
 // startup sets up the DecayedLog and possibly the garbage collector.
-func startup(notifier bool) (*DecayedLog, *mockNotifier, [sharedHashSize]byte, error) {
+func startup(notifier bool) (*DecayedLog, *testChain, []byte, error) {
 	var d DecayedLog
-	var MockNotifier *mockNotifier
-	var hashedSecret [sharedHashSize]byte
+	var chain *testChain
+	var hashedSecret []byte
 	if notifier {
-		// Create the MockNotifier which triggers the garbage collector
-		MockNotifier = &mockNotifier{
-			epochChan: make(chan *chainntnfs.BlockEpoch, 1),
+		// Create the mock chain which triggers the garbage collector
+		chain = &testChain{
+			Notifier: mockchain.NewNotifier(0),
+			tracker:  mockchain.NewGCTracker(),
 		}
 
 		// Initialize the DecayedLog object
-		d = DecayedLog{Notifier: MockNotifier}
+		d = DecayedLog{
+			Notifier: chain.Notifier,
+			OnPrune:  chain.tracker.OnPrune,
+			OnError:  chain.tracker.OnError,
+		}
 	} else {
 		// Initialize the DecayedLog object
 		d = DecayedLog{}
@@ -105,16 +98,16 @@ func startup(notifier bool) (*DecayedLog, *mockNotifier, [sharedHashSize]byte, e
 	secret := generateSharedSecret(testPub, priv)
 
 	// Create the hashedSecret given the shared secret we just generated.
-	// This is the first 20 bytes of the Sha-256 hash of the shared secret.
-	// This is used as a key to retrieve the cltv value.
-	hashedSecret = HashSharedSecret(secret)
+	// This is the keyed hash of the shared secret, which is used as a key
+	// to retrieve the cltv value.
+	hashedSecret = d.HashSharedSecret(secret)
 
-	return &d, MockNotifier, hashedSecret, nil
+	return &d, chain, hashedSecret, nil
 }
 
 // shutdown stops the DecayedLog and deletes the folder enclosing the
 // temporary channel database.
-func shutdown(d *DecayedLog) {
+func shutdown(d PersistLog) {
 	os.RemoveAll("tempdir")
 	d.Stop()
 }
@@ -123,7 +116,7 @@ func shutdown(d *DecayedLog) {
 // to delete expired cltv values every time a block is received. Expired cltv
 // values are cltv values that are < current block height.
 func TestDecayedLogGarbageCollector(t *testing.T) {
-	d, notifier, hashedSecret, err := startup(true)
+	d, chain, hashedSecret, err := startup(true)
 	if err != nil {
 		t.Fatalf("Unable to start up DecayedLog: %v", err)
 	}
@@ -135,16 +128,12 @@ func TestDecayedLogGarbageCollector(t *testing.T) {
 		t.Fatalf("Unable to store in channeldb: %v", err)
 	}
 
-	// Wait for database write (GC is in a goroutine)
-	time.Sleep(500 * time.Millisecond)
-
 	// Send block notifications to garbage collector. The garbage collector
 	// should remove the entry by block 100001.
 
 	// Send block 100000
-	notifier.epochChan <- &chainntnfs.BlockEpoch{
-		Height:	100000,
-	}
+	chain.NotifyBlock(100000)
+	chain.waitForGC(t, 100000)
 
 	// Assert that hashedSecret is still in the sharedHashBucket
 	val, err := d.Get(hashedSecret[:])
@@ -157,12 +146,8 @@ func TestDecayedLogGarbageCollector(t *testing.T) {
 	}
 
 	// Send block 100001 (expiry block)
-	notifier.epochChan <- &chainntnfs.BlockEpoch{
-		Height:	100001,
-	}
-
-	// Wait for database write (GC is in a goroutine)
-	time.Sleep(500 * time.Millisecond)
+	chain.NotifyBlock(100001)
+	chain.waitForGC(t, 100001)
 
 	// Assert that hashedSecret is not in the sharedHashBucket
 	val, err = d.Get(hashedSecret[:])
@@ -181,7 +166,7 @@ func TestDecayedLogGarbageCollector(t *testing.T) {
 // We test that this causes the <hashedSecret, CLTV> pair to be deleted even
 // on GC restarts.
 func TestDecayedLogPersistentGarbageCollector(t *testing.T) {
-	d, notifier, hashedSecret, err := startup(true)
+	d, chain, hashedSecret, err := startup(true)
 	if err != nil {
 		t.Fatalf("Unable to start up DecayedLog: %v", err)
 	}
@@ -192,9 +177,6 @@ func TestDecayedLogPersistentGarbageCollector(t *testing.T) {
 		t.Fatalf("Unable to store in channeldb: %v", err)
 	}
 
-	// Wait for database write (GC is in a goroutine)
-	time.Sleep(500 * time.Millisecond)
-
 	// Shut down DecayedLog and the garbage collector along with it.
 	d.Stop()
 
@@ -205,12 +187,8 @@ func TestDecayedLogPersistentGarbageCollector(t *testing.T) {
 
 	// Send a block notification to the garbage collector that expires
 	// the stored CLTV.
-	notifier.epochChan <- &chainntnfs.BlockEpoch{
-		Height: int32(100001),
-	}
-
-	// Wait for database write (GC is in a goroutine)
-	time.Sleep(500 * time.Millisecond)
+	chain.NotifyBlock(100001)
+	chain.waitForGC(t, 100001)
 
 	// Assert that hashedSecret is not in the sharedHashBucket
 	val, err := d.Get(hashedSecret[:])
@@ -352,3 +330,699 @@ func TestDecayedLogStorageAndRetrieval(t *testing.T) {
 	}
 
 }
+
+// TestDecayedLogCltvIndex checks that pruning only removes the expired
+// entries, and that the CLTV index follows entries whose CLTV is replaced.
+func TestDecayedLogCltvIndex(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	hashes := make([][]byte, 5)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		if err := d.Put(hashes[i], cltv+uint32(i)); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	// Move the first entry past all others. Its old index entry must not
+	// cause it to be pruned early.
+	if err := d.Put(hashes[0], cltv+10); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Prune everything below cltv+3, which should remove hashes 1 and 2.
+	if err := d.Prune(cltv + 3); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	for i, hash := range hashes {
+		val, err := d.Get(hash)
+		if err != nil {
+			t.Fatalf("Get failed - received an error upon Get: %v", err)
+		}
+
+		expired := i == 1 || i == 2
+		if expired && val != math.MaxUint32 {
+			t.Fatalf("entry %v was not pruned", i)
+		}
+		if !expired && val == math.MaxUint32 {
+			t.Fatalf("entry %v was incorrectly pruned", i)
+		}
+	}
+
+	// Finally, the index must only contain the remaining entries.
+	var numIndexed int
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cltvIndexBucket).ForEach(func(k, v []byte) error {
+			numIndexed++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Unable to read CLTV index: %v", err)
+	}
+	if numIndexed != 3 {
+		t.Fatalf("Expected 3 indexed entries, found %v", numIndexed)
+	}
+}
+
+// TestDecayedLogCltvIndexMigration checks that the CLTV index is built for
+// databases created before its introduction.
+func TestDecayedLogCltvIndexMigration(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret[:], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Emulate a database of the old format by dropping the index and
+	// the schema version.
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Delete(versionKey); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(cltvIndexBucket)
+	})
+	if err != nil {
+		t.Fatalf("Unable to delete CLTV index: %v", err)
+	}
+
+	// Restarting the DecayedLog should rebuild the index, allowing the
+	// entry to be pruned.
+	d.Stop()
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	if err := d.Prune(cltv + 1); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	val, err := d.Get(hashedSecret[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("cltv was not deleted")
+	}
+}
+
+// TestDecayedLogCatchUp checks that entries which expired while the
+// DecayedLog was stopped are garbage collected as soon as it's started with
+// the current height.
+func TestDecayedLogCatchUp(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret[:], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Restart the DecayedLog at a height which expires the entry, without
+	// any block notifications in between.
+	d.Stop()
+	d.StartHeight = cltv + 1
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	val, err := d.Get(hashedSecret[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("cltv was not deleted on start")
+	}
+
+	// The catch-up height should have been persisted.
+	gcHeight, err := d.gcHeight()
+	if err != nil {
+		t.Fatalf("Unable to read gc height: %v", err)
+	}
+	if gcHeight != cltv+1 {
+		t.Fatalf("Expected gc height %v, got %v", cltv+1, gcHeight)
+	}
+}
+
+// TestDecayedLogManualPrune checks that a DecayedLog without a Notifier can
+// be garbage collected manually, and that the height of the last collection
+// is persisted and never decreases.
+func TestDecayedLogManualPrune(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret[:], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Pruning at the expiry height itself must not remove the entry.
+	if err := d.Prune(cltv); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	val, err := d.Get(hashedSecret[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Prune incorrectly deleted CLTV")
+	}
+
+	// Pruning at a lower height must not lower the persisted height,
+	// which should survive a restart.
+	if err := d.Prune(cltv - 10); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	d.Stop()
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	gcHeight, err := d.gcHeight()
+	if err != nil {
+		t.Fatalf("Unable to read gc height: %v", err)
+	}
+	if gcHeight != cltv {
+		t.Fatalf("Expected gc height %v, got %v", cltv, gcHeight)
+	}
+
+	// Finally, pruning past the expiry removes the entry.
+	if err := d.Prune(cltv + 1); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	val, err = d.Get(hashedSecret[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("cltv was not deleted")
+	}
+}
+
+// TestDecayedLogRejectExpired checks that entries whose CLTV has already
+// expired according to the best known height are rejected.
+func TestDecayedLogRejectExpired(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Prune(cltv + 1); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	if d.BestHeight() != cltv+1 {
+		t.Fatalf("Expected best height %v, got %v", cltv+1,
+			d.BestHeight())
+	}
+
+	if err := d.Put(hashedSecret[:], cltv); err != ErrExpiredEntry {
+		t.Fatalf("Expected ErrExpiredEntry, got %v", err)
+	}
+
+	val, err := d.Get(hashedSecret[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("Expired entry was stored")
+	}
+
+	// An entry expiring at the best height is still accepted.
+	if err := d.Put(hashedSecret[:], cltv+1); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+}
+
+// TestDecayedLogKeyedHashes checks that the hashes of shared secrets are
+// keyed with a per-database salt which survives restarts.
+func TestDecayedLogKeyedHashes(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	legacyHash := HashSharedSecret(secret)
+
+	hash := d.HashSharedSecret(secret)
+	if len(hash) != defaultHashSize {
+		t.Fatalf("Expected hash of %v bytes, got %v", defaultHashSize,
+			len(hash))
+	}
+	if bytes.Equal(hash, legacyHash[:]) {
+		t.Fatalf("Hash isn't keyed")
+	}
+
+	if err := d.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// A second database must use a different salt.
+	other := &DecayedLog{}
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	otherHash := other.HashSharedSecret(secret)
+	other.Stop()
+	os.RemoveAll("tempdir2")
+	if bytes.Equal(hash, otherHash) {
+		t.Fatalf("Databases share the same salt")
+	}
+
+	// The salt must be persisted, so the stored entry can be found after
+	// a restart.
+	d.Stop()
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	if !bytes.Equal(d.HashSharedSecret(secret), hash) {
+		t.Fatalf("Hash changed across restarts")
+	}
+
+	val, err := d.Get(hashedSecret)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+}
+
+// TestDecayedLogKeyedHashMigration checks that the entries of a database
+// created before the introduction of keyed hashes are rehashed on Start.
+func TestDecayedLogKeyedHashMigration(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	legacyHash := HashSharedSecret(secret)
+
+	// Emulate a database of version 1 by storing the unkeyed hash and
+	// dropping the salt.
+	if err := d.Put(legacyHash[:], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Delete(saltKey); err != nil {
+			return err
+		}
+		if err := meta.Delete(hashSizeKey); err != nil {
+			return err
+		}
+
+		var scratch [4]byte
+		binary.BigEndian.PutUint32(scratch[:], 1)
+		return meta.Put(versionKey, scratch[:])
+	})
+	if err != nil {
+		t.Fatalf("Unable to delete salt: %v", err)
+	}
+
+	d.Stop()
+	d.HashSize = maxHashSize
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	hash := d.HashSharedSecret(secret)
+	if len(hash) != maxHashSize {
+		t.Fatalf("Expected hash of %v bytes, got %v", maxHashSize,
+			len(hash))
+	}
+
+	val, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Entry wasn't migrated")
+	}
+	val, err = d.Get(legacyHash[:])
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("Legacy entry wasn't removed")
+	}
+
+	// The CLTV index must follow the migrated entry.
+	if err := d.Prune(cltv + 1); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	val, err = d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("Migrated entry wasn't pruned")
+	}
+}
+
+// TestDecayedLogHashSize checks that invalid hash sizes are rejected, and
+// that the hash size can't be changed once the database has been created.
+func TestDecayedLogHashSize(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	for _, hashSize := range []int{minHashSize - 1, maxHashSize + 1} {
+		d := &DecayedLog{HashSize: hashSize}
+		if err := d.Start("tempdir"); err != ErrInvalidHashSize {
+			t.Fatalf("Expected ErrInvalidHashSize for size %v, "+
+				"got %v", hashSize, err)
+		}
+	}
+
+	d := &DecayedLog{HashSize: minHashSize}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	d.Stop()
+
+	d = &DecayedLog{HashSize: defaultHashSize}
+	if err := d.Start("tempdir"); err != ErrHashSizeMismatch {
+		t.Fatalf("Expected ErrHashSizeMismatch, got %v", err)
+	}
+
+	// Without a configured size, the size of the database is used.
+	d = &DecayedLog{}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer d.Stop()
+
+	var secret [sharedSecretSize]byte
+	if len(d.HashSharedSecret(secret)) != minHashSize {
+		t.Fatalf("Expected hash of %v bytes", minHashSize)
+	}
+}
+
+// TestDecayedLogCollisions checks that storing an already stored hash is
+// accounted as a collision.
+func TestDecayedLogCollisions(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	for i := 0; i < 3; i++ {
+		if err := d.Put(hashedSecret, cltv); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	collisions, err := d.Collisions()
+	if err != nil {
+		t.Fatalf("Unable to retrieve collisions: %v", err)
+	}
+	if collisions != 2 {
+		t.Fatalf("Expected 2 collisions, got %v", collisions)
+	}
+}
+
+// TestDecayedLogStats checks that the statistics reflect the stored entries,
+// lookups and garbage collections.
+func TestDecayedLogStats(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 0 || stats.OldestCltv != 0 ||
+		stats.NewestCltv != 0 {
+
+		t.Fatalf("Unexpected stats for empty log: %v", spew.Sdump(stats))
+	}
+
+	hashes := make([][]byte, 4)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		if err := d.Put(hashes[i], cltv+uint32(i)); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	// Store one hash again, and look up a stored and an unknown hash.
+	if err := d.Put(hashes[3], cltv+3); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if _, err := d.Get(hashes[0]); err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if _, err := d.Get(make([]byte, sharedHashSize)); err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+
+	if err := d.Prune(cltv + 2); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	stats, err = d.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+
+	expected := Stats{
+		NumEntries:  2,
+		SizeOnDisk:  stats.SizeOnDisk,
+		OldestCltv:  cltv + 2,
+		NewestCltv:  cltv + 3,
+		BestHeight:  cltv + 2,
+		LastPurged:  2,
+		TotalPurged: 2,
+		Hits:        1,
+		Collisions:  1,
+	}
+	if *stats != expected {
+		t.Fatalf("Expected stats %v, got %v", spew.Sdump(expected),
+			spew.Sdump(stats))
+	}
+	if stats.SizeOnDisk <= 0 {
+		t.Fatalf("Invalid size on disk: %v", stats.SizeOnDisk)
+	}
+
+	// Pruning at the same height purges nothing more.
+	if err := d.Prune(cltv + 2); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	stats, err = d.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.LastPurged != 0 || stats.TotalPurged != 2 {
+		t.Fatalf("Expected 0 last and 2 total purged, got %v and %v",
+			stats.LastPurged, stats.TotalPurged)
+	}
+}
+
+// TestDecayedLogForEach checks that ForEach visits every stored entry, and
+// stops at the first error.
+func TestDecayedLogForEach(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	entries := make(map[string]uint32)
+	for i := 0; i < 5; i++ {
+		hash := bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		entries[string(hash)] = cltv + uint32(i)
+		if err := d.Put(hash, cltv+uint32(i)); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	visited := make(map[string]uint32)
+	err = d.ForEach(func(hash []byte, cltv uint32) error {
+		visited[string(hash)] = cltv
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to iterate over entries: %v", err)
+	}
+	if !reflect.DeepEqual(entries, visited) {
+		t.Fatalf("Expected entries %v, got %v", spew.Sdump(entries),
+			spew.Sdump(visited))
+	}
+
+	errStop := fmt.Errorf("stop")
+	var numVisited int
+	err = d.ForEach(func(hash []byte, cltv uint32) error {
+		numVisited++
+		return errStop
+	})
+	if err != errStop || numVisited != 1 {
+		t.Fatalf("Expected iteration to stop after 1 entry with %v, "+
+			"got %v after %v", errStop, err, numVisited)
+	}
+}
+
+// TestDecayedLogLifecycle checks that Start and Stop may be called
+// repeatedly, and that operations on a stopped DecayedLog fail with
+// ErrLogStopped instead of hitting a closed database.
+func TestDecayedLogLifecycle(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	// Stopping a DecayedLog which was never started has no effect.
+	d := &DecayedLog{}
+	d.Stop()
+
+	if _, err := d.Get([]byte("hash")); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped before Start, got %v", err)
+	}
+
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog twice: %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{1}, defaultHashSize)
+	if err := d.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	d.Stop()
+	d.Stop()
+
+	if _, err := d.Get(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Get, got %v", err)
+	}
+	if err := d.Put(hash, cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Put, got %v", err)
+	}
+	if err := d.Delete(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Delete, got %v", err)
+	}
+	if err := d.Prune(cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Prune, got %v", err)
+	}
+	if err := d.Flush(); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Flush, got %v", err)
+	}
+	if _, err := d.Stats(); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Stats, got %v", err)
+	}
+
+	// The DecayedLog can be started again after being stopped.
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	defer d.Stop()
+
+	value, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if value != cltv {
+		t.Fatalf("Expected cltv %v after restart, got %v", cltv, value)
+	}
+}
+
+// TestDecayedLogGCError checks that a failure of the garbage collector is
+// passed to OnError, and that Stop still returns afterwards.
+func TestDecayedLogGCError(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	notifier := mockchain.NewNotifier(0)
+	errChan := make(chan error, 1)
+	d := &DecayedLog{
+		Notifier: notifier,
+		OnError: func(err error) {
+			errChan <- err
+		},
+	}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+
+	// Shutting down the epoch client terminates the garbage collector.
+	notifier.Stop()
+
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatalf("Expected a non-nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Garbage collector error wasn't reported")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop didn't return")
+	}
+}
+
+// TestDecayedLogConcurrentStop checks that operations racing with Stop
+// either succeed or fail with ErrLogStopped.
+func TestDecayedLogConcurrentStop(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	d := &DecayedLog{}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+
+	const numWorkers = 4
+	errChan := make(chan error, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func(i int) {
+			hash := bytes.Repeat([]byte{byte(i)}, defaultHashSize)
+			for {
+				if err := d.Put(hash, cltv); err != nil {
+					errChan <- err
+					return
+				}
+				if _, err := d.Get(hash); err != nil {
+					errChan <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	d.Stop()
+
+	for i := 0; i < numWorkers; i++ {
+		if err := <-errChan; err != ErrLogStopped {
+			t.Fatalf("Expected ErrLogStopped, got %v", err)
+		}
+	}
+}
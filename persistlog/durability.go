@@ -0,0 +1,260 @@
+package persistlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// SyncPolicy determines when the writes of a DecayedLog become durable, and
+// hence which entries survive a crash.
+type SyncPolicy uint8
+
+const (
+	// SyncAlways commits every write in a batched transaction which is
+	// fsynced before Put, Delete or Prune return. An entry which has
+	// been stored survives any crash. This is the default.
+	SyncAlways SyncPolicy = iota
+
+	// SyncBuffered keeps stored entries in memory, and writes them to the
+	// database in a single fsynced transaction on Flush, every
+	// FlushInterval, once MaxBufferSize entries are buffered, and on
+	// Stop. Entries which haven't been flushed yet are lost on a crash,
+	// so the packets they protect become replayable until their CLTV
+	// expires. Lookups see buffered entries immediately.
+	SyncBuffered
+
+	// SyncDisabled commits every write, but doesn't fsync the database,
+	// leaving durability to the operating system. Flush forces an fsync.
+	// On a crash of the operating system, recent commits may be lost and
+	// the database may be corrupted, so this policy is only suitable if
+	// the replay log can be discarded, e.g. on a ramdisk.
+	SyncDisabled
+)
+
+// String returns a human readable name of the SyncPolicy.
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+
+	case SyncBuffered:
+		return "buffered"
+
+	case SyncDisabled:
+		return "disabled"
+
+	default:
+		return fmt.Sprintf("unknown<%d>", uint8(p))
+	}
+}
+
+const (
+	// defaultMaxBufferSize is the default number of buffered entries
+	// which triggers a flush in SyncBuffered mode.
+	defaultMaxBufferSize = 1000
+)
+
+// bufferPut buffers the passed entry, flushing the buffer if it's full. A hash
+// which is already buffered keeps the greater of both CLTVs. The caller MUST
+// have checked the expiry of the entry.
+func (d *DecayedLog) bufferPut(hash []byte, cltv uint32) error {
+	d.bufMtx.Lock()
+	if oldCltv, ok := d.buffer[string(hash)]; ok {
+		d.bufferedCollisions++
+		if oldCltv > cltv {
+			cltv = oldCltv
+		}
+	}
+	d.buffer[string(hash)] = cltv
+
+	maxBufferSize := d.MaxBufferSize
+	if maxBufferSize == 0 {
+		maxBufferSize = defaultMaxBufferSize
+	}
+	full := len(d.buffer) >= maxBufferSize
+	d.bufMtx.Unlock()
+
+	if full {
+		return d.flush()
+	}
+
+	return nil
+}
+
+// bufferGet returns the CLTV of the passed hash if it's buffered, or being
+// flushed.
+func (d *DecayedLog) bufferGet(hash []byte) (uint32, bool) {
+	d.bufMtx.Lock()
+	defer d.bufMtx.Unlock()
+
+	if cltv, ok := d.buffer[string(hash)]; ok {
+		return cltv, true
+	}
+
+	cltv, ok := d.inflight[string(hash)]
+	return cltv, ok
+}
+
+// bufferDelete removes the passed hash from the buffer.
+func (d *DecayedLog) bufferDelete(hash []byte) {
+	d.bufMtx.Lock()
+	delete(d.buffer, string(hash))
+	d.bufMtx.Unlock()
+}
+
+// bufferPrune removes every buffered entry whose CLTV is below the passed
+// height, returning the number of removed entries. Entries of a flush in
+// flight are left to the flush, which skips the expired ones.
+func (d *DecayedLog) bufferPrune(height uint32) uint64 {
+	d.bufMtx.Lock()
+	defer d.bufMtx.Unlock()
+
+	var numPurged uint64
+	for hash, cltv := range d.buffer {
+		if cltv < height {
+			delete(d.buffer, hash)
+			numPurged++
+		}
+	}
+
+	return numPurged
+}
+
+// Flush makes every write of the DecayedLog durable. In SyncBuffered mode,
+// the buffered entries are written to the database in a single fsynced
+// transaction. If the transaction fails, the entries remain buffered. In
+// SyncDisabled mode, the database is fsynced. In SyncAlways mode, every
+// write is already durable, so Flush does nothing.
+func (d *DecayedLog) Flush() error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	return d.flush()
+}
+
+// flush implements Flush. The caller MUST have acquired the DecayedLog.
+func (d *DecayedLog) flush() error {
+	switch d.SyncPolicy {
+	case SyncDisabled:
+		return d.db.Sync()
+
+	case SyncBuffered:
+
+	default:
+		return nil
+	}
+
+	// Flushes are serialized, so entries are never written out of order
+	// by concurrent flushes.
+	d.flushMtx.Lock()
+	defer d.flushMtx.Unlock()
+
+	// The entries are kept in flight until the transaction completes,
+	// so lookups never miss an entry which is being written.
+	d.bufMtx.Lock()
+	buffer := d.buffer
+	collisions := d.bufferedCollisions
+	d.buffer = make(map[string]uint32)
+	d.inflight = buffer
+	d.bufferedCollisions = 0
+	d.bufMtx.Unlock()
+
+	if len(buffer) == 0 && collisions == 0 {
+		return nil
+	}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+		cltvIndex := tx.Bucket(cltvIndexBucket)
+		if cltvIndex == nil {
+			return fmt.Errorf("cltvIndexBucket is nil")
+		}
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("metaBucket is nil")
+		}
+
+		for i := 0; i < collisions; i++ {
+			if err := incrementCollisions(meta); err != nil {
+				return err
+			}
+		}
+
+		// A Prune committed while the entries were in flight doesn't
+		// remove them from the flush, so the entries which have
+		// expired since are skipped.
+		threshold := d.expiryThreshold()
+		if heightBytes := meta.Get(gcHeightKey); heightBytes != nil &&
+			d.ExpiryMode == BlockExpiry {
+
+			gcHeight := binary.BigEndian.Uint32(heightBytes)
+			if gcHeight > threshold {
+				threshold = gcHeight
+			}
+		}
+
+		for hash, cltv := range buffer {
+			if cltv < threshold {
+				continue
+			}
+
+			err := putEntry(sharedHashes, cltvIndex, meta,
+				[]byte(hash), cltv)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	d.bufMtx.Lock()
+	defer d.bufMtx.Unlock()
+
+	d.inflight = nil
+	if err != nil {
+		// Restore the entries, without overwriting newer ones.
+		for hash, cltv := range buffer {
+			if _, ok := d.buffer[hash]; !ok {
+				d.buffer[hash] = cltv
+			}
+		}
+		d.bufferedCollisions += collisions
+
+		return err
+	}
+
+	return nil
+}
+
+// flusher periodically flushes the buffered entries. This function MUST be
+// run as a goroutine.
+func (d *DecayedLog) flusher() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A failed flush leaves the entries buffered, so
+			// they're retried on the next tick.
+			if err := d.Flush(); err != nil {
+				d.reportError(fmt.Errorf("Unable to flush "+
+					"buffered entries: %v", err))
+			}
+
+		case <-d.quit:
+			return
+		}
+	}
+}
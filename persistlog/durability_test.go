@@ -0,0 +1,373 @@
+package persistlog
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// crash simulates a crash of the process, by closing the database of the
+// DecayedLog without flushing any buffered entries.
+func crash(d *DecayedLog) {
+	close(d.quit)
+	d.wg.Wait()
+	d.close()
+}
+
+// restartAfterCrash starts a fresh DecayedLog on the database of a crashed
+// one.
+func restartAfterCrash(t *testing.T) *DecayedLog {
+	d := &DecayedLog{}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	return d
+}
+
+// TestDecayedLogCrashSyncAlways checks that stored entries survive a crash
+// in SyncAlways mode.
+func TestDecayedLogCrashSyncAlways(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	d := &DecayedLog{SyncPolicy: SyncAlways}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := d.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	crash(d)
+
+	d = restartAfterCrash(t)
+	defer d.Stop()
+
+	if val, _ := d.Get(hash); val != cltv {
+		t.Fatalf("Entry was lost in the crash")
+	}
+}
+
+// TestDecayedLogCrashSyncBuffered checks that buffered entries are visible
+// immediately, lost in a crash before Flush, and survive a crash after it.
+func TestDecayedLogCrashSyncBuffered(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	d := &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+
+	flushed := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	unflushed := bytes.Repeat([]byte{0x02}, sharedHashSize)
+
+	if err := d.Put(flushed, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if val, _ := d.Get(flushed); val != cltv {
+		t.Fatalf("Buffered entry isn't visible")
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Unable to flush DecayedLog: %v", err)
+	}
+
+	if err := d.Put(unflushed, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	crash(d)
+
+	d = restartAfterCrash(t)
+	defer d.Stop()
+
+	if val, _ := d.Get(flushed); val != cltv {
+		t.Fatalf("Flushed entry was lost in the crash")
+	}
+	if val, _ := d.Get(unflushed); val != math.MaxUint32 {
+		t.Fatalf("Unflushed entry survived the crash")
+	}
+}
+
+// TestDecayedLogBufferedFlushTriggers checks that buffered entries are
+// flushed once the buffer is full, periodically, and on Stop.
+func TestDecayedLogBufferedFlushTriggers(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	hashes := make([][]byte, 4)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+	}
+
+	// A full buffer is flushed.
+	d := &DecayedLog{SyncPolicy: SyncBuffered, MaxBufferSize: 2}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	for _, hash := range hashes[:2] {
+		if err := d.Put(hash, cltv); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+	crash(d)
+
+	// Buffered entries are flushed periodically.
+	d = &DecayedLog{
+		SyncPolicy:    SyncBuffered,
+		FlushInterval: 50 * time.Millisecond,
+	}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	if err := d.Put(hashes[2], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	crash(d)
+
+	// Buffered entries are flushed on Stop.
+	d = &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	if err := d.Put(hashes[3], cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	d.Stop()
+
+	d = restartAfterCrash(t)
+	defer d.Stop()
+
+	for i, hash := range hashes {
+		if val, _ := d.Get(hash); val != cltv {
+			t.Fatalf("Entry %v wasn't flushed", i)
+		}
+	}
+}
+
+// TestDecayedLogBufferedPruneDelete checks that buffered entries are subject
+// to Prune and Delete, and that collisions among them are accounted.
+func TestDecayedLogBufferedPruneDelete(t *testing.T) {
+	d := &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	expired := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	deleted := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	live := bytes.Repeat([]byte{0x03}, sharedHashSize)
+
+	for _, hash := range [][]byte{deleted, live, live} {
+		if err := d.Put(hash, cltv); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+	for _, height := range []uint32{cltv - 2, cltv - 1} {
+		if err := d.Put(expired, height); err != nil {
+			t.Fatalf("Unable to store in channeldb: %v", err)
+		}
+	}
+
+	if err := d.Delete(deleted); err != nil {
+		t.Fatalf("Unable to delete from channeldb: %v", err)
+	}
+	if err := d.Prune(cltv); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	if val, _ := d.Get(expired); val != math.MaxUint32 {
+		t.Fatalf("Buffered entry wasn't pruned")
+	}
+	if val, _ := d.Get(deleted); val != math.MaxUint32 {
+		t.Fatalf("Buffered entry wasn't deleted")
+	}
+
+	// Stats flush the buffer first.
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 1 || stats.Collisions != 2 ||
+		stats.LastPurged != 1 {
+
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestDecayedLogBufferedFlushInFlight checks that entries remain visible
+// while a flush is being committed, and that a concurrent Delete isn't undone
+// by the flush.
+func TestDecayedLogBufferedFlushInFlight(t *testing.T) {
+	d := &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := d.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Hold the write lock of the database, so the flush blocks while
+	// committing. The lock is released on failure as well, so the
+	// DecayedLog can be shut down.
+	locked := make(chan struct{})
+	unlock := make(chan struct{})
+	var unlockOnce sync.Once
+	release := func() {
+		unlockOnce.Do(func() { close(unlock) })
+	}
+	defer release()
+	go d.db.Update(func(tx *bolt.Tx) error {
+		close(locked)
+		<-unlock
+		return nil
+	})
+	<-locked
+
+	flushErr := make(chan error, 1)
+	go func() {
+		flushErr <- d.Flush()
+	}()
+
+	// Wait for the flush to take the entries out of the buffer.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.bufMtx.Lock()
+		buffered := len(d.buffer)
+		d.bufMtx.Unlock()
+		if buffered == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Flush didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if val, _ := d.Get(hash); val != cltv {
+		t.Fatalf("Entry isn't visible while being flushed")
+	}
+
+	deleteErr := make(chan error, 1)
+	go func() {
+		deleteErr <- d.Delete(hash)
+	}()
+
+	release()
+	if err := <-flushErr; err != nil {
+		t.Fatalf("Unable to flush DecayedLog: %v", err)
+	}
+	if err := <-deleteErr; err != nil {
+		t.Fatalf("Unable to delete from channeldb: %v", err)
+	}
+
+	if val, _ := d.Get(hash); val != math.MaxUint32 {
+		t.Fatalf("Deleted entry was restored by the flush")
+	}
+}
+
+// TestDecayedLogBufferedPruneInFlight checks that entries which are being
+// flushed while a Prune commits aren't written to the database once expired.
+func TestDecayedLogBufferedPruneInFlight(t *testing.T) {
+	d := &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := d.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	// Hold the write lock of the database, so the Prune and the flush
+	// queue up behind it, the Prune first.
+	locked := make(chan struct{})
+	unlock := make(chan struct{})
+	var unlockOnce sync.Once
+	release := func() {
+		unlockOnce.Do(func() { close(unlock) })
+	}
+	defer release()
+	go d.db.Update(func(tx *bolt.Tx) error {
+		close(locked)
+		<-unlock
+		return nil
+	})
+	<-locked
+
+	pruneErr := make(chan error, 1)
+	go func() {
+		pruneErr <- d.Prune(cltv + 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	flushErr := make(chan error, 1)
+	go func() {
+		flushErr <- d.Flush()
+	}()
+
+	// Wait for the flush to take the entry out of the buffer, so the
+	// Prune can't remove it from there.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.bufMtx.Lock()
+		buffered := len(d.buffer)
+		d.bufMtx.Unlock()
+		if buffered == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Flush didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	release()
+	if err := <-pruneErr; err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	if err := <-flushErr; err != nil {
+		t.Fatalf("Unable to flush DecayedLog: %v", err)
+	}
+
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 0 {
+		t.Fatalf("Expired entry was flushed to the database")
+	}
+}
+
+// TestDecayedLogSyncDisabled checks that writes aren't fsynced in
+// SyncDisabled mode, and that Flush forces an fsync.
+func TestDecayedLogSyncDisabled(t *testing.T) {
+	d := &DecayedLog{SyncPolicy: SyncDisabled}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if !d.db.NoSync {
+		t.Fatalf("Database is synced on every commit")
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := d.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Unable to flush DecayedLog: %v", err)
+	}
+	if val, _ := d.Get(hash); val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+}
@@ -0,0 +1,82 @@
+package persistlog
+
+import "fmt"
+
+var (
+	// ErrExpiredEntry is returned when attempting to store an entry whose
+	// CLTV has already expired according to the best known height. Such
+	// entries can't be replayed anyway, so there's no need to store them.
+	ErrExpiredEntry = fmt.Errorf("entry has already expired")
+
+	// ErrInvalidHashSize is returned when the configured hash size of a
+	// DecayedLog is out of range.
+	ErrInvalidHashSize = fmt.Errorf("hash size must be between %v and %v "+
+		"bytes", minHashSize, maxHashSize)
+
+	// ErrHashSizeMismatch is returned when the configured hash size of a
+	// DecayedLog differs from the hash size of its existing database.
+	ErrHashSizeMismatch = fmt.Errorf("hash size doesn't match the hash " +
+		"size of the database")
+
+	// ErrNewerDBVersion is returned when attempting to open a database
+	// which was written by a newer version of the DecayedLog.
+	ErrNewerDBVersion = fmt.Errorf("database was written by a newer " +
+		"version of the DecayedLog")
+
+	// ErrBucketRangeMismatch is returned when the configured bucket range
+	// of a BucketedLog differs from the bucket range of its existing
+	// database.
+	ErrBucketRangeMismatch = fmt.Errorf("bucket range doesn't match the " +
+		"bucket range of the database")
+
+	// ErrCorruptLog is returned when the FileLog encounters a record or
+	// metadata which fails its checksum, outside of the torn tail of the
+	// last segment.
+	ErrCorruptLog = fmt.Errorf("file log is corrupt")
+
+	// ErrInvalidSnapshot is returned when importing a snapshot which is
+	// truncated or malformed.
+	ErrInvalidSnapshot = fmt.Errorf("invalid replay log snapshot")
+
+	// ErrUnknownSnapshotVersion is returned when importing a snapshot of
+	// an unknown version.
+	ErrUnknownSnapshotVersion = fmt.Errorf("unknown replay log snapshot " +
+		"version")
+
+	// ErrSnapshotChecksum is returned when the checksum of an imported
+	// snapshot doesn't match its contents.
+	ErrSnapshotChecksum = fmt.Errorf("replay log snapshot checksum " +
+		"mismatch")
+
+	// ErrSaltMismatch is returned when importing a snapshot into a
+	// non-empty replay log which uses a different salt or hash size. As
+	// the stored hashes are keyed, the entries of both can't be merged.
+	ErrSaltMismatch = fmt.Errorf("snapshot salt doesn't match the salt " +
+		"of the replay log")
+
+	// ErrInvalidNamespace is returned when requesting a namespace with an
+	// empty name.
+	ErrInvalidNamespace = fmt.Errorf("namespace name must not be empty")
+
+	// ErrLogStopped is returned by the operations of a replay log which
+	// isn't started, either because Start hasn't been called yet or
+	// because it has been stopped.
+	ErrLogStopped = fmt.Errorf("replay log is stopped")
+
+	// ErrExpiryModeMismatch is returned when the configured ExpiryMode of
+	// a DecayedLog differs from the mode of its existing database, or of
+	// a snapshot being imported.
+	ErrExpiryModeMismatch = fmt.Errorf("expiry mode doesn't match the " +
+		"expiry mode of the database")
+
+	// ErrFilteredTimeExpiry is returned when starting a FilteredLog which
+	// wraps a DecayedLog in TimeExpiry mode, as its filter generations
+	// are keyed by block height.
+	ErrFilteredTimeExpiry = fmt.Errorf("filtered log requires block " +
+		"based expiry")
+
+	// ErrNamespaceExpiryMode is returned when requesting a namespace of a
+	// DecayedLog which doesn't use BlockExpiry.
+	ErrNamespaceExpiryMode = fmt.Errorf("namespaces require block based " +
+		"expiry")
+)
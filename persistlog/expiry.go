@@ -0,0 +1,212 @@
+package persistlog
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// expiryModeKey is the key within the metaBucket under which the
+	// ExpiryMode of the database is stored. Databases without it use
+	// BlockExpiry.
+	expiryModeKey = []byte("expiry-mode")
+)
+
+// ExpiryMode determines what the expiry of the entries of a DecayedLog is
+// based on.
+type ExpiryMode uint8
+
+const (
+	// BlockExpiry expires entries once the best height of the chain
+	// reaches their CLTV. Garbage collection is driven by the block
+	// epochs of the Notifier. This is the default.
+	BlockExpiry ExpiryMode = iota
+
+	// TimeExpiry expires entries EntryTTL after they have been stored,
+	// ignoring the CLTV passed to Put. Garbage collection is driven by the
+	// Clock every GCInterval, so no chain backend is required. The
+	// database stores the deadline of every entry as a unix timestamp in
+	// place of its CLTV, so a database can't switch between modes.
+	TimeExpiry
+)
+
+// String returns a human readable name of the ExpiryMode.
+func (m ExpiryMode) String() string {
+	switch m {
+	case BlockExpiry:
+		return "block"
+
+	case TimeExpiry:
+		return "time"
+
+	default:
+		return fmt.Sprintf("unknown<%d>", uint8(m))
+	}
+}
+
+const (
+	// defaultEntryTTL is the default duration entries are kept for in
+	// TimeExpiry mode.
+	defaultEntryTTL = 24 * time.Hour
+
+	// defaultGCInterval is the default interval of the garbage collector
+	// in TimeExpiry mode.
+	defaultGCInterval = time.Minute
+)
+
+// Clock is the source of time of the TimeExpiry mode. It allows tests to
+// control the passage of time deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the passed duration to elapse and then sends the
+	// current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is a Clock backed by the system time.
+type systemClock struct{}
+
+// Now returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the passed duration using time.After.
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock returns the Clock of the DecayedLog, defaulting to the system clock.
+func (d *DecayedLog) clock() Clock {
+	if d.Clock == nil {
+		return systemClock{}
+	}
+
+	return d.Clock
+}
+
+// deadline returns the unix timestamp at which an entry stored now expires
+// in TimeExpiry mode.
+func (d *DecayedLog) deadline() uint32 {
+	ttl := d.EntryTTL
+	if ttl == 0 {
+		ttl = defaultEntryTTL
+	}
+
+	return uint32(d.clock().Now().Add(ttl).Unix())
+}
+
+// expiryThreshold returns the value below which the stored CLTVs, or
+// deadlines in TimeExpiry mode, have expired: the best known height, or the
+// current time of the Clock.
+func (d *DecayedLog) expiryThreshold() uint32 {
+	if d.ExpiryMode == TimeExpiry {
+		return uint32(d.clock().Now().Unix())
+	}
+
+	return d.BestHeight()
+}
+
+// loadExpiryMode ensures that the ExpiryMode of the DecayedLog matches the
+// mode of its database, and stores the mode of a new database.
+func (d *DecayedLog) loadExpiryMode(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return fmt.Errorf("metaBucket is nil")
+	}
+
+	if mode := meta.Get(expiryModeKey); mode != nil {
+		if len(mode) != 1 || ExpiryMode(mode[0]) != d.ExpiryMode {
+			return ErrExpiryModeMismatch
+		}
+
+		return nil
+	}
+
+	// Databases which predate the expiry mode hold CLTVs, so they may
+	// only switch to TimeExpiry while they're empty.
+	if d.ExpiryMode != BlockExpiry {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+
+		if k, _ := sharedHashes.Cursor().First(); k != nil {
+			return ErrExpiryModeMismatch
+		}
+	}
+
+	return meta.Put(expiryModeKey, []byte{byte(d.ExpiryMode)})
+}
+
+// PruneExpired deletes every entry whose deadline has passed at the passed
+// time. It's called by the garbage collector in TimeExpiry mode, and unlike
+// Prune, it doesn't affect the best height of the DecayedLog.
+func (d *DecayedLog) PruneExpired(now time.Time) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	deadline := uint32(now.Unix())
+
+	var numPurged uint64
+	err := d.db.Batch(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+
+		cltvIndex := tx.Bucket(cltvIndexBucket)
+		if cltvIndex == nil {
+			return fmt.Errorf("cltvIndexBucket is nil")
+		}
+
+		var err error
+		numPurged, err = pruneEntries(sharedHashes, cltvIndex, deadline)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	numPurged += d.bufferPrune(deadline)
+
+	atomic.StoreUint64(&d.lastPurged, numPurged)
+	atomic.AddUint64(&d.totalPurged, numPurged)
+
+	return nil
+}
+
+// timeCollector deletes the entries whose deadline has passed every
+// GCInterval in TimeExpiry mode. Failures are reported through OnError. This
+// function MUST be run as a goroutine.
+func (d *DecayedLog) timeCollector() {
+	defer d.wg.Done()
+
+	interval := d.GCInterval
+	if interval == 0 {
+		interval = defaultGCInterval
+	}
+
+	clock := d.clock()
+	for {
+		select {
+		case now := <-clock.After(interval):
+			// A failed garbage collection is retried on the next
+			// tick, as PruneExpired removes every expired entry.
+			if err := d.PruneExpired(now); err != nil {
+				d.reportError(fmt.Errorf("Error pruning "+
+					"channeldb: %v", err))
+			}
+
+		case <-d.quit:
+			return
+		}
+	}
+}
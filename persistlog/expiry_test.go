@@ -0,0 +1,303 @@
+package persistlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockClock is a Clock whose time only advances when Advance is called.
+type mockClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	waiters []mockWaiter
+
+	// armed receives a value whenever After is called, which allows tests
+	// to wait for the garbage collector to complete a collection.
+	armed chan struct{}
+}
+
+// mockWaiter is a pending call to After of a mockClock.
+type mockWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newMockClock(now time.Time) *mockClock {
+	return &mockClock{
+		now:   now,
+		armed: make(chan struct{}, 100),
+	}
+}
+
+func (m *mockClock) Now() time.Time {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.now
+}
+
+func (m *mockClock) After(d time.Duration) <-chan time.Time {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	c := make(chan time.Time, 1)
+	m.waiters = append(m.waiters, mockWaiter{m.now.Add(d), c})
+	m.armed <- struct{}{}
+
+	return c
+}
+
+// Advance moves the time forward, firing the waiters whose deadline passed.
+func (m *mockClock) Advance(d time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.now = m.now.Add(d)
+
+	var pending []mockWaiter
+	for _, w := range m.waiters {
+		if w.deadline.After(m.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- m.now
+	}
+	m.waiters = pending
+}
+
+// waitArmed waits for the garbage collector to call After.
+func (m *mockClock) waitArmed(t *testing.T) {
+	select {
+	case <-m.armed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Garbage collector didn't wait for the clock")
+	}
+}
+
+// TestDecayedLogTimeExpiry checks that entries are garbage collected once
+// their deadline passes in TimeExpiry mode, without affecting the best
+// height.
+func TestDecayedLogTimeExpiry(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	start := time.Unix(1500000000, 0)
+	clock := newMockClock(start)
+	d := &DecayedLog{
+		ExpiryMode: TimeExpiry,
+		EntryTTL:   time.Hour,
+		GCInterval: time.Minute,
+		Clock:      clock,
+	}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer d.Stop()
+	clock.waitArmed(t)
+
+	// The CLTV is ignored in favor of the deadline of the entry.
+	hash := bytes.Repeat([]byte{1}, defaultHashSize)
+	if err := d.Put(hash, 0); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	value, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	deadline := uint32(start.Add(time.Hour).Unix())
+	if value != deadline {
+		t.Fatalf("Expected deadline %v, got %v", deadline, value)
+	}
+
+	clock.Advance(30 * time.Minute)
+	clock.waitArmed(t)
+
+	value, err = d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if value != deadline {
+		t.Fatalf("Entry was collected before its deadline")
+	}
+
+	clock.Advance(31 * time.Minute)
+	clock.waitArmed(t)
+
+	value, err = d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if value != math.MaxUint32 {
+		t.Fatalf("Entry wasn't collected after its deadline")
+	}
+
+	if d.BestHeight() != 0 {
+		t.Fatalf("Expected best height 0, got %v", d.BestHeight())
+	}
+}
+
+// TestDecayedLogTimeExpiryRestart checks that entries which expired while the
+// DecayedLog was stopped are collected on Start, and that the expiry mode of
+// a database can't be changed.
+func TestDecayedLogTimeExpiryRestart(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	clock := newMockClock(time.Unix(1500000000, 0))
+	d := &DecayedLog{
+		ExpiryMode: TimeExpiry,
+		EntryTTL:   time.Hour,
+		Clock:      clock,
+	}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+
+	if _, err := d.Namespace("ns", NamespaceConfig{}); err != ErrNamespaceExpiryMode {
+		t.Fatalf("Expected ErrNamespaceExpiryMode, got %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{1}, defaultHashSize)
+	if err := d.Put(hash, 0); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	d.Stop()
+
+	blockLog := &DecayedLog{}
+	if err := blockLog.Start("tempdir"); err != ErrExpiryModeMismatch {
+		t.Fatalf("Expected ErrExpiryModeMismatch, got %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	defer d.Stop()
+
+	value, err := d.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if value != math.MaxUint32 {
+		t.Fatalf("Expired entry wasn't collected on Start")
+	}
+}
+
+// legacySnapshot converts a snapshot of a DecayedLog in BlockExpiry mode into
+// a snapshot of the legacy format, which lacks the expiry mode.
+func legacySnapshot(snapshot []byte) []byte {
+	modeOffset := len(snapshotMagic) + 2
+	body := snapshot[:len(snapshot)-sha256.Size]
+
+	var legacy []byte
+	legacy = append(legacy, body[:modeOffset]...)
+	legacy = append(legacy, body[modeOffset+1:]...)
+	legacy[len(snapshotMagic)] = legacySnapshotVersion
+
+	checksum := sha256.Sum256(legacy)
+	return append(legacy, checksum[:]...)
+}
+
+// TestDecayedLogSnapshotExpiryMode checks that snapshots carry the expiry
+// mode of their DecayedLog, are only imported into a DecayedLog of the same
+// mode, and omit the entries whose deadline has passed in TimeExpiry mode.
+func TestDecayedLogSnapshotExpiryMode(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+	defer os.RemoveAll("tempdir2")
+	defer os.RemoveAll("tempdir3")
+
+	// The garbage collector never fires, so expired entries are only
+	// omitted by Export itself.
+	clock := newMockClock(time.Unix(1500000000, 0))
+	newTimeLog := func(dir string) *DecayedLog {
+		d := &DecayedLog{
+			ExpiryMode: TimeExpiry,
+			EntryTTL:   time.Hour,
+			GCInterval: 24 * time.Hour,
+			Clock:      clock,
+		}
+		if err := d.Start(dir); err != nil {
+			t.Fatalf("Unable to start DecayedLog: %v", err)
+		}
+
+		return d
+	}
+
+	timeLog := newTimeLog("tempdir")
+	defer timeLog.Stop()
+
+	expired := bytes.Repeat([]byte{1}, defaultHashSize)
+	live := bytes.Repeat([]byte{2}, defaultHashSize)
+	if err := timeLog.Put(expired, 0); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	clock.Advance(30 * time.Minute)
+	if err := timeLog.Put(live, 0); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	clock.Advance(40 * time.Minute)
+
+	var timeSnapshot bytes.Buffer
+	if err := timeLog.Export(&timeSnapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+
+	otherTimeLog := newTimeLog("tempdir2")
+	defer otherTimeLog.Stop()
+
+	numImported, err := otherTimeLog.Import(
+		bytes.NewReader(timeSnapshot.Bytes()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to import snapshot: %v", err)
+	}
+	if numImported != 1 {
+		t.Fatalf("Expected 1 imported entry, got %v", numImported)
+	}
+	if val, _ := otherTimeLog.Get(expired); val != math.MaxUint32 {
+		t.Fatalf("Expired entry was exported")
+	}
+	liveDeadline, _ := timeLog.Get(live)
+	if val, _ := otherTimeLog.Get(live); val != liveDeadline {
+		t.Fatalf("Expected deadline %v, got %v", liveDeadline, val)
+	}
+
+	// Deadlines can't be imported as CLTVs, nor the other way around.
+	blockLog := &DecayedLog{}
+	if err := blockLog.Start("tempdir3"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer blockLog.Stop()
+
+	_, err = blockLog.Import(bytes.NewReader(timeSnapshot.Bytes()))
+	if err != ErrExpiryModeMismatch {
+		t.Fatalf("Expected ErrExpiryModeMismatch, got %v", err)
+	}
+
+	if err := blockLog.Put(expired, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	var blockSnapshot bytes.Buffer
+	if err := blockLog.Export(&blockSnapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+
+	_, err = otherTimeLog.Import(bytes.NewReader(blockSnapshot.Bytes()))
+	if err != ErrExpiryModeMismatch {
+		t.Fatalf("Expected ErrExpiryModeMismatch, got %v", err)
+	}
+
+	// Legacy snapshots predate the expiry mode, and hold CLTVs.
+	legacy := legacySnapshot(blockSnapshot.Bytes())
+	_, err = otherTimeLog.Import(bytes.NewReader(legacy))
+	if err != ErrExpiryModeMismatch {
+		t.Fatalf("Expected ErrExpiryModeMismatch, got %v", err)
+	}
+	if _, err := blockLog.Import(bytes.NewReader(legacy)); err != nil {
+		t.Fatalf("Unable to import legacy snapshot: %v", err)
+	}
+}
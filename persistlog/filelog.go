@@ -0,0 +1,773 @@
+package persistlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/chainntnfs"
+)
+
+const (
+	// defaultFileLogDirectory is the default directory where the FileLog
+	// will store its segments.
+	defaultFileLogDirectory = "filehashes"
+
+	// defaultSegmentSize is the default size in bytes after which the
+	// FileLog starts a new segment.
+	defaultSegmentSize = 4 << 20
+
+	// fileLogVersion is the format version of the FileLog.
+	fileLogVersion = 1
+
+	// metaFileName is the name of the file holding the metadata of the
+	// FileLog.
+	metaFileName = "meta"
+
+	// segmentFilePattern is the format of the names of segment files,
+	// which contain the sequence number of the segment.
+	segmentFilePattern = "segment-%08d.log"
+
+	// metaFileSize is the size in bytes of the metadata file: the version,
+	// hash size, salt and gc height, followed by a checksum.
+	metaFileSize = 4 + 1 + saltSize + 4 + 4
+
+	// recordPut and recordDelete are the types of records within a
+	// segment.
+	recordPut    = 0
+	recordDelete = 1
+
+	// recordHeaderSize is the size in bytes of the type and hash length
+	// preceding the hash of a record.
+	recordHeaderSize = 2
+
+	// recordTrailerSize is the size in bytes of the CLTV and checksum
+	// following the hash of a record.
+	recordTrailerSize = 4 + 4
+
+	// maxRecordSize is the size in bytes of a record with the longest
+	// possible hash. As records are appended one at a time, a crash can
+	// tear at most this many bytes at the end of the last segment.
+	maxRecordSize = recordHeaderSize + math.MaxUint8 + recordTrailerSize
+)
+
+// crcTable is the CRC-32C table used to checksum records and metadata.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is a single append-only file of the FileLog.
+type segment struct {
+	seq uint64
+
+	// maxCltv is the highest CLTV of any record within the segment. Once
+	// it has expired, the segment can be removed.
+	maxCltv uint32
+
+	size int64
+}
+
+// segmentFile is the open file of the current segment.
+type segmentFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// fileEntry is the in-memory state of a stored hash.
+type fileEntry struct {
+	cltv uint32
+}
+
+// FileLog implements the PersistLog interface without a database. Every Put
+// and Delete appends a checksummed record to the current segment file, and
+// Start rebuilds an in-memory map of the stored entries by replaying the
+// segments in order. A record torn by a crash at the end of the last segment
+// is discarded. Any other corrupt record, including one followed by more
+// than a single record's worth of data within the last segment, fails Start
+// with ErrCorruptLog rather than discarding the records following it.
+//
+// A new segment is started once the current one exceeds SegmentSize. The
+// garbage collector removes expired entries from memory, and deletes every
+// segment whose records all carry an expired CLTV.
+type FileLog struct {
+	mtx sync.Mutex
+
+	// lifecycleMtx serializes Start and Stop. started is only modified
+	// while holding both lifecycleMtx and mtx, so either of them guards
+	// reading it.
+	lifecycleMtx sync.Mutex
+	started      bool
+
+	dir      string
+	segments []*segment
+	current  segmentFile
+	entries  map[string]fileEntry
+
+	bestHeight uint32
+
+	hits        uint64
+	lastPurged  uint64
+	totalPurged uint64
+	collisions  uint64
+
+	wg       sync.WaitGroup
+	quit     chan (struct{})
+	Notifier chainntnfs.ChainNotifier
+
+	// StartHeight is the current best height of the chain at the time
+	// the FileLog is started. It's optional, and if set, entries which
+	// expired before this height are garbage collected on Start.
+	StartHeight uint32
+
+	// OnPrune is called by the garbage collector with the height of every
+	// block epoch it has pruned the FileLog at, see DecayedLog.OnPrune.
+	OnPrune func(height uint32)
+
+	// OnError is called with the failures of the garbage collector, see
+	// DecayedLog.OnError.
+	OnError func(error)
+
+	// SegmentSize is the size in bytes after which a new segment is
+	// started. If zero, segments are started after 4MB.
+	SegmentSize int64
+
+	// HashSize is the size in bytes the keyed hashes are truncated to,
+	// see DecayedLog.HashSize.
+	HashSize int
+
+	// salt and hashSize are read from the metadata on Start.
+	salt     []byte
+	hashSize int
+}
+
+// A compile time check to see if FileLog adheres to the PersistLog
+// interface.
+var _ PersistLog = (*FileLog)(nil)
+
+// segmentPath returns the path of the segment file with the passed sequence
+// number.
+func (f *FileLog) segmentPath(seq uint64) string {
+	return filepath.Join(f.dir, fmt.Sprintf(segmentFilePattern, seq))
+}
+
+// encodeRecord serializes a record of the passed type.
+func encodeRecord(recordType byte, hash []byte, cltv uint32) []byte {
+	record := make([]byte, 0, recordHeaderSize+len(hash)+recordTrailerSize)
+	record = append(record, recordType, byte(len(hash)))
+	record = append(record, hash...)
+
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], cltv)
+	record = append(record, scratch[:]...)
+
+	binary.BigEndian.PutUint32(scratch[:], crc32.Checksum(record, crcTable))
+	return append(record, scratch[:]...)
+}
+
+// readRecord reads a single record from the passed reader. io.EOF is only
+// returned if the reader is exhausted before the first byte of the record,
+// any other incomplete or invalid record results in ErrCorruptLog.
+func readRecord(r io.Reader) (byte, []byte, uint32, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return 0, nil, 0, 0, err
+	}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return 0, nil, 0, 0, ErrCorruptLog
+	}
+
+	rest := make([]byte, int(header[1])+recordTrailerSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return 0, nil, 0, 0, ErrCorruptLog
+	}
+
+	hashLen := int(header[1])
+	checksum := binary.BigEndian.Uint32(rest[hashLen+4:])
+	crc := crc32.Update(crc32.Checksum(header[:], crcTable), crcTable,
+		rest[:hashLen+4])
+	if crc != checksum || header[0] > recordDelete {
+		return 0, nil, 0, 0, ErrCorruptLog
+	}
+
+	hash := rest[:hashLen]
+	cltv := binary.BigEndian.Uint32(rest[hashLen : hashLen+4])
+	size := int64(recordHeaderSize + len(rest))
+
+	return header[0], hash, cltv, size, nil
+}
+
+// writeMeta atomically replaces the metadata file with the current metadata
+// and the passed gc height.
+func (f *FileLog) writeMeta(gcHeight uint32) error {
+	var b bytes.Buffer
+	var scratch [4]byte
+
+	binary.BigEndian.PutUint32(scratch[:], fileLogVersion)
+	b.Write(scratch[:])
+	b.WriteByte(byte(f.hashSize))
+	b.Write(f.salt)
+	binary.BigEndian.PutUint32(scratch[:], gcHeight)
+	b.Write(scratch[:])
+	binary.BigEndian.PutUint32(scratch[:], crc32.Checksum(b.Bytes(), crcTable))
+	b.Write(scratch[:])
+
+	tempPath := filepath.Join(f.dir, metaFileName+".tmp")
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, filepath.Join(f.dir, metaFileName))
+}
+
+// readMeta reads the metadata file, creating it if it doesn't exist yet. The
+// persisted gc height is returned.
+func (f *FileLog) readMeta() (uint32, error) {
+	metaBytes, err := ioutil.ReadFile(filepath.Join(f.dir, metaFileName))
+	if os.IsNotExist(err) {
+		if f.HashSize != 0 &&
+			(f.HashSize < minHashSize || f.HashSize > maxHashSize) {
+
+			return 0, ErrInvalidHashSize
+		}
+
+		f.hashSize = f.HashSize
+		if f.hashSize == 0 {
+			f.hashSize = defaultHashSize
+		}
+
+		f.salt = make([]byte, saltSize)
+		if _, err := rand.Read(f.salt); err != nil {
+			return 0, err
+		}
+
+		return 0, f.writeMeta(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(metaBytes) != metaFileSize {
+		return 0, ErrCorruptLog
+	}
+	checksum := binary.BigEndian.Uint32(metaBytes[metaFileSize-4:])
+	if crc32.Checksum(metaBytes[:metaFileSize-4], crcTable) != checksum {
+		return 0, ErrCorruptLog
+	}
+
+	if binary.BigEndian.Uint32(metaBytes[:4]) > fileLogVersion {
+		return 0, ErrNewerDBVersion
+	}
+
+	hashSize := int(metaBytes[4])
+	if f.HashSize != 0 && f.HashSize != hashSize {
+		return 0, ErrHashSizeMismatch
+	}
+
+	f.hashSize = hashSize
+	f.salt = append([]byte(nil), metaBytes[5:5+saltSize]...)
+
+	return binary.BigEndian.Uint32(metaBytes[5+saltSize:]), nil
+}
+
+// replaySegment applies the records of the passed segment file to the
+// in-memory map. If truncate is set, a torn record at the end of the segment
+// is discarded. Any other corrupt record results in ErrCorruptLog.
+func (f *FileLog) replaySegment(seg *segment, truncate bool) error {
+	file, err := os.OpenFile(f.segmentPath(seg.seq), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		recordType, hash, cltv, size, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+
+		// Only the last record can be torn by a crash, so a corrupt
+		// record followed by more data than fits into a single
+		// record indicates corruption rather than a torn write.
+		if err == ErrCorruptLog && truncate &&
+			info.Size()-seg.size <= maxRecordSize {
+
+			return file.Truncate(seg.size)
+		}
+		if err != nil {
+			return err
+		}
+
+		seg.size += size
+		if cltv > seg.maxCltv {
+			seg.maxCltv = cltv
+		}
+
+		switch recordType {
+		case recordPut:
+			f.entries[string(hash)] = fileEntry{cltv: cltv}
+
+		case recordDelete:
+			delete(f.entries, string(hash))
+		}
+	}
+}
+
+// append writes a record to the current segment and syncs it to disk,
+// starting a new segment if the current one is full. If the record can't be
+// written, the segment is truncated back to its previous size, so a partial
+// record doesn't precede the following ones. The caller MUST hold the mutex.
+func (f *FileLog) append(recordType byte, hash []byte, cltv uint32) error {
+	segmentSize := f.SegmentSize
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	last := f.segments[len(f.segments)-1]
+	if last.size >= segmentSize {
+		if err := f.current.Close(); err != nil {
+			return err
+		}
+
+		last = &segment{seq: last.seq + 1}
+		if err := f.openSegment(last); err != nil {
+			return err
+		}
+		f.segments = append(f.segments, last)
+	}
+
+	record := encodeRecord(recordType, hash, cltv)
+	_, err := f.current.Write(record)
+	if err == nil {
+		err = f.current.Sync()
+	}
+	if err != nil {
+		if truncErr := f.current.Truncate(last.size); truncErr != nil {
+			return fmt.Errorf("%v, unable to truncate segment: %v",
+				err, truncErr)
+		}
+		return err
+	}
+
+	last.size += int64(len(record))
+	if cltv > last.maxCltv {
+		last.maxCltv = cltv
+	}
+
+	return nil
+}
+
+// openSegment opens the passed segment for appending, creating it if needed.
+func (f *FileLog) openSegment(seg *segment) error {
+	file, err := os.OpenFile(f.segmentPath(seg.seq),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	f.current = file
+	return nil
+}
+
+// garbageCollector removes expired entries and segments. This function MUST
+// be run as a goroutine.
+func (f *FileLog) garbageCollector(
+	epochClient *chainntnfs.BlockEpochEvent) {
+
+	defer f.wg.Done()
+	defer epochClient.Cancel()
+
+	for {
+		select {
+		case epoch, ok := <-epochClient.Epochs:
+			if !ok {
+				f.reportError(fmt.Errorf("Epoch client " +
+					"shutting down"))
+				return
+			}
+
+			// A failed garbage collection is retried with the
+			// next block, as Prune removes every expired entry.
+			if err := f.Prune(uint32(epoch.Height)); err != nil {
+				f.reportError(fmt.Errorf("Error pruning "+
+					"file log: %v", err))
+				continue
+			}
+
+			if f.OnPrune != nil {
+				f.OnPrune(uint32(epoch.Height))
+			}
+
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// reportError passes an error of the garbage collector to OnError, if set.
+func (f *FileLog) reportError(err error) {
+	if f.OnError != nil {
+		f.OnError(err)
+	}
+}
+
+// Prune removes every entry whose CLTV is below the passed height from
+// memory, and deletes every segment, apart from the current one, whose
+// records have all expired. The height is persisted as the height of the
+// last garbage collection, unless a greater height has already been
+// recorded.
+func (f *FileLog) Prune(height uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return ErrLogStopped
+	}
+
+	if height > f.bestHeight {
+		if err := f.writeMeta(height); err != nil {
+			return err
+		}
+		f.bestHeight = height
+	}
+
+	var numPurged uint64
+	for hash, entry := range f.entries {
+		if entry.cltv < height {
+			delete(f.entries, hash)
+			numPurged++
+		}
+	}
+
+	live := f.segments[:0]
+	for i, seg := range f.segments {
+		if i == len(f.segments)-1 || seg.maxCltv >= height {
+			live = append(live, seg)
+			continue
+		}
+
+		if err := os.Remove(f.segmentPath(seg.seq)); err != nil {
+			return err
+		}
+	}
+	f.segments = live
+
+	f.lastPurged = numPurged
+	f.totalPurged += numPurged
+
+	return nil
+}
+
+// BestHeight returns the highest block height the FileLog knows of.
+func (f *FileLog) BestHeight() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.bestHeight
+}
+
+// retainedHeight returns the lowest CLTV the FileLog may still hold an entry
+// for, implementing the retentionLog interface.
+func (f *FileLog) retainedHeight() uint32 {
+	return f.BestHeight()
+}
+
+// HashSharedSecret returns the key under which the passed shared secret is
+// stored in the FileLog, see DecayedLog.HashSharedSecret.
+func (f *FileLog) HashSharedSecret(sharedSecret [sharedSecretSize]byte) []byte {
+	legacyHash := HashSharedSecret(sharedSecret)
+	return keyedHash(f.salt, legacyHash[:], f.hashSize)
+}
+
+// Delete removes the entry of the passed hash by appending a delete record.
+func (f *FileLog) Delete(hash []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return ErrLogStopped
+	}
+
+	entry, ok := f.entries[string(hash)]
+	if !ok {
+		return nil
+	}
+
+	// The delete record carries the CLTV of the deleted entry, so its
+	// segment isn't removed before the one holding the entry.
+	if err := f.append(recordDelete, hash, entry.cltv); err != nil {
+		return err
+	}
+	delete(f.entries, string(hash))
+
+	return nil
+}
+
+// Get retrieves the CLTV stored for the passed hash. If the hash isn't
+// stored, math.MaxUint32 is returned.
+func (f *FileLog) Get(hash []byte) (uint32, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return 0, ErrLogStopped
+	}
+
+	entry, ok := f.entries[string(hash)]
+	if !ok {
+		return math.MaxUint32, nil
+	}
+	f.hits++
+
+	return entry.cltv, nil
+}
+
+// Put appends a record of the passed hash and CLTV, and adds it to the
+// in-memory map. A stored hash keeps the greater of both CLTVs. If the CLTV
+// has already expired according to the best known height, ErrExpiredEntry is
+// returned and nothing is stored.
+func (f *FileLog) Put(hash []byte, cltv uint32) error {
+	if len(hash) > math.MaxUint8 {
+		return fmt.Errorf("hash of %v bytes is too long", len(hash))
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return ErrLogStopped
+	}
+
+	if cltv < f.bestHeight {
+		return ErrExpiredEntry
+	}
+
+	// A stored hash keeps the greater of both CLTVs, so no record is
+	// needed if the stored one isn't lower.
+	oldEntry, ok := f.entries[string(hash)]
+	if ok {
+		f.collisions++
+		if oldEntry.cltv >= cltv {
+			return nil
+		}
+	}
+
+	if err := f.append(recordPut, hash, cltv); err != nil {
+		return err
+	}
+
+	f.entries[string(hash)] = fileEntry{cltv: cltv}
+
+	return nil
+}
+
+// ForEach calls the passed function with the hash and CLTV of every stored
+// entry, in no particular order. Iteration stops at the first error returned
+// by the function, which is then returned. The function MUST NOT modify the
+// FileLog.
+func (f *FileLog) ForEach(cb func(hash []byte, cltv uint32) error) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return ErrLogStopped
+	}
+
+	for hash, entry := range f.entries {
+		if err := cb([]byte(hash), entry.cltv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of statistics about the FileLog.
+func (f *FileLog) Stats() (*Stats, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.started {
+		return nil, ErrLogStopped
+	}
+
+	stats := &Stats{
+		NumEntries:  uint64(len(f.entries)),
+		SizeOnDisk:  metaFileSize,
+		BestHeight:  f.bestHeight,
+		LastPurged:  f.lastPurged,
+		TotalPurged: f.totalPurged,
+		Hits:        f.hits,
+		Collisions:  f.collisions,
+	}
+
+	for _, seg := range f.segments {
+		stats.SizeOnDisk += seg.size
+	}
+
+	for _, entry := range f.entries {
+		if stats.OldestCltv == 0 || entry.cltv < stats.OldestCltv {
+			stats.OldestCltv = entry.cltv
+		}
+		if entry.cltv > stats.NewestCltv {
+			stats.NewestCltv = entry.cltv
+		}
+	}
+
+	return stats, nil
+}
+
+// Start opens the FileLog within the passed directory, and rebuilds the
+// in-memory map from its segments. It immediately garbage collects the
+// entries which expired while the FileLog was stopped, and starts the
+// garbage collector in a goroutine. Calling Start on a started FileLog has no
+// effect.
+func (f *FileLog) Start(dir string) error {
+	f.lifecycleMtx.Lock()
+	defer f.lifecycleMtx.Unlock()
+
+	if f.started {
+		return nil
+	}
+
+	// Create the quit channel
+	f.quit = make(chan struct{})
+
+	f.dir = dir
+	if f.dir == "" {
+		f.dir = defaultFileLogDirectory
+	}
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+
+	gcHeight, err := f.readMeta()
+	if err != nil {
+		return err
+	}
+
+	// Collect the existing segments in order of their sequence numbers.
+	names, err := filepath.Glob(filepath.Join(f.dir, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	f.segments = nil
+	for _, name := range names {
+		var seq uint64
+		_, err := fmt.Sscanf(filepath.Base(name), segmentFilePattern,
+			&seq)
+		if err != nil {
+			return fmt.Errorf("invalid segment file %v", name)
+		}
+
+		f.segments = append(f.segments, &segment{seq: seq})
+	}
+	sort.Slice(f.segments, func(i, j int) bool {
+		return f.segments[i].seq < f.segments[j].seq
+	})
+	if len(f.segments) == 0 {
+		f.segments = append(f.segments, &segment{})
+	}
+
+	// Replay the segments to rebuild the in-memory map. Only the last
+	// segment may contain a torn write.
+	f.entries = make(map[string]fileEntry)
+	for i, seg := range f.segments {
+		if _, err := os.Stat(f.segmentPath(seg.seq)); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := f.replaySegment(seg, i == len(f.segments)-1); err != nil {
+			return fmt.Errorf("Unable to replay segment %v: %v",
+				seg.seq, err)
+		}
+	}
+
+	if err := f.openSegment(f.segments[len(f.segments)-1]); err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	f.started = true
+	f.mtx.Unlock()
+
+	// Catch up on the entries which expired while we were offline, using
+	// the best height we know of.
+	f.bestHeight = gcHeight
+	f.hits, f.lastPurged, f.totalPurged, f.collisions = 0, 0, 0, 0
+	if f.StartHeight > gcHeight {
+		gcHeight = f.StartHeight
+	}
+	if err := f.Prune(gcHeight); err != nil {
+		f.close()
+		return fmt.Errorf("Unable to prune file log: %v", err)
+	}
+
+	// Start garbage collector.
+	if f.Notifier != nil {
+		epochClient, err := f.Notifier.RegisterBlockEpochNtfn()
+		if err != nil {
+			f.close()
+			return fmt.Errorf("Unable to register for epoch "+
+				"notification: %v", err)
+		}
+
+		f.wg.Add(1)
+		go f.garbageCollector(epochClient)
+	}
+
+	return nil
+}
+
+// Stop halts the garbage collector and closes the current segment.
+// Operations on a stopped FileLog fail with ErrLogStopped. Calling Stop on a
+// FileLog which isn't started has no effect.
+func (f *FileLog) Stop() {
+	f.lifecycleMtx.Lock()
+	defer f.lifecycleMtx.Unlock()
+
+	if !f.started {
+		return
+	}
+
+	// Stop garbage collector.
+	close(f.quit)
+	f.wg.Wait()
+
+	f.close()
+}
+
+// close marks the FileLog as stopped and closes the current segment.
+func (f *FileLog) close() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.started = false
+	f.current.Close()
+}
@@ -0,0 +1,321 @@
+package persistlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileLogTornWrite checks that a record torn by a crash at the end of the
+// last segment is discarded on Start, without losing the preceding records.
+func TestFileLogTornWrite(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in FileLog: %v", err)
+	}
+	f.Stop()
+
+	// Emulate a torn write of a second record.
+	segmentPath := f.segmentPath(0)
+	file, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Unable to open segment: %v", err)
+	}
+	tornHash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	record := encodeRecord(recordPut, tornHash, cltv)
+	file.Write(record[:len(record)-3])
+	file.Close()
+
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatalf("Unable to stat segment: %v", err)
+	}
+	goodSize := info.Size() - int64(len(record)-3)
+
+	f = &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart FileLog: %v", err)
+	}
+
+	if val, _ := f.Get(hash); val != cltv {
+		t.Fatalf("Record preceding the torn write was lost")
+	}
+	if val, _ := f.Get(tornHash); val != math.MaxUint32 {
+		t.Fatalf("Torn record was applied")
+	}
+
+	info, err = os.Stat(segmentPath)
+	if err != nil {
+		t.Fatalf("Unable to stat segment: %v", err)
+	}
+	if info.Size() != goodSize {
+		t.Fatalf("Torn record wasn't truncated: expected size %v, "+
+			"got %v", goodSize, info.Size())
+	}
+
+	// Records appended after the recovery must be readable again.
+	if err := f.Put(tornHash, cltv); err != nil {
+		t.Fatalf("Unable to store in FileLog: %v", err)
+	}
+	f.Stop()
+
+	f = &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart FileLog: %v", err)
+	}
+	defer f.Stop()
+
+	if val, _ := f.Get(tornHash); val != cltv {
+		t.Fatalf("Record appended after recovery was lost")
+	}
+}
+
+// TestFileLogCorruptSegment checks that corruption within a segment other
+// than the last one is reported rather than silently truncated.
+func TestFileLogCorruptSegment(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FileLog{SegmentSize: 1}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		hash := bytes.Repeat([]byte{byte(i)}, sharedHashSize)
+		if err := f.Put(hash, cltv); err != nil {
+			t.Fatalf("Unable to store in FileLog: %v", err)
+		}
+	}
+	f.Stop()
+
+	// Flip a bit of the first segment's record.
+	segmentPath := f.segmentPath(0)
+	record, err := ioutil.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatalf("Unable to read segment: %v", err)
+	}
+	record[3] ^= 0x01
+	if err := ioutil.WriteFile(segmentPath, record, 0600); err != nil {
+		t.Fatalf("Unable to write segment: %v", err)
+	}
+
+	f = &FileLog{SegmentSize: 1}
+	if err := f.Start("tempdir"); err == nil {
+		f.Stop()
+		t.Fatalf("Corrupt segment was accepted")
+	}
+}
+
+// TestFileLogSegmentRemoval checks that segments are removed once all their
+// records have expired.
+func TestFileLogSegmentRemoval(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	// With a tiny segment size, every record starts a new segment.
+	f := &FileLog{SegmentSize: 1}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+	defer f.Stop()
+
+	for i := uint32(0); i < 4; i++ {
+		hash := bytes.Repeat([]byte{byte(i)}, sharedHashSize)
+		if err := f.Put(hash, cltv+i); err != nil {
+			t.Fatalf("Unable to store in FileLog: %v", err)
+		}
+	}
+
+	countSegments := func() int {
+		names, err := filepath.Glob(filepath.Join("tempdir",
+			"segment-*.log"))
+		if err != nil {
+			t.Fatalf("Unable to list segments: %v", err)
+		}
+		return len(names)
+	}
+	if n := countSegments(); n != 4 {
+		t.Fatalf("Expected 4 segments, found %v", n)
+	}
+
+	if err := f.Prune(cltv + 2); err != nil {
+		t.Fatalf("Unable to prune FileLog: %v", err)
+	}
+	if n := countSegments(); n != 2 {
+		t.Fatalf("Expected 2 segments, found %v", n)
+	}
+
+	// The current segment is kept even once it has expired.
+	if err := f.Prune(cltv + 10); err != nil {
+		t.Fatalf("Unable to prune FileLog: %v", err)
+	}
+	if n := countSegments(); n != 1 {
+		t.Fatalf("Expected 1 segment, found %v", n)
+	}
+}
+
+// TestFileLogCorruptLastSegment checks that corruption within the last
+// segment which is followed by further records is reported rather than
+// treated as a torn write.
+func TestFileLogCorruptLastSegment(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		hash := bytes.Repeat([]byte{byte(i)}, sharedHashSize)
+		if err := f.Put(hash, cltv); err != nil {
+			t.Fatalf("Unable to store in FileLog: %v", err)
+		}
+	}
+	f.Stop()
+
+	// Flip a bit of the first record.
+	segmentPath := f.segmentPath(0)
+	records, err := ioutil.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatalf("Unable to read segment: %v", err)
+	}
+	records[3] ^= 0x01
+	if err := ioutil.WriteFile(segmentPath, records, 0600); err != nil {
+		t.Fatalf("Unable to write segment: %v", err)
+	}
+
+	f = &FileLog{}
+	if err := f.Start("tempdir"); err == nil {
+		f.Stop()
+		t.Fatalf("Corrupt segment was accepted")
+	}
+
+	// The records following the corruption must not have been discarded.
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatalf("Unable to stat segment: %v", err)
+	}
+	if info.Size() != int64(len(records)) {
+		t.Fatalf("Corrupt segment was truncated")
+	}
+}
+
+// TestFileLogStartStop checks that starting or stopping a FileLog more than
+// once has no effect.
+func TestFileLogStartStop(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FileLog{}
+	f.Stop()
+
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog again: %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in FileLog: %v", err)
+	}
+
+	f.Stop()
+	f.Stop()
+
+	// The FileLog can be started again after being stopped.
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart FileLog: %v", err)
+	}
+	defer f.Stop()
+
+	if val, _ := f.Get(hash); val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+}
+
+// TestFileLogNotStarted checks that operations on a FileLog which hasn't been
+// started fail with ErrLogStopped, without touching the working directory.
+func TestFileLogNotStarted(t *testing.T) {
+	f := &FileLog{}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(hash, cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Put, got %v", err)
+	}
+	if _, err := f.Get(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Get, got %v", err)
+	}
+	if err := f.Prune(cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Prune, got %v", err)
+	}
+
+	if _, err := os.Stat(metaFileName); !os.IsNotExist(err) {
+		os.Remove(metaFileName)
+		t.Fatalf("Prune wrote metadata into the working directory")
+	}
+}
+
+// failingSegment is a segmentFile which writes only part of a record and
+// fails the write once fail is set.
+type failingSegment struct {
+	*os.File
+	fail bool
+}
+
+func (s *failingSegment) Write(b []byte) (int, error) {
+	if !s.fail {
+		return s.File.Write(b)
+	}
+
+	n, _ := s.File.Write(b[:len(b)/2])
+	return n, fmt.Errorf("short write")
+}
+
+// TestFileLogFailedWrite checks that a record which couldn't be fully
+// written is removed from the segment, so neither the records appended after
+// it nor the next Start are affected.
+func TestFileLogFailedWrite(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FileLog: %v", err)
+	}
+
+	segment := &failingSegment{File: f.current.(*os.File), fail: true}
+	f.current = segment
+
+	failedHash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(failedHash, cltv); err == nil {
+		t.Fatalf("Failed write wasn't reported")
+	}
+
+	segment.fail = false
+	hash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	if err := f.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in FileLog: %v", err)
+	}
+	f.Stop()
+
+	f = &FileLog{}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart FileLog: %v", err)
+	}
+	defer f.Stop()
+
+	if val, _ := f.Get(hash); val != cltv {
+		t.Fatalf("Record following the failed write was lost")
+	}
+	if val, _ := f.Get(failedHash); val != math.MaxUint32 {
+		t.Fatalf("Failed record was applied")
+	}
+}
@@ -0,0 +1,367 @@
+package persistlog
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+const (
+	// defaultGenerationRange is the default number of consecutive CLTV
+	// heights covered by a single filter generation.
+	defaultGenerationRange = 144
+
+	// defaultExpectedEntries is the default number of entries a single
+	// filter generation is sized for.
+	defaultExpectedEntries = 10000
+
+	// defaultFalsePositiveRate is the default false positive rate of a
+	// filter generation holding the expected number of entries.
+	defaultFalsePositiveRate = 0.001
+)
+
+// bloomFilter is a plain bloom filter using double hashing to derive its
+// bit positions.
+type bloomFilter struct {
+	bits      []uint64
+	numBits   uint64
+	numHashes uint64
+}
+
+// newBloomFilter creates a bloom filter sized for the passed number of
+// entries and false positive rate.
+func newBloomFilter(numEntries uint64, fpRate float64) *bloomFilter {
+	numBits := uint64(math.Ceil(-float64(numEntries) * math.Log(fpRate) /
+		(math.Ln2 * math.Ln2)))
+	if numBits < 64 {
+		numBits = 64
+	}
+
+	numHashes := uint64(math.Floor(float64(numBits)/
+		float64(numEntries)*math.Ln2 + 0.5))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+
+	return &bloomFilter{
+		bits:      make([]uint64, (numBits+63)/64),
+		numBits:   numBits,
+		numHashes: numHashes,
+	}
+}
+
+// positions returns the two base hashes of the passed key, from which the
+// bit positions are derived.
+func (f *bloomFilter) positions(key []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write(key)
+
+	h2 := fnv.New64()
+	h2.Write(key)
+
+	// The second hash must be odd, so the derived positions don't cycle
+	// early.
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+// add adds the passed key to the filter.
+func (f *bloomFilter) add(key []byte) {
+	h1, h2 := f.positions(key)
+	for i := uint64(0); i < f.numHashes; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// contains returns false if the key has definitely not been added to the
+// filter, and true if it may have been.
+func (f *bloomFilter) contains(key []byte) bool {
+	h1, h2 := f.positions(key)
+	for i := uint64(0); i < f.numHashes; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilteredLog implements the PersistLog interface by wrapping another
+// PersistLog with in-memory bloom filters, which answer lookups of hashes
+// that have definitely not been stored without touching the wrapped log.
+// Lookups which may hit are passed through, so the answers of the
+// FilteredLog are always exact.
+//
+// Entries are added to a filter generation per GenerationRange consecutive
+// CLTV heights. Once the wrapped log has garbage collected every CLTV of a
+// generation, taking into account how long it retains entries past their
+// expiry, the generation is dropped by the next Put or Prune. Lookups only
+// take a read lock, and never drop generations. The filters are rebuilt from
+// the wrapped log on Start. Logs which don't report their retention, and
+// hence can't be told apart from logs which never garbage collect, keep every
+// generation. As generations are keyed by block height, a DecayedLog in
+// TimeExpiry mode can't be wrapped.
+type FilteredLog struct {
+	// Log is the wrapped PersistLog, which is started and stopped along
+	// with the FilteredLog.
+	Log PersistLog
+
+	// GenerationRange is the number of consecutive CLTV heights covered
+	// by a single filter generation. If zero, 144 is used.
+	GenerationRange uint32
+
+	// ExpectedEntries is the number of entries a single generation is
+	// sized for. If zero, 10000 is used.
+	ExpectedEntries uint64
+
+	// FalsePositiveRate is the false positive rate of a generation
+	// holding ExpectedEntries entries. If zero, 0.001 is used.
+	FalsePositiveRate float64
+
+	// mtx guards generations, and expiredHeight, the best height of the
+	// wrapped log the generations were last expired at.
+	mtx           sync.RWMutex
+	generations   map[uint32]*bloomFilter
+	expiredHeight uint32
+}
+
+// A compile time check to see if FilteredLog adheres to the PersistLog
+// interface.
+var _ PersistLog = (*FilteredLog)(nil)
+
+// retentionLog is implemented by the PersistLogs of this package, which can
+// report the lowest CLTV they may still hold an entry for.
+type retentionLog interface {
+	retainedHeight() uint32
+}
+
+// retainedHeight returns the lowest CLTV the passed log may still hold an
+// entry for, or zero if the log doesn't report its retention.
+func retainedHeight(log PersistLog) uint32 {
+	if r, ok := log.(retentionLog); ok {
+		return r.retainedHeight()
+	}
+
+	return 0
+}
+
+// retainedHeight returns the lowest CLTV the wrapped log may still hold an
+// entry for, implementing the retentionLog interface.
+func (f *FilteredLog) retainedHeight() uint32 {
+	return retainedHeight(f.Log)
+}
+
+// usesTimeExpiry returns whether the passed log stores deadlines rather than
+// CLTVs.
+func usesTimeExpiry(log PersistLog) bool {
+	switch l := log.(type) {
+	case *DecayedLog:
+		return l.ExpiryMode == TimeExpiry
+
+	case *FilteredLog:
+		return usesTimeExpiry(l.Log)
+	}
+
+	return false
+}
+
+// generationRange returns the configured or default generation range.
+func (f *FilteredLog) generationRange() uint32 {
+	if f.GenerationRange == 0 {
+		return defaultGenerationRange
+	}
+
+	return f.GenerationRange
+}
+
+// add adds the passed hash to the filter generation of its CLTV, creating
+// the generation if needed. The caller MUST hold the write lock.
+func (f *FilteredLog) add(hash []byte, cltv uint32) {
+	start := cltv - cltv%f.generationRange()
+
+	filter, ok := f.generations[start]
+	if !ok {
+		expectedEntries := f.ExpectedEntries
+		if expectedEntries == 0 {
+			expectedEntries = defaultExpectedEntries
+		}
+
+		fpRate := f.FalsePositiveRate
+		if fpRate == 0 {
+			fpRate = defaultFalsePositiveRate
+		}
+
+		filter = newBloomFilter(expectedEntries, fpRate)
+		f.generations[start] = filter
+	}
+
+	filter.add(hash)
+}
+
+// expire drops every filter generation whose CLTVs have all been garbage
+// collected by the wrapped log. The write lock is only taken once the
+// retained height of the wrapped log has advanced.
+func (f *FilteredLog) expire() {
+	height := retainedHeight(f.Log)
+
+	f.mtx.RLock()
+	expired := height <= f.expiredHeight
+	f.mtx.RUnlock()
+	if expired {
+		return
+	}
+
+	generationRange := uint64(f.generationRange())
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for start := range f.generations {
+		if uint64(start)+generationRange <= uint64(height) {
+			delete(f.generations, start)
+		}
+	}
+	if height > f.expiredHeight {
+		f.expiredHeight = height
+	}
+}
+
+// mayContain returns false if the passed hash has definitely not been stored.
+// ErrLogStopped is returned if the FilteredLog isn't started.
+func (f *FilteredLog) mayContain(hash []byte) (bool, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+
+	if f.generations == nil {
+		return false, ErrLogStopped
+	}
+
+	for _, filter := range f.generations {
+		if filter.contains(hash) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Delete removes the entry of the passed hash from the wrapped log. The hash
+// remains within the filters until its generation expires, which merely
+// causes lookups of it to be passed through.
+func (f *FilteredLog) Delete(hash []byte) error {
+	return f.Log.Delete(hash)
+}
+
+// Get retrieves the CLTV stored for the passed hash. If the filters show that
+// the hash has definitely not been stored, math.MaxUint32 is returned without
+// consulting the wrapped log.
+func (f *FilteredLog) Get(hash []byte) (uint32, error) {
+	mayContain, err := f.mayContain(hash)
+	if err != nil {
+		return 0, err
+	}
+	if !mayContain {
+		return math.MaxUint32, nil
+	}
+
+	return f.Log.Get(hash)
+}
+
+// Put stores the passed hash and CLTV within the wrapped log, after dropping
+// the filter generations which have expired. The hash is added to the filters
+// first, so concurrent lookups never miss a stored entry.
+func (f *FilteredLog) Put(hash []byte, cltv uint32) error {
+	f.expire()
+
+	f.mtx.Lock()
+	if f.generations == nil {
+		f.mtx.Unlock()
+		return ErrLogStopped
+	}
+	f.add(hash, cltv)
+	f.mtx.Unlock()
+
+	return f.Log.Put(hash, cltv)
+}
+
+// HashSharedSecret returns the key under which the passed shared secret is
+// stored in the wrapped log.
+func (f *FilteredLog) HashSharedSecret(sharedSecret [sharedSecretSize]byte) []byte {
+	return f.Log.HashSharedSecret(sharedSecret)
+}
+
+// Prune prunes the wrapped log, and drops the filter generations which have
+// expired.
+func (f *FilteredLog) Prune(height uint32) error {
+	if err := f.Log.Prune(height); err != nil {
+		return err
+	}
+
+	f.expire()
+
+	return nil
+}
+
+// BestHeight returns the best height of the wrapped log.
+func (f *FilteredLog) BestHeight() uint32 {
+	return f.Log.BestHeight()
+}
+
+// ForEach iterates over the entries of the wrapped log.
+func (f *FilteredLog) ForEach(cb func(hash []byte, cltv uint32) error) error {
+	return f.Log.ForEach(cb)
+}
+
+// Stats returns the statistics of the wrapped log.
+func (f *FilteredLog) Stats() (*Stats, error) {
+	return f.Log.Stats()
+}
+
+// Start starts the wrapped log, and rebuilds the filters from its entries.
+// ErrFilteredTimeExpiry is returned if the wrapped log is a DecayedLog in
+// TimeExpiry mode. Calling Start on a started FilteredLog has no effect.
+func (f *FilteredLog) Start(dbDir string) error {
+	if usesTimeExpiry(f.Log) {
+		return ErrFilteredTimeExpiry
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.generations != nil {
+		return nil
+	}
+
+	if err := f.Log.Start(dbDir); err != nil {
+		return err
+	}
+
+	f.generations = make(map[uint32]*bloomFilter)
+	f.expiredHeight = 0
+	err := f.Log.ForEach(func(hash []byte, cltv uint32) error {
+		f.add(hash, cltv)
+		return nil
+	})
+	if err != nil {
+		f.generations = nil
+		f.Log.Stop()
+		return err
+	}
+
+	return nil
+}
+
+// Stop stops the wrapped log and drops the filters. Calling Stop on a
+// FilteredLog which isn't started has no effect.
+func (f *FilteredLog) Stop() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.generations == nil {
+		return
+	}
+
+	f.generations = nil
+	f.Log.Stop()
+}
@@ -0,0 +1,215 @@
+package persistlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"testing"
+)
+
+// countingLog wraps a PersistLog, counting the lookups which reach it.
+type countingLog struct {
+	PersistLog
+	numGets int
+}
+
+func (c *countingLog) Get(hash []byte) (uint32, error) {
+	c.numGets++
+	return c.PersistLog.Get(hash)
+}
+
+// TestFilteredLogMisses checks that lookups of hashes which have never been
+// stored are answered without consulting the wrapped log, while stored
+// hashes are still found, also after a restart.
+func TestFilteredLogMisses(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	inner := &countingLog{PersistLog: &DecayedLog{}}
+	f := &FilteredLog{Log: inner}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FilteredLog: %v", err)
+	}
+
+	hashes := make([][]byte, 100)
+	for i := range hashes {
+		hashes[i] = make([]byte, sharedHashSize)
+		binary.BigEndian.PutUint32(hashes[i], uint32(i))
+		if err := f.Put(hashes[i], cltv); err != nil {
+			t.Fatalf("Unable to store in FilteredLog: %v", err)
+		}
+	}
+	f.Stop()
+
+	inner = &countingLog{PersistLog: &DecayedLog{}}
+	f = &FilteredLog{Log: inner}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart FilteredLog: %v", err)
+	}
+	defer f.Stop()
+
+	for i, hash := range hashes {
+		if val, _ := f.Get(hash); val != cltv {
+			t.Fatalf("Entry %v not found after restart", i)
+		}
+	}
+	if inner.numGets != len(hashes) {
+		t.Fatalf("Expected %v lookups, got %v", len(hashes),
+			inner.numGets)
+	}
+
+	// With the default false positive rate, hardly any of the unknown
+	// hashes should reach the wrapped log.
+	inner.numGets = 0
+	for i := 0; i < 1000; i++ {
+		hash := bytes.Repeat([]byte{0xff}, sharedHashSize)
+		binary.BigEndian.PutUint32(hash, uint32(i))
+		if val, _ := f.Get(hash); val != math.MaxUint32 {
+			t.Fatalf("Unknown hash was found")
+		}
+	}
+	if inner.numGets > 10 {
+		t.Fatalf("%v of 1000 misses reached the wrapped log",
+			inner.numGets)
+	}
+}
+
+// TestFilteredLogExpiry checks that filter generations are dropped once the
+// wrapped log has been garbage collected past them.
+func TestFilteredLogExpiry(t *testing.T) {
+	f := &FilteredLog{Log: &DecayedLog{}, GenerationRange: 10}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FilteredLog: %v", err)
+	}
+	defer shutdown(f)
+
+	base := cltv - cltv%10
+	for i := uint32(0); i < 20; i++ {
+		hash := bytes.Repeat([]byte{byte(i)}, sharedHashSize)
+		if err := f.Put(hash, base+i); err != nil {
+			t.Fatalf("Unable to store in FilteredLog: %v", err)
+		}
+	}
+	if len(f.generations) != 2 {
+		t.Fatalf("Expected 2 generations, got %v", len(f.generations))
+	}
+
+	// The first generation is kept until all of its CLTVs expired.
+	if err := f.Prune(base + 9); err != nil {
+		t.Fatalf("Unable to prune FilteredLog: %v", err)
+	}
+	if len(f.generations) != 2 {
+		t.Fatalf("Generation was dropped early")
+	}
+
+	if err := f.Prune(base + 10); err != nil {
+		t.Fatalf("Unable to prune FilteredLog: %v", err)
+	}
+	if len(f.generations) != 1 {
+		t.Fatalf("Expected 1 generation, got %v", len(f.generations))
+	}
+
+	// The remaining entries are still found.
+	hash := bytes.Repeat([]byte{15}, sharedHashSize)
+	if val, _ := f.Get(hash); val != base+15 {
+		t.Fatalf("Expected cltv %v, got %v", base+15, val)
+	}
+}
+
+// TestFilteredLogExpiryOnPut checks that lookups leave the filter generations
+// alone, while the next Put drops those the wrapped log has been garbage
+// collected past.
+func TestFilteredLogExpiryOnPut(t *testing.T) {
+	inner := &DecayedLog{}
+	f := &FilteredLog{Log: inner, GenerationRange: 10}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FilteredLog: %v", err)
+	}
+	defer shutdown(f)
+
+	base := cltv - cltv%10
+	expiredHash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(expiredHash, base); err != nil {
+		t.Fatalf("Unable to store in FilteredLog: %v", err)
+	}
+
+	// Garbage collection of the wrapped log doesn't touch the filters,
+	// and neither do lookups, which still answer exactly.
+	if err := inner.Prune(base + 10); err != nil {
+		t.Fatalf("Unable to prune wrapped log: %v", err)
+	}
+	if val, _ := f.Get(expiredHash); val != math.MaxUint32 {
+		t.Fatalf("Expired entry was found")
+	}
+	if len(f.generations) != 1 {
+		t.Fatalf("Lookup changed the generations")
+	}
+
+	liveHash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	if err := f.Put(liveHash, base+10); err != nil {
+		t.Fatalf("Unable to store in FilteredLog: %v", err)
+	}
+	if _, ok := f.generations[base]; ok || len(f.generations) != 1 {
+		t.Fatalf("Expired generation wasn't dropped on Put")
+	}
+}
+
+// TestFilteredLogRetention checks that a generation is kept as long as the
+// wrapped log retains its entries past their expiry, so that lookups remain
+// exact.
+func TestFilteredLogRetention(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FilteredLog{
+		Log:             &BucketedLog{BucketRange: 10},
+		GenerationRange: 5,
+	}
+	if err := f.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start FilteredLog: %v", err)
+	}
+	defer f.Stop()
+
+	base := cltv - cltv%10
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := f.Put(hash, base+1); err != nil {
+		t.Fatalf("Unable to store in FilteredLog: %v", err)
+	}
+
+	// The bucket of the entry outlives its generation, so the entry must
+	// still be found.
+	if err := f.Prune(base + 5); err != nil {
+		t.Fatalf("Unable to prune FilteredLog: %v", err)
+	}
+	if val, _ := f.Get(hash); val != base+1 {
+		t.Fatalf("Expected cltv %v, got %v", base+1, val)
+	}
+
+	// Once the bucket has been dropped, so is the generation.
+	if err := f.Prune(base + 10); err != nil {
+		t.Fatalf("Unable to prune FilteredLog: %v", err)
+	}
+	if len(f.generations) != 0 {
+		t.Fatalf("Expected no generations, got %v", len(f.generations))
+	}
+}
+
+// TestFilteredLogNotStarted checks that a FilteredLog which isn't started
+// refuses lookups and writes, and that TimeExpiry is rejected.
+func TestFilteredLogNotStarted(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	f := &FilteredLog{Log: &DecayedLog{}}
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if _, err := f.Get(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped, got %v", err)
+	}
+	if err := f.Put(hash, cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped, got %v", err)
+	}
+
+	f = &FilteredLog{Log: &DecayedLog{ExpiryMode: TimeExpiry}}
+	if err := f.Start("tempdir"); err != ErrFilteredTimeExpiry {
+		f.Stop()
+		t.Fatalf("Expected ErrFilteredTimeExpiry, got %v", err)
+	}
+}
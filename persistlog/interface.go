@@ -17,6 +17,26 @@ type PersistLog interface {
 	// occurs.
 	Put([]byte, uint32) error
 
+	// HashSharedSecret returns the key under which the passed shared
+	// secret is stored in the persistent log. It MUST only be called
+	// after the persistent log has been started.
+	HashSharedSecret([sharedSecretSize]byte) []byte
+
+	// Prune removes every entry whose CLTV is below the given height.
+	Prune(uint32) error
+
+	// BestHeight returns the highest block height the persistent log has
+	// been garbage collected at.
+	BestHeight() uint32
+
+	// ForEach calls the passed function for every entry of the persistent
+	// log, stopping at the first error, which is returned. The function
+	// MUST NOT modify the persistent log.
+	ForEach(func(hash []byte, cltv uint32) error) error
+
+	// Stats returns a snapshot of statistics about the persistent log.
+	Stats() (*Stats, error)
+
 	// Start starts up the on-disk persistent log. It returns an error if
 	// one occurs.
 	Start(string) error
@@ -24,3 +44,45 @@ type PersistLog interface {
 	// Stop safely stops the on-disk persistent log.
 	Stop()
 }
+
+// Stats is a snapshot of statistics about a persistent log, allowing the
+// growth of the log to be monitored and suspected replay attacks to be
+// debugged. Counters which aren't persisted are reset on Start.
+type Stats struct {
+	// NumEntries is the number of entries currently stored.
+	NumEntries uint64
+
+	// SizeOnDisk is the size in bytes the persistent log occupies on
+	// disk.
+	SizeOnDisk int64
+
+	// OldestCltv and NewestCltv are the lowest and highest CLTV of the
+	// stored entries. Both are zero if the log is empty. For a DecayedLog
+	// in TimeExpiry mode, they're the unix timestamps of the earliest and
+	// latest deadline.
+	OldestCltv uint32
+	NewestCltv uint32
+
+	// BestHeight is the highest block height the log has been garbage
+	// collected at.
+	BestHeight uint32
+
+	// LastPurged is the number of entries removed by the most recent
+	// garbage collection.
+	LastPurged uint64
+
+	// TotalPurged is the number of entries removed by garbage collection
+	// since Start.
+	TotalPurged uint64
+
+	// Hits is the number of lookups since Start which found a stored
+	// entry. As every lookup is counted, regardless of whether the caller
+	// rejects a packet, this is an upper bound on the replays detected.
+	// The Router reports the replays it rejected through
+	// ReplaysRejected.
+	Hits uint64
+
+	// Collisions is the number of times an entry was stored for a hash
+	// which was already stored.
+	Collisions uint64
+}
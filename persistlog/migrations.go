@@ -0,0 +1,188 @@
+package persistlog
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// migration is a function which upgrades the database of a DecayedLog from
+// the previous schema version. It's applied within the same transaction as
+// every other pending migration, so a failed migration leaves the database
+// untouched.
+type migration func(d *DecayedLog, tx *bolt.Tx) error
+
+// version pairs a schema version with the migration which upgrades the
+// database from the previous version.
+type version struct {
+	number    uint32
+	migration migration
+}
+
+var (
+	// dbVersions lists every schema version of the DecayedLog in
+	// ascending order. New versions MUST be appended to the end of the
+	// list, along with the migration from the previous version.
+	//
+	// Version zero is the original schema, consisting merely of
+	// sharedHashBucket.
+	dbVersions = []version{
+		{
+			// Version 1 indexes the entries by their CLTV.
+			number:    1,
+			migration: migrateCltvIndex,
+		},
+		{
+			// Version 2 keys the hashes of shared secrets with a
+			// per-database salt.
+			number:    2,
+			migration: migrateKeyedHashes,
+		},
+	}
+)
+
+// latestVersion returns the schema version written by this version of the
+// DecayedLog.
+func latestVersion() uint32 {
+	return dbVersions[len(dbVersions)-1].number
+}
+
+// dbVersion returns the schema version of the database, or zero if the
+// database doesn't have a version.
+func dbVersion(tx *bolt.Tx) uint32 {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0
+	}
+
+	versionBytes := meta.Get(versionKey)
+	if versionBytes == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(versionBytes)
+}
+
+// migrate applies every migration required to bring the database up to the
+// latest schema version, and records the new version. An error is returned
+// if the database was written by a newer version of the DecayedLog.
+func (d *DecayedLog) migrate(tx *bolt.Tx) error {
+	if d.HashSize != 0 &&
+		(d.HashSize < minHashSize || d.HashSize > maxHashSize) {
+
+		return ErrInvalidHashSize
+	}
+
+	_, err := tx.CreateBucketIfNotExists(sharedHashBucket)
+	if err != nil {
+		return fmt.Errorf("Unable to create bucket sharedHashes:"+
+			" %v", err)
+	}
+
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return fmt.Errorf("Unable to create bucket meta:"+
+			" %v", err)
+	}
+
+	currentVersion := dbVersion(tx)
+	if currentVersion > latestVersion() {
+		return ErrNewerDBVersion
+	}
+
+	for _, v := range dbVersions {
+		if v.number <= currentVersion {
+			continue
+		}
+
+		if err := v.migration(d, tx); err != nil {
+			return fmt.Errorf("Unable to migrate DecayedLog to "+
+				"version %v: %v", v.number, err)
+		}
+	}
+
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], latestVersion())
+
+	return meta.Put(versionKey, scratch[:])
+}
+
+// migrateCltvIndex builds the CLTV index from the existing entries. Any
+// existing index is rebuilt from scratch.
+func migrateCltvIndex(d *DecayedLog, tx *bolt.Tx) error {
+	if tx.Bucket(cltvIndexBucket) != nil {
+		if err := tx.DeleteBucket(cltvIndexBucket); err != nil {
+			return err
+		}
+	}
+
+	cltvIndex, err := tx.CreateBucket(cltvIndexBucket)
+	if err != nil {
+		return fmt.Errorf("Unable to create bucket cltvIndex:"+
+			" %v", err)
+	}
+
+	sharedHashes := tx.Bucket(sharedHashBucket)
+	return sharedHashes.ForEach(func(k, v []byte) error {
+		cltv := binary.BigEndian.Uint32(v)
+		return cltvIndex.Put(cltvIndexKey(cltv, k), nil)
+	})
+}
+
+// migrateKeyedHashes generates the salt of the database, and rehashes the
+// unkeyed entries with it, along with their entries in the CLTV index. The
+// hash size is taken from the configuration of the DecayedLog. If the
+// database already has a salt, nothing is done.
+func migrateKeyedHashes(d *DecayedLog, tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if meta.Get(saltKey) != nil {
+		return nil
+	}
+
+	salt, hashSize, err := writeKeyedHashParams(meta, d.HashSize)
+	if err != nil {
+		return err
+	}
+
+	// The buckets must not be modified while iterating over them, so
+	// we'll collect the entries first.
+	sharedHashes := tx.Bucket(sharedHashBucket)
+	cltvIndex := tx.Bucket(cltvIndexBucket)
+
+	var legacyHashes, values [][]byte
+	err = sharedHashes.ForEach(func(k, v []byte) error {
+		if len(k) != sharedHashSize {
+			return fmt.Errorf("invalid legacy hash %x", k)
+		}
+
+		legacyHashes = append(legacyHashes, append([]byte(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, legacyHash := range legacyHashes {
+		cltv := binary.BigEndian.Uint32(values[i])
+		hash := keyedHash(salt, legacyHash, hashSize)
+
+		if err := sharedHashes.Delete(legacyHash); err != nil {
+			return err
+		}
+		err := cltvIndex.Delete(cltvIndexKey(cltv, legacyHash))
+		if err != nil {
+			return err
+		}
+
+		if err := sharedHashes.Put(hash, values[i]); err != nil {
+			return err
+		}
+		if err := cltvIndex.Put(cltvIndexKey(cltv, hash), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package persistlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/lightningnetwork/lnd/channeldb"
+)
+
+// TestMigrationFromVersionZero checks that a database consisting merely of
+// the original sharedHashBucket is upgraded to the latest version on Start.
+func TestMigrationFromVersionZero(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	legacyHash := HashSharedSecret(secret)
+
+	// Create a database in the original format.
+	db, err := channeldb.Open("tempdir")
+	if err != nil {
+		t.Fatalf("Unable to open channeldb: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		sharedHashes, err := tx.CreateBucket(sharedHashBucket)
+		if err != nil {
+			return err
+		}
+
+		var scratch [4]byte
+		binary.BigEndian.PutUint32(scratch[:], cltv)
+		return sharedHashes.Put(legacyHash[:], scratch[:])
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("Unable to create legacy database: %v", err)
+	}
+
+	d := &DecayedLog{}
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer d.Stop()
+
+	err = d.db.View(func(tx *bolt.Tx) error {
+		if version := dbVersion(tx); version != latestVersion() {
+			return fmt.Errorf("expected version %v, got %v",
+				latestVersion(), version)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The entry must have been rehashed, and be pruned using the index.
+	val, err := d.Get(d.HashSharedSecret(secret))
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != cltv {
+		t.Fatalf("Entry wasn't migrated")
+	}
+
+	if err := d.Prune(cltv + 1); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	val, err = d.Get(d.HashSharedSecret(secret))
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != math.MaxUint32 {
+		t.Fatalf("Migrated entry wasn't pruned")
+	}
+}
+
+// TestMigrationNewerVersion checks that databases written by a newer version
+// of the DecayedLog are refused and left untouched.
+func TestMigrationNewerVersion(t *testing.T) {
+	defer os.RemoveAll("tempdir")
+
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+
+	newerVersion := latestVersion() + 1
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		var scratch [4]byte
+		binary.BigEndian.PutUint32(scratch[:], newerVersion)
+		return tx.Bucket(metaBucket).Put(versionKey, scratch[:])
+	})
+	if err != nil {
+		t.Fatalf("Unable to set version: %v", err)
+	}
+	d.Stop()
+
+	if err := d.Start("tempdir"); err != ErrNewerDBVersion {
+		t.Fatalf("Expected ErrNewerDBVersion, got %v", err)
+	}
+
+	db, err := channeldb.Open("tempdir")
+	if err != nil {
+		t.Fatalf("Unable to open channeldb: %v", err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if version := dbVersion(tx); version != newerVersion {
+			return fmt.Errorf("expected version %v, got %v",
+				newerVersion, version)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,463 @@
+package persistlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// namespacesBucket is a bucket which houses a nested bucket per
+	// namespace of the DecayedLog. Each namespace bucket in turn houses
+	// its own sharedHashBucket, cltvIndexBucket and metaBucket.
+	namespacesBucket = []byte("namespaces")
+
+	// gcPolicyKey is the key within the metaBucket of a namespace under
+	// which its serialized NamespaceConfig is stored.
+	gcPolicyKey = []byte("gc-policy")
+)
+
+// NamespaceConfig is the garbage collection policy of a namespace.
+type NamespaceConfig struct {
+	// RetainBlocks is the number of blocks entries of the namespace are
+	// kept after their CLTV has expired.
+	RetainBlocks uint32
+
+	// DisableGC prevents entries of the namespace from ever being
+	// garbage collected. They must be removed using Delete.
+	DisableGC bool
+}
+
+// encode serializes the NamespaceConfig.
+func (c NamespaceConfig) encode() []byte {
+	var b [5]byte
+	binary.BigEndian.PutUint32(b[:4], c.RetainBlocks)
+	if c.DisableGC {
+		b[4] = 1
+	}
+
+	return b[:]
+}
+
+// decodeNamespaceConfig deserializes a NamespaceConfig.
+func decodeNamespaceConfig(b []byte) (NamespaceConfig, error) {
+	if len(b) != 5 {
+		return NamespaceConfig{}, fmt.Errorf("invalid gc policy")
+	}
+
+	return NamespaceConfig{
+		RetainBlocks: binary.BigEndian.Uint32(b[:4]),
+		DisableGC:    b[4] == 1,
+	}, nil
+}
+
+// expiryHeight returns the height below which entries of the namespace are
+// garbage collected, given the current height. False is returned if no entry
+// may be collected.
+func (c NamespaceConfig) expiryHeight(height uint32) (uint32, bool) {
+	if c.DisableGC || height <= c.RetainBlocks {
+		return 0, false
+	}
+
+	return height - c.RetainBlocks, true
+}
+
+// namespaceBuckets returns the buckets of the passed namespace, or nil
+// buckets if the namespace doesn't exist.
+func namespaceBuckets(tx *bolt.Tx, name []byte) (*bolt.Bucket, *bolt.Bucket,
+	*bolt.Bucket) {
+
+	namespaces := tx.Bucket(namespacesBucket)
+	if namespaces == nil {
+		return nil, nil, nil
+	}
+
+	namespace := namespaces.Bucket(name)
+	if namespace == nil {
+		return nil, nil, nil
+	}
+
+	return namespace.Bucket(sharedHashBucket),
+		namespace.Bucket(cltvIndexBucket), namespace.Bucket(metaBucket)
+}
+
+// namespacesEmpty returns whether none of the namespaces of the DecayedLog
+// holds any entries.
+func namespacesEmpty(tx *bolt.Tx) (bool, error) {
+	namespaces := tx.Bucket(namespacesBucket)
+	if namespaces == nil {
+		return true, nil
+	}
+
+	empty := true
+	err := namespaces.ForEach(func(name, _ []byte) error {
+		sharedHashes, _, _ := namespaceBuckets(tx, name)
+		if sharedHashes == nil {
+			return fmt.Errorf("namespace %s is incomplete", name)
+		}
+
+		if k, _ := sharedHashes.Cursor().First(); k != nil {
+			empty = false
+		}
+
+		return nil
+	})
+
+	return empty, err
+}
+
+// pruneNamespaces garbage collects every namespace according to its policy,
+// returning the number of entries purged from each namespace by name. As the
+// transaction may be retried, the numbers are only recorded by
+// recordNamespacePurges once it has been committed.
+func (d *DecayedLog) pruneNamespaces(tx *bolt.Tx,
+	height uint32) (map[string]uint64, error) {
+
+	purged := make(map[string]uint64)
+
+	namespaces := tx.Bucket(namespacesBucket)
+	if namespaces == nil {
+		return purged, nil
+	}
+
+	err := namespaces.ForEach(func(name, _ []byte) error {
+		sharedHashes, cltvIndex, meta := namespaceBuckets(tx, name)
+		if sharedHashes == nil || cltvIndex == nil || meta == nil {
+			return fmt.Errorf("namespace %s is incomplete", name)
+		}
+
+		cfg, err := decodeNamespaceConfig(meta.Get(gcPolicyKey))
+		if err != nil {
+			return err
+		}
+
+		expiryHeight, ok := cfg.expiryHeight(height)
+		if !ok {
+			return nil
+		}
+
+		numPurged, err := pruneEntries(sharedHashes, cltvIndex,
+			expiryHeight)
+		if err != nil {
+			return err
+		}
+		purged[string(name)] = numPurged
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// recordNamespacePurges records the numbers of entries purged from the
+// namespaces by a committed garbage collection with the namespace views
+// handed out by Namespace.
+func (d *DecayedLog) recordNamespacePurges(purged map[string]uint64) {
+	d.nsMtx.Lock()
+	defer d.nsMtx.Unlock()
+
+	for name, numPurged := range purged {
+		if ns, ok := d.namespaces[name]; ok {
+			ns.recordPurge(numPurged)
+		}
+	}
+}
+
+// Namespace returns a PersistLog view of the named namespace of the
+// DecayedLog, creating the namespace if it doesn't exist yet. Namespaces
+// share the database, salt and best height of the DecayedLog, but hold
+// distinct entries, so a hash stored in one namespace isn't seen by any
+// other. This allows several Routers to share a single database, by handing
+// each of them its own view. The passed config replaces the stored garbage
+// collection policy of the namespace, which is applied whenever the
+// DecayedLog is pruned.
+//
+// The DecayedLog MUST be started before calling Namespace. Starting and
+// stopping the returned view has no effect, the lifecycle of the database is
+// controlled by the DecayedLog, and the view returns ErrLogStopped once the
+// DecayedLog is stopped. As the garbage collection policies of namespaces are
+// expressed in blocks, namespaces are only available in BlockExpiry mode.
+func (d *DecayedLog) Namespace(name string, cfg NamespaceConfig) (PersistLog,
+	error) {
+
+	if name == "" {
+		return nil, ErrInvalidNamespace
+	}
+	if d.ExpiryMode != BlockExpiry {
+		return nil, ErrNamespaceExpiryMode
+	}
+
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.release()
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		namespaces, err := tx.CreateBucketIfNotExists(namespacesBucket)
+		if err != nil {
+			return fmt.Errorf("Unable to create bucket namespaces:"+
+				" %v", err)
+		}
+
+		namespace, err := namespaces.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("Unable to create namespace %v: %v",
+				name, err)
+		}
+
+		for _, bucket := range [][]byte{sharedHashBucket,
+			cltvIndexBucket} {
+
+			_, err := namespace.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		meta, err := namespace.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(gcPolicyKey, cfg.encode())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.nsMtx.Lock()
+	defer d.nsMtx.Unlock()
+
+	if d.namespaces == nil {
+		d.namespaces = make(map[string]*namespaceLog)
+	}
+
+	ns, ok := d.namespaces[name]
+	if !ok {
+		ns = &namespaceLog{d: d, name: []byte(name)}
+		d.namespaces[name] = ns
+	}
+	ns.setConfig(cfg)
+
+	return ns, nil
+}
+
+// namespaceLog is a PersistLog view of a single namespace of a DecayedLog.
+type namespaceLog struct {
+	// hits, lastPurged and totalPurged are the counters reported by
+	// Stats. They MUST be used atomically.
+	hits        uint64
+	lastPurged  uint64
+	totalPurged uint64
+
+	d    *DecayedLog
+	name []byte
+
+	mtx sync.Mutex
+	cfg NamespaceConfig
+}
+
+// A compile time check to see if namespaceLog adheres to the PersistLog
+// interface.
+var _ PersistLog = (*namespaceLog)(nil)
+
+// setConfig replaces the garbage collection policy of the namespace.
+func (n *namespaceLog) setConfig(cfg NamespaceConfig) {
+	n.mtx.Lock()
+	n.cfg = cfg
+	n.mtx.Unlock()
+}
+
+// config returns the garbage collection policy of the namespace.
+func (n *namespaceLog) config() NamespaceConfig {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.cfg
+}
+
+// recordPurge records the number of entries purged by a garbage collection.
+func (n *namespaceLog) recordPurge(numPurged uint64) {
+	atomic.StoreUint64(&n.lastPurged, numPurged)
+	atomic.AddUint64(&n.totalPurged, numPurged)
+}
+
+// buckets returns the buckets of the namespace, or an error if they're
+// missing.
+func (n *namespaceLog) buckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket,
+	*bolt.Bucket, error) {
+
+	sharedHashes, cltvIndex, meta := namespaceBuckets(tx, n.name)
+	if sharedHashes == nil || cltvIndex == nil || meta == nil {
+		return nil, nil, nil, fmt.Errorf("namespace %s is incomplete",
+			n.name)
+	}
+
+	return sharedHashes, cltvIndex, meta, nil
+}
+
+// Delete removes the entry of the passed hash from the namespace.
+func (n *namespaceLog) Delete(hash []byte) error {
+	if err := n.d.acquire(); err != nil {
+		return err
+	}
+	defer n.d.release()
+
+	return n.d.db.Batch(func(tx *bolt.Tx) error {
+		sharedHashes, cltvIndex, _, err := n.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		return deleteEntry(sharedHashes, cltvIndex, hash)
+	})
+}
+
+// Get retrieves the CLTV stored for the passed hash within the namespace. If
+// the hash isn't stored, math.MaxUint32 is returned.
+func (n *namespaceLog) Get(hash []byte) (uint32, error) {
+	var value uint32 = math.MaxUint32
+
+	if err := n.d.acquire(); err != nil {
+		return value, err
+	}
+	defer n.d.release()
+
+	err := n.d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes, _, _, err := n.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		if valueBytes := sharedHashes.Get(hash); valueBytes != nil {
+			value = binary.BigEndian.Uint32(valueBytes)
+			atomic.AddUint64(&n.hits, 1)
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+// Put stores the passed hash and CLTV within the namespace. If the entry
+// would already be garbage collected according to the policy of the
+// namespace and the best known height, ErrExpiredEntry is returned and
+// nothing is stored.
+func (n *namespaceLog) Put(hash []byte, cltv uint32) error {
+	if err := n.d.acquire(); err != nil {
+		return err
+	}
+	defer n.d.release()
+
+	expiryHeight, ok := n.config().expiryHeight(n.d.BestHeight())
+	if ok && cltv < expiryHeight {
+		return ErrExpiredEntry
+	}
+
+	return n.d.db.Batch(func(tx *bolt.Tx) error {
+		sharedHashes, cltvIndex, meta, err := n.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		return putEntry(sharedHashes, cltvIndex, meta, hash, cltv)
+	})
+}
+
+// HashSharedSecret returns the key under which the passed shared secret is
+// stored, using the salt of the DecayedLog.
+func (n *namespaceLog) HashSharedSecret(sharedSecret [sharedSecretSize]byte) []byte {
+	return n.d.HashSharedSecret(sharedSecret)
+}
+
+// Prune prunes the DecayedLog, and hence every namespace according to its
+// policy.
+func (n *namespaceLog) Prune(height uint32) error {
+	return n.d.Prune(height)
+}
+
+// BestHeight returns the best height of the DecayedLog.
+func (n *namespaceLog) BestHeight() uint32 {
+	return n.d.BestHeight()
+}
+
+// retainedHeight returns the lowest CLTV the namespace may still hold an
+// entry for according to its policy, implementing the retentionLog
+// interface.
+func (n *namespaceLog) retainedHeight() uint32 {
+	height, ok := n.config().expiryHeight(n.d.BestHeight())
+	if !ok {
+		return 0
+	}
+
+	return height
+}
+
+// ForEach calls the passed function with the hash and CLTV of every entry
+// of the namespace. The function MUST NOT modify the DecayedLog.
+func (n *namespaceLog) ForEach(f func(hash []byte, cltv uint32) error) error {
+	if err := n.d.acquire(); err != nil {
+		return err
+	}
+	defer n.d.release()
+
+	return n.d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes, _, _, err := n.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		return sharedHashes.ForEach(func(k, v []byte) error {
+			return f(k, binary.BigEndian.Uint32(v))
+		})
+	})
+}
+
+// Stats returns a snapshot of statistics about the namespace. SizeOnDisk is
+// the size of the whole database shared by all namespaces.
+func (n *namespaceLog) Stats() (*Stats, error) {
+	if err := n.d.acquire(); err != nil {
+		return nil, err
+	}
+	defer n.d.release()
+
+	stats := &Stats{
+		BestHeight:  n.d.BestHeight(),
+		LastPurged:  atomic.LoadUint64(&n.lastPurged),
+		TotalPurged: atomic.LoadUint64(&n.totalPurged),
+		Hits:        atomic.LoadUint64(&n.hits),
+	}
+
+	err := n.d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes, cltvIndex, meta, err := n.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		stats.SizeOnDisk = tx.Size()
+		entryStats(sharedHashes, cltvIndex, meta, stats)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Start does nothing, as the database is started by the DecayedLog.
+func (n *namespaceLog) Start(string) error {
+	return nil
+}
+
+// Stop does nothing, as the database is stopped by the DecayedLog.
+func (n *namespaceLog) Stop() {}
@@ -0,0 +1,194 @@
+package persistlog
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestNamespaceIsolation checks that entries of different namespaces, and of
+// the root of the DecayedLog, don't see each other.
+func TestNamespaceIsolation(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if _, err := d.Namespace("", NamespaceConfig{}); err != ErrInvalidNamespace {
+		t.Fatalf("Expected ErrInvalidNamespace, got %v", err)
+	}
+
+	htlcs, err := d.Namespace("htlc", NamespaceConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create namespace: %v", err)
+	}
+	messages, err := d.Namespace("onion-message", NamespaceConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create namespace: %v", err)
+	}
+
+	if err := htlcs.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in namespace: %v", err)
+	}
+
+	if val, _ := htlcs.Get(hashedSecret); val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+	if val, _ := messages.Get(hashedSecret); val != math.MaxUint32 {
+		t.Fatalf("Entry leaked into another namespace")
+	}
+	if val, _ := d.Get(hashedSecret); val != math.MaxUint32 {
+		t.Fatalf("Entry leaked into the root namespace")
+	}
+
+	stats, err := htlcs.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 1 || stats.OldestCltv != cltv ||
+		stats.Hits != 1 {
+
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	if err := htlcs.Delete(hashedSecret); err != nil {
+		t.Fatalf("Unable to delete from namespace: %v", err)
+	}
+	if val, _ := htlcs.Get(hashedSecret); val != math.MaxUint32 {
+		t.Fatalf("Entry was not deleted")
+	}
+}
+
+// TestNamespaceGCPolicy checks that every namespace is garbage collected
+// according to its own policy, which persists across restarts.
+func TestNamespaceGCPolicy(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	configs := map[string]NamespaceConfig{
+		"default":  {},
+		"retained": {RetainBlocks: 10},
+		"disabled": {DisableGC: true},
+	}
+
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	for name, cfg := range configs {
+		ns, err := d.Namespace(name, cfg)
+		if err != nil {
+			t.Fatalf("Unable to create namespace: %v", err)
+		}
+		if err := ns.Put(hash, cltv); err != nil {
+			t.Fatalf("Unable to store in namespace: %v", err)
+		}
+	}
+
+	// After a restart, the policies must still be applied by the garbage
+	// collector, before any view has been requested again.
+	d.Stop()
+	d.StartHeight = cltv + 1
+	if err := d.Start("tempdir"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+
+	assertNamespaceCltv := func(name string, expected uint32) {
+		ns, err := d.Namespace(name, configs[name])
+		if err != nil {
+			t.Fatalf("Unable to open namespace: %v", err)
+		}
+		if val, _ := ns.Get(hash); val != expected {
+			t.Fatalf("Namespace %v: expected cltv %v, got %v",
+				name, expected, val)
+		}
+	}
+
+	assertNamespaceCltv("default", math.MaxUint32)
+	assertNamespaceCltv("retained", cltv)
+	assertNamespaceCltv("disabled", cltv)
+
+	// The retained entry is collected 10 blocks after its CLTV expired.
+	if err := d.Prune(cltv + 10); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	assertNamespaceCltv("retained", cltv)
+
+	if err := d.Prune(cltv + 11); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+	assertNamespaceCltv("retained", math.MaxUint32)
+	assertNamespaceCltv("disabled", cltv)
+
+	ns, err := d.Namespace("retained", configs["retained"])
+	if err != nil {
+		t.Fatalf("Unable to open namespace: %v", err)
+	}
+	stats, err := ns.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.LastPurged != 1 || stats.TotalPurged != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Entries within the retention period are still accepted, older ones
+	// are rejected.
+	if err := ns.Put(hash, cltv+1); err != nil {
+		t.Fatalf("Unable to store in namespace: %v", err)
+	}
+	if err := ns.Put(hash, cltv); err != ErrExpiredEntry {
+		t.Fatalf("Expected ErrExpiredEntry, got %v", err)
+	}
+}
+
+// TestNamespacePurgeRetried checks that the purge counters of a namespace
+// aren't inflated when the garbage collection is retried by a failing batch.
+func TestNamespacePurgeRetried(t *testing.T) {
+	d, _, _, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	ns, err := d.Namespace("htlc", NamespaceConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create namespace: %v", err)
+	}
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := ns.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in namespace: %v", err)
+	}
+
+	// A failing call following the Prune within the same batch makes
+	// bolt rerun the Prune.
+	d.db.MaxBatchDelay = 100 * time.Millisecond
+	pruneErr := make(chan error, 1)
+	go func() {
+		pruneErr <- d.Prune(cltv + 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err = d.db.Batch(func(tx *bolt.Tx) error {
+		return fmt.Errorf("failing batch call")
+	})
+	if err == nil {
+		t.Fatalf("Batch call didn't fail")
+	}
+	if err := <-pruneErr; err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	stats, err := ns.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.LastPurged != 1 || stats.TotalPurged != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
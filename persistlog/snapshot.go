@@ -0,0 +1,330 @@
+package persistlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// snapshotVersion is the current version of the snapshot format.
+	snapshotVersion = 2
+
+	// legacySnapshotVersion is the version of snapshots which predate the
+	// expiry mode, and therefore always hold CLTVs.
+	legacySnapshotVersion = 1
+
+	// snapshotMagic marks the beginning of a replay log snapshot.
+	snapshotMagic = "SPHXRLOG"
+
+	// snapshotHeaderSize is the size in bytes of the snapshot header: the
+	// magic, version, hash size, expiry mode, salt and number of entries.
+	snapshotHeaderSize = len(snapshotMagic) + 1 + 1 + 1 + saltSize + 8
+)
+
+// Export writes a snapshot of every live entry of the DecayedLog, excluding
+// its namespaces, to the passed io.Writer. The snapshot consists of a header
+// carrying the salt, hash size and ExpiryMode of the database, followed by
+// the <hash, CLTV> entries and a sha256 checksum of everything preceding it.
+// As the stored hashes are keyed, the snapshot is only usable along with the
+// salt it carries. In TimeExpiry mode, the entries carry their deadlines in
+// place of CLTVs.
+//
+// Entries which have already expired, according to the best known height or
+// the Clock in TimeExpiry mode, are omitted. The snapshot is taken within a
+// single read transaction, so it's consistent even while the DecayedLog is in
+// use. Buffered entries are flushed first.
+func (d *DecayedLog) Export(w io.Writer) error {
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+
+	if err := d.flush(); err != nil {
+		return err
+	}
+
+	threshold := d.expiryThreshold()
+
+	return d.db.View(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+
+		// Count the live entries first, so the header can carry their
+		// number.
+		var numEntries uint64
+		err := sharedHashes.ForEach(func(_, v []byte) error {
+			if binary.BigEndian.Uint32(v) >= threshold {
+				numEntries++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		mw := io.MultiWriter(w, h)
+
+		var header bytes.Buffer
+		header.WriteString(snapshotMagic)
+		header.WriteByte(snapshotVersion)
+		header.WriteByte(byte(d.hashSize))
+		header.WriteByte(byte(d.ExpiryMode))
+		header.Write(d.salt)
+
+		var scratch [8]byte
+		binary.BigEndian.PutUint64(scratch[:], numEntries)
+		header.Write(scratch[:])
+
+		if _, err := mw.Write(header.Bytes()); err != nil {
+			return err
+		}
+
+		err = sharedHashes.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint32(v) < threshold {
+				return nil
+			}
+
+			if _, err := mw.Write(k); err != nil {
+				return err
+			}
+			_, err := mw.Write(v[:4])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(h.Sum(nil))
+		return err
+	})
+}
+
+// snapshotEntry is a single <hash, CLTV> entry read from a snapshot.
+type snapshotEntry struct {
+	hash []byte
+	cltv uint32
+}
+
+// snapshot is the content of a verified snapshot.
+type snapshot struct {
+	salt       []byte
+	hashSize   int
+	expiryMode ExpiryMode
+	entries    []snapshotEntry
+}
+
+// readSnapshot reads and verifies a complete snapshot from the passed
+// io.Reader. Legacy snapshots, which lack the expiry mode, use BlockExpiry.
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	h := sha256.New()
+	tr := io.TeeReader(r, h)
+
+	var prefix [len(snapshotMagic) + 1]byte
+	if _, err := io.ReadFull(tr, prefix[:]); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+
+	if string(prefix[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, ErrInvalidSnapshot
+	}
+
+	// The remainder of the header consists of the hash size, the expiry
+	// mode unless the snapshot is a legacy one, the salt and the number
+	// of entries.
+	version := prefix[len(snapshotMagic)]
+	var header []byte
+	switch version {
+	case snapshotVersion:
+		header = make([]byte, snapshotHeaderSize-len(prefix))
+
+	case legacySnapshotVersion:
+		header = make([]byte, snapshotHeaderSize-len(prefix)-1)
+
+	default:
+		return nil, ErrUnknownSnapshotVersion
+	}
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+
+	snap := &snapshot{
+		hashSize:   int(header[0]),
+		expiryMode: BlockExpiry,
+	}
+	if snap.hashSize < minHashSize || snap.hashSize > maxHashSize {
+		return nil, ErrInvalidSnapshot
+	}
+	header = header[1:]
+
+	if version == snapshotVersion {
+		snap.expiryMode = ExpiryMode(header[0])
+		if snap.expiryMode > TimeExpiry {
+			return nil, ErrInvalidSnapshot
+		}
+		header = header[1:]
+	}
+
+	snap.salt = append([]byte(nil), header[:saltSize]...)
+	numEntries := binary.BigEndian.Uint64(header[saltSize:])
+
+	// Entries are read one at a time rather than preallocated, so a
+	// corrupt count can't exhaust memory before the stream runs out.
+	for i := uint64(0); i < numEntries; i++ {
+		entry := make([]byte, snap.hashSize+4)
+		if _, err := io.ReadFull(tr, entry); err != nil {
+			return nil, ErrInvalidSnapshot
+		}
+
+		snap.entries = append(snap.entries, snapshotEntry{
+			hash: entry[:snap.hashSize],
+			cltv: binary.BigEndian.Uint32(entry[snap.hashSize:]),
+		})
+	}
+
+	checksum := h.Sum(nil)
+
+	var expectedChecksum [sha256.Size]byte
+	if _, err := io.ReadFull(r, expectedChecksum[:]); err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	if !bytes.Equal(checksum, expectedChecksum[:]) {
+		return nil, ErrSnapshotChecksum
+	}
+
+	return snap, nil
+}
+
+// Import reads a snapshot created by Export from the passed io.Reader, and
+// merges its entries into the DecayedLog. The whole snapshot is verified
+// before any entry is stored, and all entries are stored within a single
+// transaction.
+//
+// If the DecayedLog and its namespaces are empty, it adopts the salt and
+// hash size of the snapshot, so shared secrets hash to the imported keys.
+// Otherwise, the salt and hash size must match, and ErrSaltMismatch is
+// returned if they don't. The ExpiryMode of the snapshot must match the mode
+// of the DecayedLog, as CLTVs and deadlines can't be converted into each
+// other, and ErrExpiryModeMismatch is returned if it doesn't.
+//
+// Entries already stored keep the greater of both CLTVs, and entries which
+// have already expired are skipped. The number of imported entries is
+// returned. As the salt may change, Import waits for every pending operation
+// to complete and blocks new ones, including HashSharedSecret, until it
+// returns. Buffered entries are flushed first, so they count towards the
+// DecayedLog not being empty.
+func (d *DecayedLog) Import(r io.Reader) (int, error) {
+	snap, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+	salt, hashSize := snap.salt, snap.hashSize
+
+	d.opsMtx.Lock()
+	defer d.opsMtx.Unlock()
+
+	if !d.started {
+		return 0, ErrLogStopped
+	}
+
+	if snap.expiryMode != d.ExpiryMode {
+		return 0, ErrExpiryModeMismatch
+	}
+
+	if err := d.flush(); err != nil {
+		return 0, err
+	}
+
+	threshold := d.expiryThreshold()
+
+	var numImported int
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		sharedHashes := tx.Bucket(sharedHashBucket)
+		if sharedHashes == nil {
+			return fmt.Errorf("sharedHashBucket is nil")
+		}
+		cltvIndex := tx.Bucket(cltvIndexBucket)
+		if cltvIndex == nil {
+			return fmt.Errorf("cltvIndexBucket is nil")
+		}
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("metaBucket is nil")
+		}
+
+		sameSalt := bytes.Equal(salt, d.salt) && hashSize == d.hashSize
+		if !sameSalt {
+			// The entries of the namespaces are keyed with the
+			// same salt, so they must be empty as well.
+			if k, _ := sharedHashes.Cursor().First(); k != nil {
+				return ErrSaltMismatch
+			}
+			empty, err := namespacesEmpty(tx)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return ErrSaltMismatch
+			}
+
+			if err := meta.Put(saltKey, salt); err != nil {
+				return err
+			}
+			err = meta.Put(hashSizeKey, []byte{byte(hashSize)})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, entry := range snap.entries {
+			if entry.cltv < threshold {
+				continue
+			}
+
+			if oldValue := sharedHashes.Get(entry.hash); oldValue != nil {
+				oldCltv := binary.BigEndian.Uint32(oldValue)
+				if oldCltv >= entry.cltv {
+					continue
+				}
+
+				err := cltvIndex.Delete(
+					cltvIndexKey(oldCltv, entry.hash),
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			var scratch [4]byte
+			binary.BigEndian.PutUint32(scratch[:], entry.cltv)
+			if err := sharedHashes.Put(entry.hash, scratch[:]); err != nil {
+				return err
+			}
+
+			err := cltvIndex.Put(cltvIndexKey(entry.cltv, entry.hash), nil)
+			if err != nil {
+				return err
+			}
+
+			numImported++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only adopt the salt of the snapshot once it has been committed.
+	d.salt = salt
+	d.hashSize = hashSize
+
+	return numImported, nil
+}
@@ -0,0 +1,282 @@
+package persistlog
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+)
+
+// TestDecayedLogSnapshot checks that the live entries of a DecayedLog can be
+// carried over to a fresh DecayedLog, which adopts the salt of the snapshot.
+func TestDecayedLogSnapshot(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	expiredHash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := d.Put(expiredHash, cltv-10); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if err := d.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if err := d.Prune(cltv - 5); err != nil {
+		t.Fatalf("Unable to prune DecayedLog: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := d.Export(&snapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+
+	other := &DecayedLog{}
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer os.RemoveAll("tempdir2")
+	defer other.Stop()
+
+	numImported, err := other.Import(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to import snapshot: %v", err)
+	}
+	if numImported != 1 {
+		t.Fatalf("Expected 1 imported entry, got %v", numImported)
+	}
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	if !bytes.Equal(other.HashSharedSecret(secret),
+		d.HashSharedSecret(secret)) {
+
+		t.Fatalf("Salt of the snapshot wasn't adopted")
+	}
+
+	if val, _ := other.Get(hashedSecret); val != cltv {
+		t.Fatalf("Expected cltv %v, got %v", cltv, val)
+	}
+	if val, _ := other.Get(expiredHash); val != math.MaxUint32 {
+		t.Fatalf("Expired entry was imported")
+	}
+
+	// The adopted salt must survive a restart.
+	other.Stop()
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to restart DecayedLog: %v", err)
+	}
+	if !bytes.Equal(other.HashSharedSecret(secret),
+		d.HashSharedSecret(secret)) {
+
+		t.Fatalf("Adopted salt wasn't persisted")
+	}
+
+	// Importing the snapshot again merges it, keeping the greater CLTV.
+	if err := other.Put(hashedSecret, cltv+10); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	numImported, err = other.Import(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to import snapshot: %v", err)
+	}
+	if numImported != 0 {
+		t.Fatalf("Expected 0 imported entries, got %v", numImported)
+	}
+	if val, _ := other.Get(hashedSecret); val != cltv+10 {
+		t.Fatalf("Expected cltv %v, got %v", cltv+10, val)
+	}
+}
+
+// TestDecayedLogSnapshotInvalid checks that invalid snapshots, and snapshots
+// with a foreign salt, are refused without modifying the DecayedLog.
+func TestDecayedLogSnapshotInvalid(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := d.Export(&snapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+	encoded := snapshot.Bytes()
+
+	corrupted := append([]byte(nil), encoded...)
+	corrupted[snapshotHeaderSize] ^= 0x01
+
+	badMagic := append([]byte(nil), encoded...)
+	badMagic[0] ^= 0x01
+
+	badVersion := append([]byte(nil), encoded...)
+	badVersion[len(snapshotMagic)] = snapshotVersion + 1
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		err      error
+	}{
+		{"truncated", encoded[:len(encoded)-1], ErrInvalidSnapshot},
+		{"corrupted", corrupted, ErrSnapshotChecksum},
+		{"bad magic", badMagic, ErrInvalidSnapshot},
+		{"bad version", badVersion, ErrUnknownSnapshotVersion},
+	}
+	for _, test := range tests {
+		_, err := d.Import(bytes.NewReader(test.snapshot))
+		if err != test.err {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.err,
+				err)
+		}
+	}
+
+	// A snapshot of another, non-empty DecayedLog can't be merged.
+	other := &DecayedLog{}
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer os.RemoveAll("tempdir2")
+	defer other.Stop()
+
+	otherHash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	if err := other.Put(otherHash, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+	if _, err := other.Import(bytes.NewReader(encoded)); err != ErrSaltMismatch {
+		t.Fatalf("Expected ErrSaltMismatch, got %v", err)
+	}
+	if val, _ := other.Get(hashedSecret); val != math.MaxUint32 {
+		t.Fatalf("Entry of refused snapshot was imported")
+	}
+}
+
+// TestDecayedLogSnapshotNamespaces checks that a DecayedLog whose namespaces
+// hold entries refuses to adopt the salt of a snapshot, as the entries of its
+// namespaces would no longer match the hashes of their shared secrets.
+func TestDecayedLogSnapshotNamespaces(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := d.Export(&snapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+
+	other := &DecayedLog{}
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer os.RemoveAll("tempdir2")
+	defer other.Stop()
+
+	ns, err := other.Namespace("htlc", NamespaceConfig{})
+	if err != nil {
+		t.Fatalf("Unable to open namespace: %v", err)
+	}
+	nsHash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	if err := ns.Put(nsHash, cltv); err != nil {
+		t.Fatalf("Unable to store in namespace: %v", err)
+	}
+
+	_, err = other.Import(bytes.NewReader(snapshot.Bytes()))
+	if err != ErrSaltMismatch {
+		t.Fatalf("Expected ErrSaltMismatch, got %v", err)
+	}
+	if val, _ := ns.Get(nsHash); val != cltv {
+		t.Fatalf("Namespace entry was lost")
+	}
+
+	// Once the namespace is empty again, the salt may be adopted.
+	if err := ns.Delete(nsHash); err != nil {
+		t.Fatalf("Unable to delete from namespace: %v", err)
+	}
+	if _, err := other.Import(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatalf("Unable to import snapshot: %v", err)
+	}
+}
+
+// TestDecayedLogSnapshotBuffered checks that entries which haven't been
+// flushed yet prevent a DecayedLog from adopting the salt of a snapshot, and
+// that the salt can be adopted while shared secrets are being hashed.
+func TestDecayedLogSnapshotBuffered(t *testing.T) {
+	d, _, hashedSecret, err := startup(false)
+	if err != nil {
+		t.Fatalf("Unable to start up DecayedLog: %v", err)
+	}
+	defer shutdown(d)
+
+	if err := d.Put(hashedSecret, cltv); err != nil {
+		t.Fatalf("Unable to store in channeldb: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := d.Export(&snapshot); err != nil {
+		t.Fatalf("Unable to export snapshot: %v", err)
+	}
+
+	other := &DecayedLog{SyncPolicy: SyncBuffered}
+	if err := other.Start("tempdir2"); err != nil {
+		t.Fatalf("Unable to start DecayedLog: %v", err)
+	}
+	defer os.RemoveAll("tempdir2")
+	defer other.Stop()
+
+	bufferedHash := bytes.Repeat([]byte{0x02}, sharedHashSize)
+	if err := other.Put(bufferedHash, cltv); err != nil {
+		t.Fatalf("Unable to store in DecayedLog: %v", err)
+	}
+
+	_, err = other.Import(bytes.NewReader(snapshot.Bytes()))
+	if err != ErrSaltMismatch {
+		t.Fatalf("Expected ErrSaltMismatch, got %v", err)
+	}
+	if val, _ := other.Get(bufferedHash); val != cltv {
+		t.Fatalf("Buffered entry was lost")
+	}
+
+	if err := other.Delete(bufferedHash); err != nil {
+		t.Fatalf("Unable to delete from DecayedLog: %v", err)
+	}
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+				other.HashSharedSecret(secret)
+			}
+		}
+	}()
+
+	_, err = other.Import(bytes.NewReader(snapshot.Bytes()))
+	close(quit)
+	<-done
+	if err != nil {
+		t.Fatalf("Unable to import snapshot: %v", err)
+	}
+
+	if !bytes.Equal(other.HashSharedSecret(secret),
+		d.HashSharedSecret(secret)) {
+
+		t.Fatalf("Salt of the snapshot wasn't adopted")
+	}
+}
@@ -0,0 +1,306 @@
+package persistlog
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+)
+
+// logConstructors returns constructors for every PersistLog implementation,
+// so the same test suite can be run against all of them.
+var logConstructors = []struct {
+	name   string
+	newLog func() PersistLog
+}{
+	{
+		name:   "DecayedLog",
+		newLog: func() PersistLog { return &DecayedLog{} },
+	},
+	{
+		name: "BufferedDecayedLog",
+		newLog: func() PersistLog {
+			return &DecayedLog{SyncPolicy: SyncBuffered}
+		},
+	},
+	{
+		name:   "BucketedLog",
+		newLog: func() PersistLog { return &BucketedLog{BucketRange: 1} },
+	},
+	{
+		name: "FileLog",
+		newLog: func() PersistLog {
+			return &FileLog{SegmentSize: 64}
+		},
+	},
+	{
+		name: "FilteredLog",
+		newLog: func() PersistLog {
+			return &FilteredLog{
+				Log:             &DecayedLog{},
+				GenerationRange: 2,
+			}
+		},
+	},
+}
+
+// persistLogTests is the test suite every PersistLog implementation must
+// pass. Each test is handed a started log using the "tempdir" directory, and
+// a function which restarts it.
+var persistLogTests = []struct {
+	name string
+	test func(t *testing.T, log PersistLog, restart func() PersistLog)
+}{
+	{
+		name: "storage and retrieval",
+		test: testLogStorageAndRetrieval,
+	},
+	{
+		name: "persistence",
+		test: testLogPersistence,
+	},
+	{
+		name: "prune",
+		test: testLogPrune,
+	},
+	{
+		name: "stats and iteration",
+		test: testLogStatsAndIteration,
+	},
+	{
+		name: "stopped",
+		test: testLogStopped,
+	},
+}
+
+// TestPersistLogSuite runs the test suite against every PersistLog
+// implementation.
+func TestPersistLogSuite(t *testing.T) {
+	for _, constructor := range logConstructors {
+		for _, test := range persistLogTests {
+			name := constructor.name + "/" + test.name
+			t.Run(name, func(t *testing.T) {
+				defer os.RemoveAll("tempdir")
+
+				log := constructor.newLog()
+				if err := log.Start("tempdir"); err != nil {
+					t.Fatalf("Unable to start log: %v", err)
+				}
+
+				restart := func() PersistLog {
+					log.Stop()
+					log = constructor.newLog()
+					if err := log.Start("tempdir"); err != nil {
+						t.Fatalf("Unable to restart log: %v",
+							err)
+					}
+					return log
+				}
+				defer func() { log.Stop() }()
+
+				test.test(t, log, restart)
+			})
+		}
+	}
+}
+
+// TestPersistLogNotStarted checks that every PersistLog implementation fails
+// its operations with ErrLogStopped before it has been started.
+func TestPersistLogNotStarted(t *testing.T) {
+	for _, constructor := range logConstructors {
+		t.Run(constructor.name, func(t *testing.T) {
+			assertLogStopped(t, constructor.newLog())
+		})
+	}
+}
+
+// assertLogStopped fails the test unless every operation on the log fails
+// with ErrLogStopped.
+func assertLogStopped(t *testing.T, log PersistLog) {
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+
+	if err := log.Put(hash, cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Put, got %v", err)
+	}
+	if _, err := log.Get(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Get, got %v", err)
+	}
+	if err := log.Delete(hash); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Delete, got %v", err)
+	}
+	if err := log.Prune(cltv); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Prune, got %v", err)
+	}
+	err := log.ForEach(func([]byte, uint32) error { return nil })
+	if err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from ForEach, got %v", err)
+	}
+	if _, err := log.Stats(); err != ErrLogStopped {
+		t.Fatalf("Expected ErrLogStopped from Stats, got %v", err)
+	}
+}
+
+// assertLogCltv fails the test if the CLTV stored for the hash doesn't match
+// the expected one.
+func assertLogCltv(t *testing.T, log PersistLog, hash []byte, expected uint32) {
+	val, err := log.Get(hash)
+	if err != nil {
+		t.Fatalf("Get failed - received an error upon Get: %v", err)
+	}
+	if val != expected {
+		t.Fatalf("Expected cltv %v for %x, got %v", expected, hash, val)
+	}
+}
+
+func testLogStorageAndRetrieval(t *testing.T, log PersistLog,
+	_ func() PersistLog) {
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	hash := log.HashSharedSecret(secret)
+
+	assertLogCltv(t, log, hash, math.MaxUint32)
+
+	if err := log.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+	assertLogCltv(t, log, hash, cltv)
+
+	if err := log.Put(hash, cltv+5); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+	assertLogCltv(t, log, hash, cltv+5)
+
+	// Storing the hash again with a lower CLTV mustn't cut its replay
+	// protection short.
+	if err := log.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+	assertLogCltv(t, log, hash, cltv+5)
+
+	if err := log.Delete(hash); err != nil {
+		t.Fatalf("Unable to delete from log: %v", err)
+	}
+	assertLogCltv(t, log, hash, math.MaxUint32)
+}
+
+func testLogPersistence(t *testing.T, log PersistLog,
+	restart func() PersistLog) {
+
+	var secret [sharedSecretSize]byte
+	copy(secret[:], key[:])
+	hash := log.HashSharedSecret(secret)
+
+	deleted := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	for i := uint32(0); i < 10; i++ {
+		filler := bytes.Repeat([]byte{byte(i + 2)}, sharedHashSize)
+		if err := log.Put(filler, cltv+i); err != nil {
+			t.Fatalf("Unable to store in log: %v", err)
+		}
+	}
+	if err := log.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+	if err := log.Put(deleted, cltv); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+	if err := log.Delete(deleted); err != nil {
+		t.Fatalf("Unable to delete from log: %v", err)
+	}
+	if err := log.Prune(cltv - 1); err != nil {
+		t.Fatalf("Unable to prune log: %v", err)
+	}
+
+	log = restart()
+
+	if !bytes.Equal(log.HashSharedSecret(secret), hash) {
+		t.Fatalf("Hash changed across restarts")
+	}
+	if log.BestHeight() != cltv-1 {
+		t.Fatalf("Expected best height %v, got %v", cltv-1,
+			log.BestHeight())
+	}
+	assertLogCltv(t, log, hash, cltv)
+	assertLogCltv(t, log, deleted, math.MaxUint32)
+}
+
+func testLogPrune(t *testing.T, log PersistLog, restart func() PersistLog) {
+	hashes := make([][]byte, 10)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		if err := log.Put(hashes[i], cltv+uint32(i)); err != nil {
+			t.Fatalf("Unable to store in log: %v", err)
+		}
+	}
+
+	if err := log.Prune(cltv + 5); err != nil {
+		t.Fatalf("Unable to prune log: %v", err)
+	}
+	if err := log.Put(hashes[0], cltv+4); err != ErrExpiredEntry {
+		t.Fatalf("Expected ErrExpiredEntry, got %v", err)
+	}
+
+	// Pruned entries must not come back after a restart.
+	log = restart()
+
+	for i, hash := range hashes {
+		if i < 5 {
+			assertLogCltv(t, log, hash, math.MaxUint32)
+		} else {
+			assertLogCltv(t, log, hash, cltv+uint32(i))
+		}
+	}
+}
+
+func testLogStatsAndIteration(t *testing.T, log PersistLog,
+	_ func() PersistLog) {
+
+	hashes := make([][]byte, 5)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i + 1)}, sharedHashSize)
+		if err := log.Put(hashes[i], cltv+uint32(i)); err != nil {
+			t.Fatalf("Unable to store in log: %v", err)
+		}
+	}
+	if err := log.Prune(cltv + 2); err != nil {
+		t.Fatalf("Unable to prune log: %v", err)
+	}
+
+	visited := make(map[string]uint32)
+	err := log.ForEach(func(hash []byte, cltv uint32) error {
+		visited[string(hash)] = cltv
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to iterate over entries: %v", err)
+	}
+	if len(visited) != 3 {
+		t.Fatalf("Expected 3 entries, visited %v", len(visited))
+	}
+	for i := 2; i < len(hashes); i++ {
+		if visited[string(hashes[i])] != cltv+uint32(i) {
+			t.Fatalf("Entry %v wasn't visited", i)
+		}
+	}
+
+	stats, err := log.Stats()
+	if err != nil {
+		t.Fatalf("Unable to retrieve stats: %v", err)
+	}
+	if stats.NumEntries != 3 || stats.OldestCltv != cltv+2 ||
+		stats.NewestCltv != cltv+4 || stats.BestHeight != cltv+2 ||
+		stats.LastPurged != 2 || stats.SizeOnDisk <= 0 {
+
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func testLogStopped(t *testing.T, log PersistLog, _ func() PersistLog) {
+	hash := bytes.Repeat([]byte{0x01}, sharedHashSize)
+	if err := log.Put(hash, cltv); err != nil {
+		t.Fatalf("Unable to store in log: %v", err)
+	}
+
+	log.Stop()
+	assertLogStopped(t, log)
+}
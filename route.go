@@ -0,0 +1,142 @@
+package sphinx
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+// feeRateParts is the denominator of the proportional fee rate of a channel,
+// which is expressed in millionths of the forwarded amount.
+const feeRateParts = 1000000
+
+// RouteHop describes a hop of a payment route, along with the channel used to
+// reach it and the forwarding policy of that channel.
+type RouteHop struct {
+	// PubKey is the onion public key of the node of this hop.
+	PubKey *btcec.PublicKey
+
+	// ChannelID is the short channel ID of the channel connecting the
+	// previous node of the route to this hop. The ChannelID of the first
+	// hop is the channel of the sender, which isn't part of the onion.
+	ChannelID uint64
+
+	// BaseFee and FeeRate are the fee the previous node of the route
+	// charges for forwarding over the channel: a fixed base fee plus
+	// FeeRate millionths of the forwarded amount, both in the unit of the
+	// amounts of the route. They're ignored for the first hop, as the
+	// sender doesn't pay itself.
+	BaseFee uint64
+	FeeRate uint64
+
+	// CltvDelta is the number of blocks the previous node of the route
+	// requires between the time-lock of its incoming HTLC and the
+	// time-lock of the HTLC it forwards over the channel. It's ignored
+	// for the first hop.
+	CltvDelta uint16
+}
+
+// fee returns the fee charged for forwarding the passed amount over the
+// channel of the hop. False is returned if the fee overflows.
+func (h *RouteHop) fee(amount uint64) (uint64, bool) {
+	if h.FeeRate != 0 && amount > math.MaxUint64/h.FeeRate {
+		return 0, false
+	}
+
+	proportional := amount * h.FeeRate / feeRateParts
+	if proportional > math.MaxUint64-h.BaseFee {
+		return 0, false
+	}
+
+	return h.BaseFee + proportional, true
+}
+
+// Route is a payment route built by BuildRoute, ready to be passed to
+// NewOnionPacket.
+type Route struct {
+	// PaymentPath is the onion public keys of the hops of the route.
+	PaymentPath []*btcec.PublicKey
+
+	// HopsData is the per-hop payload of every hop of the route.
+	HopsData []HopData
+
+	// TotalAmount is the amount of the HTLC the sender offers to the
+	// first hop, i.e. the destination amount plus the fees of every hop.
+	TotalAmount uint64
+
+	// TotalTimeLock is the absolute time-lock of the HTLC the sender
+	// offers to the first hop.
+	TotalTimeLock uint32
+}
+
+// TotalFees returns the sum of the fees charged by the hops of the route.
+func (r *Route) TotalFees() uint64 {
+	last := r.HopsData[len(r.HopsData)-1]
+	return r.TotalAmount - last.ForwardAmount
+}
+
+// BuildRoute builds a payment route delivering amount with the final
+// time-lock finalCltv to the last of the passed hops. The amounts and
+// time-locks each hop forwards are computed backward from the destination,
+// adding the fee and CLTV delta of every channel along the way. The per-hop
+// payload of each hop instructs it to forward over the channel of the next
+// hop, while the payload of the last hop carries a zero next address.
+func BuildRoute(amount uint64, finalCltv uint32,
+	hops []RouteHop) (*Route, error) {
+
+	if len(hops) == 0 {
+		return nil, ErrEmptyPaymentPath
+	}
+	if err := checkPayloadSize(len(hops), 0); err != nil {
+		return nil, err
+	}
+
+	route := &Route{
+		PaymentPath: make([]*btcec.PublicKey, len(hops)),
+		HopsData:    make([]HopData, len(hops)),
+	}
+
+	// The amount and time-lock of the HTLC the current hop forwards,
+	// starting with the payment received by the destination.
+	forwardAmount := amount
+	forwardCltv := finalCltv
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !validPubKey(hops[i].PubKey) {
+			return nil, ErrInvalidRoutePubKey
+		}
+		route.PaymentPath[i] = hops[i].PubKey
+
+		hopData := HopData{
+			Realm:         0x00,
+			ForwardAmount: forwardAmount,
+			OutgoingCltv:  forwardCltv,
+		}
+
+		// The last hop receives the payment. Every other hop forwards
+		// over the channel of the next hop, and its incoming HTLC
+		// must cover the fee and CLTV delta of that channel.
+		if i != len(hops)-1 {
+			next := &hops[i+1]
+			binary.BigEndian.PutUint64(hopData.NextAddress[:],
+				next.ChannelID)
+
+			fee, ok := next.fee(forwardAmount)
+			if !ok || fee > math.MaxUint64-forwardAmount {
+				return nil, ErrRouteOverflow
+			}
+			forwardAmount += fee
+
+			if uint32(next.CltvDelta) > math.MaxUint32-forwardCltv {
+				return nil, ErrRouteOverflow
+			}
+			forwardCltv += uint32(next.CltvDelta)
+		}
+		route.HopsData[i] = hopData
+	}
+
+	route.TotalAmount = forwardAmount
+	route.TotalTimeLock = forwardCltv
+
+	return route, nil
+}
@@ -0,0 +1,174 @@
+package sphinx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/roasbeef/btcd/btcec"
+)
+
+// newRouteHops returns route hops for the passed Routers, with the passed
+// channel policies.
+func newRouteHops(nodes []*Router, baseFees, feeRates []uint64,
+	cltvDeltas []uint16) []RouteHop {
+
+	hops := make([]RouteHop, len(nodes))
+	for i, node := range nodes {
+		hops[i] = RouteHop{
+			PubKey:    node.onionKey.PubKey(),
+			ChannelID: uint64(i + 1),
+			BaseFee:   baseFees[i],
+			FeeRate:   feeRates[i],
+			CltvDelta: cltvDeltas[i],
+		}
+	}
+
+	return hops
+}
+
+func TestBuildRoute(t *testing.T) {
+	nodes, _, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// The policy of the first hop belongs to the sender, and must be
+	// ignored.
+	hops := newRouteHops(nodes, []uint64{999, 1000, 500},
+		[]uint64{999, 100, 1000}, []uint16{99, 40, 20})
+
+	route, err := BuildRoute(1000000, 500, hops)
+	if err != nil {
+		t.Fatalf("unable to build route: %v", err)
+	}
+
+	// The last hop receives the payment. The second hop forwards it,
+	// charging 500 + 1000000 * 1000 / 1000000 = 1500. The first hop
+	// forwards 1001500, charging 1000 + 1001500 * 100 / 1000000 = 1100.
+	expectedAmounts := []uint64{1001500, 1000000, 1000000}
+	expectedCltvs := []uint32{520, 500, 500}
+	expectedChannels := []uint64{2, 3, 0}
+	for i, hopData := range route.HopsData {
+		if hopData.ForwardAmount != expectedAmounts[i] {
+			t.Fatalf("hop %v: expected forward amount %v, got %v",
+				i, expectedAmounts[i], hopData.ForwardAmount)
+		}
+		if hopData.OutgoingCltv != expectedCltvs[i] {
+			t.Fatalf("hop %v: expected outgoing cltv %v, got %v",
+				i, expectedCltvs[i], hopData.OutgoingCltv)
+		}
+
+		channelID := binary.BigEndian.Uint64(hopData.NextAddress[:])
+		if channelID != expectedChannels[i] {
+			t.Fatalf("hop %v: expected next channel %v, got %v",
+				i, expectedChannels[i], channelID)
+		}
+
+		if !route.PaymentPath[i].IsEqual(hops[i].PubKey) {
+			t.Fatalf("hop %v: payment path doesn't match", i)
+		}
+	}
+
+	if route.TotalAmount != 1002600 {
+		t.Fatalf("expected total amount 1002600, got %v",
+			route.TotalAmount)
+	}
+	if route.TotalTimeLock != 560 {
+		t.Fatalf("expected total time-lock 560, got %v",
+			route.TotalTimeLock)
+	}
+	if route.TotalFees() != 2600 {
+		t.Fatalf("expected total fees 2600, got %v", route.TotalFees())
+	}
+}
+
+func TestBuildRouteOnion(t *testing.T) {
+	// A route built by BuildRoute should be usable as is to create an
+	// onion packet, whose payloads are recovered by every hop.
+	nodes, _, _, err := newTestRoute(4)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	hops := newRouteHops(nodes, []uint64{0, 1000, 1000, 1000},
+		[]uint64{0, 1, 1, 1}, []uint16{0, 144, 144, 144})
+	route, err := BuildRoute(50000, 1000, hops)
+	if err != nil {
+		t.Fatalf("unable to build route: %v", err)
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+	fwdMsg, err := NewOnionPacket(route.PaymentPath, sessionKey,
+		route.HopsData, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	for i, node := range nodes {
+		tempDir := strconv.Itoa(i)
+		node.d.Start(tempDir)
+		defer shutdown(tempDir, node.d)
+
+		processed, err := node.ProcessOnionPacket(fwdMsg, nil)
+		if err != nil {
+			t.Fatalf("node %v was unable to process the packet: %v",
+				i, err)
+		}
+
+		if !reflect.DeepEqual(processed.ForwardingInstructions,
+			route.HopsData[i]) {
+
+			t.Fatalf("hop data doesn't match: expected %v, got %v",
+				spew.Sdump(route.HopsData[i]),
+				spew.Sdump(processed.ForwardingInstructions))
+		}
+
+		fwdMsg = processed.NextPacket
+	}
+}
+
+func TestBuildRouteErrors(t *testing.T) {
+	nodes, _, _, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	hops := newRouteHops(nodes, []uint64{0, 0}, []uint64{0, 0},
+		[]uint16{0, 0})
+
+	if _, err := BuildRoute(1000, 100, nil); err != ErrEmptyPaymentPath {
+		t.Fatalf("expected ErrEmptyPaymentPath, got %v", err)
+	}
+
+	tooLong := make([]RouteHop, NumMaxHops+1)
+	for i := range tooLong {
+		tooLong[i] = hops[0]
+	}
+	_, err = BuildRoute(1000, 100, tooLong)
+	if _, ok := err.(*PayloadOverflowError); !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+
+	missingKey := []RouteHop{hops[0], {ChannelID: 2}}
+	if _, err := BuildRoute(1000, 100, missingKey); err != ErrInvalidRoutePubKey {
+		t.Fatalf("expected ErrInvalidRoutePubKey, got %v", err)
+	}
+
+	feeOverflow := []RouteHop{hops[0], hops[1]}
+	feeOverflow[1].BaseFee = math.MaxUint64
+	if _, err := BuildRoute(1000, 100, feeOverflow); err != ErrRouteOverflow {
+		t.Fatalf("expected ErrRouteOverflow, got %v", err)
+	}
+
+	cltvOverflow := []RouteHop{hops[0], hops[1]}
+	cltvOverflow[1].CltvDelta = 1
+	_, err = BuildRoute(1000, math.MaxUint32, cltvOverflow)
+	if err != ErrRouteOverflow {
+		t.Fatalf("expected ErrRouteOverflow, got %v", err)
+	}
+}
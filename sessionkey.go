@@ -0,0 +1,88 @@
+package sphinx
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/big"
+
+	"github.com/roasbeef/btcd/btcec"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MinRootKeySize is the minimum size in bytes of the root secret
+	// session keys are derived from.
+	MinRootKeySize = 32
+
+	// sessionKeyInfo is the HKDF info prefix used when deriving session
+	// keys, binding the derived keys to their purpose.
+	sessionKeyInfo = "lightning-onion session key"
+)
+
+// DeriveSessionKey deterministically derives the session key of a payment
+// attempt from the passed root secret, payment identifier and attempt number
+// using HKDF-SHA256. This allows a sender to regenerate the Circuit of an
+// attempt, e.g. after a crash, without persisting its session key. Distinct
+// payment identifiers or attempt numbers yield independent session keys, so
+// an attempt number MUST never be reused for the same payment identifier.
+func DeriveSessionKey(rootKey, paymentID []byte,
+	attempt uint32) (*btcec.PrivateKey, error) {
+
+	if len(rootKey) < MinRootKeySize {
+		return nil, ErrInvalidRootKey
+	}
+
+	info := make([]byte, 0, len(sessionKeyInfo)+len(paymentID)+4)
+	info = append(info, sessionKeyInfo...)
+	info = append(info, paymentID...)
+	var attemptBytes [4]byte
+	binary.BigEndian.PutUint32(attemptBytes[:], attempt)
+	info = append(info, attemptBytes[:]...)
+
+	// As the attempt number is of fixed size, the length of the info
+	// determines the paymentID, so distinct (paymentID, attempt) pairs
+	// never share the same info and no salt is needed.
+	//
+	// The output of HKDF is read in chunks until a valid secp256k1
+	// scalar is found. A chunk is only rejected if it's zero or exceeds
+	// the order of the curve, which is astronomically unlikely.
+	reader := hkdf.New(sha256.New, rootKey, nil, info)
+	var keyBytes [privKeySize]byte
+	for {
+		if _, err := io.ReadFull(reader, keyBytes[:]); err != nil {
+			return nil, err
+		}
+
+		d := new(big.Int).SetBytes(keyBytes[:])
+		if d.Sign() == 0 || d.Cmp(btcec.S256().N) >= 0 {
+			continue
+		}
+
+		sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+			keyBytes[:])
+		return sessionKey, nil
+	}
+}
+
+// DeriveCircuit regenerates the Circuit of the payment attempt whose session
+// key was derived by DeriveSessionKey with the passed parameters, and which
+// was sent along the passed payment path.
+func DeriveCircuit(rootKey, paymentID []byte, attempt uint32,
+	paymentPath []*btcec.PublicKey) (*Circuit, error) {
+
+	sessionKey, err := DeriveSessionKey(rootKey, paymentID, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	circuit := &Circuit{
+		SessionKey:  sessionKey,
+		PaymentPath: paymentPath,
+	}
+	if err := circuit.validate(); err != nil {
+		return nil, err
+	}
+
+	return circuit, nil
+}
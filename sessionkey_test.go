@@ -0,0 +1,130 @@
+package sphinx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/roasbeef/btcd/btcec"
+)
+
+func TestDeriveSessionKey(t *testing.T) {
+	rootKey := bytes.Repeat([]byte{0x01}, MinRootKeySize)
+	paymentID := bytes.Repeat([]byte{0x02}, 32)
+
+	sessionKey, err := DeriveSessionKey(rootKey, paymentID, 0)
+	if err != nil {
+		t.Fatalf("unable to derive session key: %v", err)
+	}
+	if !validSessionKey(sessionKey) {
+		t.Fatalf("derived session key is invalid")
+	}
+
+	// Deriving the key again must yield the very same key.
+	again, err := DeriveSessionKey(rootKey, paymentID, 0)
+	if err != nil {
+		t.Fatalf("unable to derive session key: %v", err)
+	}
+	if !bytes.Equal(sessionKey.Serialize(), again.Serialize()) {
+		t.Fatalf("session key derivation isn't deterministic")
+	}
+
+	// Changing any of the parameters must yield a different key.
+	otherRoot := bytes.Repeat([]byte{0x03}, MinRootKeySize)
+	otherID := bytes.Repeat([]byte{0x04}, 32)
+	tests := []struct {
+		name      string
+		rootKey   []byte
+		paymentID []byte
+		attempt   uint32
+	}{
+		{"root key", otherRoot, paymentID, 0},
+		{"payment id", rootKey, otherID, 0},
+		{"attempt", rootKey, paymentID, 1},
+		{"payment id prefix", rootKey, paymentID[:31], 0},
+	}
+	for _, test := range tests {
+		key, err := DeriveSessionKey(test.rootKey, test.paymentID,
+			test.attempt)
+		if err != nil {
+			t.Fatalf("%v: unable to derive session key: %v",
+				test.name, err)
+		}
+		if bytes.Equal(sessionKey.Serialize(), key.Serialize()) {
+			t.Fatalf("%v: expected a different session key",
+				test.name)
+		}
+	}
+
+	_, err = DeriveSessionKey(rootKey[:MinRootKeySize-1], paymentID, 0)
+	if err != ErrInvalidRootKey {
+		t.Fatalf("expected ErrInvalidRootKey, got %v", err)
+	}
+}
+
+// TestDeriveCircuit checks that a failure of an onion created with a derived
+// session key can be decrypted by a Circuit regenerated from the root secret
+// alone.
+func TestDeriveCircuit(t *testing.T) {
+	rootKey := bytes.Repeat([]byte{0x01}, MinRootKeySize)
+	paymentID := []byte("payment hash")
+
+	nodes, hopsData, _, err := newTestRoute(3)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	paymentPath := make([]*btcec.PublicKey, len(nodes))
+	for i, node := range nodes {
+		paymentPath[i] = node.onionKey.PubKey()
+	}
+
+	sessionKey, err := DeriveSessionKey(rootKey, paymentID, 7)
+	if err != nil {
+		t.Fatalf("unable to derive session key: %v", err)
+	}
+	packet, err := NewOnionPacket(paymentPath, sessionKey, *hopsData, nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+
+	// The first hop fails the payment.
+	obfuscator, err := NewOnionObfuscator(nodes[0], packet.EphemeralKey)
+	if err != nil {
+		t.Fatalf("unable to create obfuscator: %v", err)
+	}
+	failureData := []byte("failure")
+	obfuscated, err := obfuscator.Obfuscate(true, failureData)
+	if err != nil {
+		t.Fatalf("unable to obfuscate failure: %v", err)
+	}
+
+	// The sender regenerates the circuit without the session key.
+	circuit, err := DeriveCircuit(rootKey, paymentID, 7, paymentPath)
+	if err != nil {
+		t.Fatalf("unable to derive circuit: %v", err)
+	}
+	failure, err := NewOnionDeobfuscator(circuit).Deobfuscate(obfuscated)
+	if err != nil {
+		t.Fatalf("unable to decrypt failure: %v", err)
+	}
+	if failure.SenderIdx != 0 {
+		t.Fatalf("expected failure from hop 0, got %v",
+			failure.SenderIdx)
+	}
+	if !bytes.Equal(failure.Message, failureData) {
+		t.Fatalf("expected failure %x, got %x", failureData,
+			failure.Message)
+	}
+
+	// A circuit derived for another attempt can't decrypt the failure.
+	circuit, err = DeriveCircuit(rootKey, paymentID, 8, paymentPath)
+	if err != nil {
+		t.Fatalf("unable to derive circuit: %v", err)
+	}
+	if _, err := NewOnionDeobfuscator(circuit).Deobfuscate(obfuscated); err == nil {
+		t.Fatalf("expected failure decryption to fail")
+	}
+
+	if _, err := DeriveCircuit(rootKey, paymentID, 7, nil); err != ErrInvalidCircuitPathLength {
+		t.Fatalf("expected ErrInvalidCircuitPathLength, got %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Crypt-iQ/lightning-onion/persistlog"
 	"github.com/aead/chacha20"
@@ -250,12 +252,91 @@ func generateSharedSecrets(paymentPath []*btcec.PublicKey,
 	return hopSharedSecrets
 }
 
+// validateOnionParams checks that an onion packet can be constructed for the
+// passed payment path, session key, per-hop payloads and final hop data.
+func validateOnionParams(paymentPath []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey, hopsData []HopData,
+	finalHopData []byte) error {
+
+	if len(paymentPath) == 0 {
+		return ErrEmptyPaymentPath
+	}
+
+	// Ensure the per-hop payloads and final hop data of the route fit
+	// within the routing info of the packet.
+	err := checkPayloadSize(len(paymentPath), len(finalHopData))
+	if err != nil {
+		return err
+	}
+
+	if len(hopsData) != len(paymentPath) {
+		return ErrHopDataMismatch
+	}
+
+	for _, pubKey := range paymentPath {
+		if !validPubKey(pubKey) {
+			return ErrInvalidRoutePubKey
+		}
+	}
+
+	if !validSessionKey(sessionKey) {
+		return ErrInvalidSessionKey
+	}
+
+	return nil
+}
+
+// validPubKey returns true if the passed pub key is set and lies on the
+// secp256k1 curve.
+func validPubKey(pubKey *btcec.PublicKey) bool {
+	return pubKey != nil && pubKey.X != nil && pubKey.Y != nil &&
+		btcec.S256().IsOnCurve(pubKey.X, pubKey.Y)
+}
+
+// validSessionKey returns true if the scalar of the passed session key is set
+// and lies within the order of the secp256k1 curve.
+func validSessionKey(sessionKey *btcec.PrivateKey) bool {
+	return sessionKey != nil && sessionKey.D != nil &&
+		sessionKey.D.Sign() > 0 &&
+		sessionKey.D.Cmp(btcec.S256().N) < 0
+}
+
 // NewOnionPacket creates a new onion packet which is capable of
 // obliviously routing a message through the mix-net path outline by
-// 'paymentPath'.
+// 'paymentPath'. The parameters are validated first: an empty path is
+// rejected with ErrEmptyPaymentPath, a path with more than NumMaxHops hops
+// with a *PayloadOverflowError, a number of per-hop payloads differing from
+// the number of hops with ErrHopDataMismatch, a missing or invalid pub key
+// with ErrInvalidRoutePubKey, and a missing or invalid session key with
+// ErrInvalidSessionKey.
 func NewOnionPacket(paymentPath []*btcec.PublicKey, sessionKey *btcec.PrivateKey,
 	hopsData []HopData, assocData []byte) (*OnionPacket, error) {
 
+	return NewOnionPacketWithFinalHopData(paymentPath, sessionKey, hopsData,
+		nil, assocData)
+}
+
+// NewOnionPacketWithFinalHopData creates a new onion packet like
+// NewOnionPacket, which additionally carries the passed custom data to the
+// final hop within the routing info following its per-hop payload. The final
+// hop finds the data at the start of the FinalHopData of its ProcessedPacket.
+// If the data exceeds the MaxFinalHopData of the PayloadBudget of the route,
+// a *PayloadOverflowError is returned.
+func NewOnionPacketWithFinalHopData(paymentPath []*btcec.PublicKey,
+	sessionKey *btcec.PrivateKey, hopsData []HopData, finalHopData []byte,
+	assocData []byte) (*OnionPacket, error) {
+
+	err := validateOnionParams(paymentPath, sessionKey, hopsData,
+		finalHopData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the scalar of the session key is trusted, so its public key is
+	// derived again.
+	sessionKey, _ = btcec.PrivKeyFromBytes(btcec.S256(),
+		sessionKey.D.Bytes())
+
 	numHops := len(paymentPath)
 	hopSharedSecrets := generateSharedSecrets(paymentPath, sessionKey)
 
@@ -271,6 +352,11 @@ func NewOnionPacket(paymentPath []*btcec.PublicKey, sessionKey *btcec.PrivateKey
 		hopDataBuf bytes.Buffer
 	)
 
+	// The final hop data is shifted behind the per-hop payload of the
+	// final hop along with the rest of the mix header. As it's bounded by
+	// MaxFinalHopData, it's never overwritten by the filler.
+	copy(mixHeader[:], finalHopData)
+
 	// Now we compute the routing information for each hop, along with a
 	// MAC of the routing info using the shared key for that hop.
 	for i := numHops - 1; i >= 0; i-- {
@@ -596,34 +682,69 @@ type ProcessedPacket struct {
 	// NOTE: This field will only be populated iff the above Action is
 	// MoreHops.
 	NextPacket *OnionPacket
+
+	// FinalHopData is the decrypted routing info following the per-hop
+	// payload of the final hop. It starts with the final hop data passed
+	// to NewOnionPacketWithFinalHopData by the sender. Its length isn't
+	// conveyed, so the remaining bytes are unspecified and applications
+	// must frame their data themselves.
+	//
+	// NOTE: This field will only be populated iff the above Action is
+	// ExitNode.
+	FinalHopData []byte
+
+	// SharedSecret is the shared secret derived from the ephemeral key of
+	// the processed packet. It can be used to create an ErrorEncrypter in
+	// order to send failures back to the sender of the packet.
+	SharedSecret [sharedSecretSize]byte
 }
 
 // Router is an onion router within the Sphinx network. The router is capable
 // of processing incoming Sphinx onion packets thereby "peeling" a layer off
 // the onion encryption which the packet is wrapped with.
 type Router struct {
+	// replays is the number of packets rejected as replays. It MUST be
+	// used atomically.
+	replays uint64
+
 	nodeID   [addressSize]byte
 	nodeAddr *btcutil.AddressPubKeyHash
 
 	onionKey *btcec.PrivateKey
 
-	d *persistlog.DecayedLog
+	d persistlog.PersistLog
+
+	// mtx guards started, which ensures the replay log is only started and
+	// stopped once.
+	mtx     sync.Mutex
+	started bool
 }
 
 // NewRouter creates a new instance of a Sphinx onion Router given the node's
-// currently advertised onion private key, and the target Bitcoin network.
+// currently advertised onion private key, and the target Bitcoin network. The
+// Router uses a DecayedLog to detect replayed packets.
 func NewRouter(nodeKey *btcec.PrivateKey, net *chaincfg.Params,
 	chainNotifier chainntnfs.ChainNotifier) *Router {
+
+	d := &persistlog.DecayedLog{
+		Notifier: chainNotifier,
+	}
+
+	return NewRouterWithLog(nodeKey, net, d)
+}
+
+// NewRouterWithLog creates a new instance of a Sphinx onion Router like
+// NewRouter, but uses the passed PersistLog to detect replayed packets. The
+// log is started and stopped along with the Router.
+func NewRouterWithLog(nodeKey *btcec.PrivateKey, net *chaincfg.Params,
+	d persistlog.PersistLog) *Router {
+
 	var nodeID [addressSize]byte
 	copy(nodeID[:], btcutil.Hash160(nodeKey.PubKey().SerializeCompressed()))
 
 	// Safe to ignore the error here, nodeID is 20 bytes.
 	nodeAddr, _ := btcutil.NewAddressPubKeyHash(nodeID[:], net)
 
-	d := &persistlog.DecayedLog{
-		Notifier: chainNotifier,
-	}
-
 	return &Router{
 		nodeID:   nodeID,
 		nodeAddr: nodeAddr,
@@ -641,23 +762,48 @@ func NewRouter(nodeKey *btcec.PrivateKey, net *chaincfg.Params,
 	}
 }
 
-// Start starts / opens the DecayedLog's channeldb and its accompanying
-// garbage collector goroutine.
+// Start starts / opens the replay log's database and its accompanying
+// garbage collector goroutine. Calling Start on a started Router has no
+// effect.
 func (r *Router) Start() error {
-	return r.d.Start("")
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.started {
+		return nil
+	}
+
+	if err := r.d.Start(""); err != nil {
+		return err
+	}
+	r.started = true
+
+	return nil
 }
 
-// Stop stops / closes the DecayedLog's channeldb and its accompanying
-// garbage collector goroutine.
+// Stop stops / closes the replay log's database and its accompanying
+// garbage collector goroutine, waiting for the latter to exit. Calling Stop
+// on a Router which isn't started has no effect. Once stopped, packets are
+// rejected with persistlog.ErrLogStopped by a DecayedLog.
 func (r *Router) Stop() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.started {
+		return
+	}
+
 	r.d.Stop()
+	r.started = false
 }
 
 // ProcessOnionPacket processes an incoming onion packet which has been forward
 // to the target Sphinx router. If the encoded ephemeral key isn't on the
 // target Elliptic Curve, then the packet is rejected. Similarly, if the
 // derived shared secret has been seen before the packet is rejected.  Finally
-// if the MAC doesn't check the packet is again rejected.
+// if the MAC doesn't check the packet is again rejected. If the outgoing CLTV
+// of the packet is already below the best height known to the replay log,
+// ErrExpiredPacket is returned without recording the packet.
 //
 // In the case of a successful packet processing, and ProcessedPacket struct is
 // returned which houses the newly parsed packet, along with instructions on
@@ -675,12 +821,13 @@ func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket, assocData []byte) (*P
 	// In order to mitigate replay attacks, if we've seen this particular
 	// shared secret before, cease processing and just drop this forwarding
 	// message.
-	hashedSecret := persistlog.HashSharedSecret(sharedSecret)
-	cltv, err := r.d.Get(hashedSecret[:])
+	hashedSecret := r.d.HashSharedSecret(sharedSecret)
+	cltv, err := r.d.Get(hashedSecret)
 	if err != nil {
 		return nil, err
 	}
 	if cltv != math.MaxUint32 {
+		atomic.AddUint64(&r.replays, 1)
 		return nil, ErrReplayedPacket
 	}
 
@@ -714,20 +861,33 @@ func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket, assocData []byte) (*P
 		return nil, err
 	}
 
+	// If the outgoing CLTV has already expired, there's no point in
+	// forwarding the packet, nor in remembering it as it can't be
+	// replayed anyway.
+	if hopData.OutgoingCltv < r.d.BestHeight() {
+		return nil, ErrExpiredPacket
+	}
+
 	// The MAC checks out, mark this current shared secret as processed in
 	// order to mitigate future replay attacks. We need to check to see if
 	// we already know the secret again since a replay might have happened
 	// while we were checking the MAC and decoding the HopData.
-	cltv, err = r.d.Get(hashedSecret[:])
+	cltv, err = r.d.Get(hashedSecret)
 	if err != nil {
 		return nil, err
 	}
 	if cltv != math.MaxUint32 {
+		atomic.AddUint64(&r.replays, 1)
 		return nil, ErrReplayedPacket
 	}
 
-	err = r.d.Put(hashedSecret[:], hopData.OutgoingCltv)
-	if err != nil {
+	err = r.d.Put(hashedSecret, hopData.OutgoingCltv)
+	switch {
+	// A new block might have arrived since we checked the expiry above.
+	case err == persistlog.ErrExpiredEntry:
+		return nil, ErrExpiredPacket
+
+	case err != nil:
 		return nil, err
 	}
 
@@ -746,17 +906,27 @@ func (r *Router) ProcessOnionPacket(onionPkt *OnionPacket, assocData []byte) (*P
 	// However if the uncovered 'nextMac' is all zeroes, then this
 	// indicates that we're the final hop in the route.
 	var action ProcessCode = MoreHops
+	var finalHopData []byte
 	if bytes.Compare(bytes.Repeat([]byte{0x00}, hmacSize), hopData.HMAC[:]) == 0 {
 		action = ExitNode
+		finalHopData = nextMixHeader[:routingInfoSize-hopDataSize]
 	}
 
 	return &ProcessedPacket{
 		Action:                 action,
 		ForwardingInstructions: hopData,
 		NextPacket:             nextFwdMsg,
+		FinalHopData:           finalHopData,
+		SharedSecret:           sharedSecret,
 	}, nil
 }
 
+// ReplaysRejected returns the number of packets ProcessOnionPacket has
+// rejected as replays since the Router was created.
+func (r *Router) ReplaysRejected() uint64 {
+	return atomic.LoadUint64(&r.replays)
+}
+
 // generateSharedSecret generates the shared secret by given ephemeral key.
 func (r *Router) generateSharedSecret(dhKey *btcec.PublicKey) ([sha256.Size]byte,
 	error) {
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"testing/quick"
 
 	"github.com/Crypt-iQ/lightning-onion/persistlog"
 	"github.com/davecgh/go-spew/spew"
@@ -60,7 +64,7 @@ func newTestRoute(numHops int) ([]*Router, *[]HopData, *OnionPacket, error) {
 
 // shutdown deletes the temporary directory that the test database uses
 // and handles closing the database.
-func shutdown(dir string, d *persistlog.DecayedLog) {
+func shutdown(dir string, d persistlog.PersistLog) {
 	os.RemoveAll(dir)
 	d.Stop()
 }
@@ -181,6 +185,63 @@ func TestSphinxNodeRelpay(t *testing.T) {
 	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil); err != ErrReplayedPacket {
 		t.Fatalf("sphinx packet replay should be rejected, instead error is %v", err)
 	}
+
+	// Only the rejected replay is counted, not the lookups of the replay
+	// log.
+	if replays := nodes[0].ReplaysRejected(); replays != 1 {
+		t.Fatalf("expected 1 rejected replay, got %v", replays)
+	}
+}
+
+func TestSphinxNodeReplayBucketedLog(t *testing.T) {
+	// We'd like to ensure that replays are also rejected when the Router
+	// uses a different replay log.
+	nodes, _, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	router := NewRouterWithLog(nodes[0].onionKey, &chaincfg.MainNetParams,
+		&persistlog.BucketedLog{})
+
+	// Start the BucketedLog and defer shutdown
+	router.d.Start("0")
+	defer shutdown("0", router.d)
+
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil); err != nil {
+		t.Fatalf("unable to process sphinx packet: %v", err)
+	}
+
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil); err != ErrReplayedPacket {
+		t.Fatalf("sphinx packet replay should be rejected, instead error is %v", err)
+	}
+}
+
+func TestSphinxRouterLifecycle(t *testing.T) {
+	// Starting and stopping the Router more than once should be safe, and
+	// packets should be rejected once the Router is stopped.
+	nodes, _, fwdMsg, err := newTestRoute(1)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+	defer os.RemoveAll("sharedhashes")
+
+	router := nodes[0]
+	router.Stop()
+
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router: %v", err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatalf("unable to start router twice: %v", err)
+	}
+
+	router.Stop()
+	router.Stop()
+
+	if _, err := router.ProcessOnionPacket(fwdMsg, nil); err != persistlog.ErrLogStopped {
+		t.Fatalf("expected ErrLogStopped from stopped router, instead error is %v", err)
+	}
 }
 
 func TestSphinxAssocData(t *testing.T) {
@@ -229,3 +290,254 @@ func TestSphinxEncodeDecode(t *testing.T) {
 			spew.Sdump(fwdMsg), spew.Sdump(newFwdMsg))
 	}
 }
+
+func TestSphinxExpiredPacket(t *testing.T) {
+	// We'd like to ensure that packets whose outgoing CLTV has already
+	// expired are rejected without being recorded in the replay log.
+	nodes, hopsData, fwdMsg, err := newTestRoute(2)
+	if err != nil {
+		t.Fatalf("unable to create test route: %v", err)
+	}
+
+	// Start the DecayedLog, and prune it at a height past the outgoing
+	// CLTV of the first hop.
+	nodes[0].d.Start("0")
+	defer shutdown("0", nodes[0].d)
+
+	if err := nodes[0].d.Prune((*hopsData)[0].OutgoingCltv + 1); err != nil {
+		t.Fatalf("unable to prune replay log: %v", err)
+	}
+
+	if _, err := nodes[0].ProcessOnionPacket(fwdMsg, nil); err != ErrExpiredPacket {
+		t.Fatalf("expired packet should be rejected, instead error is %v", err)
+	}
+
+	// The replay log must not have grown.
+	sharedSecret, err := nodes[0].generateSharedSecret(fwdMsg.EphemeralKey)
+	if err != nil {
+		t.Fatalf("unable to generate shared secret: %v", err)
+	}
+	hashedSecret := nodes[0].d.HashSharedSecret(sharedSecret)
+	cltv, err := nodes[0].d.Get(hashedSecret)
+	if err != nil {
+		t.Fatalf("unable to query replay log: %v", err)
+	}
+	if cltv != math.MaxUint32 {
+		t.Fatalf("expired packet was stored in the replay log")
+	}
+}
+
+// newOnionParams returns a valid payment path of numHops random keys, along
+// with a session key and per-hop payloads.
+func newOnionParams(t *testing.T, numHops int) ([]*btcec.PublicKey,
+	*btcec.PrivateKey, []HopData) {
+
+	paymentPath := make([]*btcec.PublicKey, numHops)
+	for i := range paymentPath {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		paymentPath[i] = privKey.PubKey()
+	}
+
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(),
+		bytes.Repeat([]byte{'A'}, 32))
+
+	return paymentPath, sessionKey, make([]HopData, numHops)
+}
+
+func TestNewOnionPacketValidation(t *testing.T) {
+	paymentPath, sessionKey, hopsData := newOnionParams(t, 3)
+
+	offCurve := &btcec.PublicKey{
+		Curve: btcec.S256(),
+		X:     big.NewInt(1),
+		Y:     big.NewInt(1),
+	}
+	zeroKey := &btcec.PrivateKey{
+		PublicKey: sessionKey.PublicKey,
+		D:         big.NewInt(0),
+	}
+	orderKey := &btcec.PrivateKey{
+		PublicKey: sessionKey.PublicKey,
+		D:         new(big.Int).Set(btcec.S256().N),
+	}
+
+	withKey := func(i int, pubKey *btcec.PublicKey) []*btcec.PublicKey {
+		path := append([]*btcec.PublicKey(nil), paymentPath...)
+		path[i] = pubKey
+		return path
+	}
+
+	tests := []struct {
+		name        string
+		paymentPath []*btcec.PublicKey
+		sessionKey  *btcec.PrivateKey
+		hopsData    []HopData
+		err         error
+	}{
+		{"empty path", nil, sessionKey, nil, ErrEmptyPaymentPath},
+		{"too few payloads", paymentPath, sessionKey, hopsData[:2],
+			ErrHopDataMismatch},
+		{"too many payloads", paymentPath, sessionKey,
+			make([]HopData, 4), ErrHopDataMismatch},
+		{"nil pub key", withKey(1, nil), sessionKey, hopsData,
+			ErrInvalidRoutePubKey},
+		{"empty pub key", withKey(2, &btcec.PublicKey{}), sessionKey,
+			hopsData, ErrInvalidRoutePubKey},
+		{"pub key off curve", withKey(0, offCurve), sessionKey,
+			hopsData, ErrInvalidRoutePubKey},
+		{"nil session key", paymentPath, nil, hopsData,
+			ErrInvalidSessionKey},
+		{"empty session key", paymentPath, &btcec.PrivateKey{},
+			hopsData, ErrInvalidSessionKey},
+		{"zero session key", paymentPath, zeroKey, hopsData,
+			ErrInvalidSessionKey},
+		{"session key out of range", paymentPath, orderKey, hopsData,
+			ErrInvalidSessionKey},
+	}
+	for _, test := range tests {
+		_, err := NewOnionPacket(test.paymentPath, test.sessionKey,
+			test.hopsData, nil)
+		if err != test.err {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.err,
+				err)
+		}
+	}
+
+	// The length of the path is checked before the number of payloads, so
+	// a path which is too long can't index past its payloads.
+	tooLong, _, tooLongData := newOnionParams(t, NumMaxHops+1)
+	_, err := NewOnionPacket(tooLong, sessionKey, tooLongData[:NumMaxHops],
+		nil)
+	if _, ok := err.(*PayloadOverflowError); !ok {
+		t.Fatalf("expected PayloadOverflowError, got %v", err)
+	}
+
+	// A session key whose public key doesn't match its scalar still
+	// produces the packet of the scalar.
+	mismatched := &btcec.PrivateKey{
+		PublicKey: *offCurve.ToECDSA(),
+		D:         sessionKey.D,
+	}
+	packet, err := NewOnionPacket(paymentPath, mismatched,
+		make([]HopData, 3), nil)
+	if err != nil {
+		t.Fatalf("unable to create onion packet: %v", err)
+	}
+	if !packet.EphemeralKey.IsEqual(sessionKey.PubKey()) {
+		t.Fatalf("ephemeral key wasn't derived from the session key")
+	}
+}
+
+// onionParams are the randomly generated, and possibly invalid, parameters
+// of NewOnionPacket.
+type onionParams struct {
+	paymentPath []*btcec.PublicKey
+	sessionKey  *btcec.PrivateKey
+	hopsData    []HopData
+}
+
+// randomPubKey returns a random pub key, which is invalid with a probability
+// of one in four.
+func randomPubKey(r *rand.Rand) *btcec.PublicKey {
+	switch r.Intn(8) {
+	case 0:
+		return nil
+
+	case 1:
+		return &btcec.PublicKey{
+			Curve: btcec.S256(),
+			X:     big.NewInt(r.Int63()),
+			Y:     big.NewInt(r.Int63()),
+		}
+
+	default:
+		var keyBytes [32]byte
+		r.Read(keyBytes[:])
+		keyBytes[0] |= 1
+		_, pubKey := btcec.PrivKeyFromBytes(btcec.S256(), keyBytes[:])
+		return pubKey
+	}
+}
+
+// Generate creates random onionParams, implementing quick.Generator.
+func (onionParams) Generate(r *rand.Rand, size int) reflect.Value {
+	params := onionParams{
+		paymentPath: make([]*btcec.PublicKey, r.Intn(NumMaxHops+3)),
+	}
+	for i := range params.paymentPath {
+		params.paymentPath[i] = randomPubKey(r)
+	}
+
+	numHopsData := len(params.paymentPath)
+	if r.Intn(4) == 0 {
+		numHopsData = r.Intn(NumMaxHops + 3)
+	}
+	params.hopsData = make([]HopData, numHopsData)
+	for i := range params.hopsData {
+		r.Read(params.hopsData[i].NextAddress[:])
+		params.hopsData[i].ForwardAmount = uint64(r.Int63())
+		params.hopsData[i].OutgoingCltv = r.Uint32()
+	}
+
+	var keyBytes [32]byte
+	r.Read(keyBytes[:])
+	switch r.Intn(8) {
+	case 0:
+		params.sessionKey = nil
+
+	case 1:
+		params.sessionKey = &btcec.PrivateKey{}
+
+	case 2:
+		params.sessionKey = &btcec.PrivateKey{
+			D: new(big.Int).Add(btcec.S256().N,
+				new(big.Int).SetBytes(keyBytes[:])),
+		}
+
+	default:
+		params.sessionKey, _ = btcec.PrivKeyFromBytes(btcec.S256(),
+			keyBytes[:])
+	}
+
+	return reflect.ValueOf(params)
+}
+
+func TestNewOnionPacketQuick(t *testing.T) {
+	// NewOnionPacket should never panic, and should only succeed for
+	// valid parameters.
+	f := func(params onionParams) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Logf("NewOnionPacket panicked: %v", r)
+				ok = false
+			}
+		}()
+
+		packet, err := NewOnionPacket(params.paymentPath,
+			params.sessionKey, params.hopsData, nil)
+
+		numHops := len(params.paymentPath)
+		valid := numHops > 0 && numHops <= NumMaxHops &&
+			len(params.hopsData) == numHops &&
+			params.sessionKey != nil && params.sessionKey.D != nil &&
+			params.sessionKey.D.Sign() > 0 &&
+			params.sessionKey.D.Cmp(btcec.S256().N) < 0
+		for _, pubKey := range params.paymentPath {
+			valid = valid && pubKey != nil &&
+				btcec.S256().IsOnCurve(pubKey.X, pubKey.Y)
+		}
+		if valid != (err == nil) {
+			t.Logf("valid params: %v, got error: %v", valid, err)
+			return false
+		}
+
+		return err != nil || packet != nil
+	}
+
+	if err := quick.Check(f, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatalf("NewOnionPacket failed on random parameters: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package sphinxtest
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	sphinx "github.com/Crypt-iQ/lightning-onion"
+	"github.com/Crypt-iQ/lightning-onion/mockchain"
+	"github.com/Crypt-iQ/lightning-onion/persistlog"
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/roasbeef/btcd/btcec"
+	"github.com/roasbeef/btcd/chaincfg"
+)
+
+// Route is a multi-hop route of Routers, each backed by its own DecayedLog
+// which reports its garbage collections to a GCTracker. It allows onion
+// packets to be created and forwarded along the whole route in tests.
+type Route struct {
+	// Routers are the Routers of the hops, in the order of the route.
+	Routers []*sphinx.Router
+
+	// NodeKeys are the onion keys of the Routers.
+	NodeKeys []*btcec.PrivateKey
+
+	// Logs are the replay logs of the Routers. They may be configured
+	// before Start is called.
+	Logs []*persistlog.DecayedLog
+
+	// Trackers record the garbage collections of the Logs.
+	Trackers []*mockchain.GCTracker
+}
+
+// NewRoute creates a Route of numHops Routers with random onion keys, whose
+// replay logs are garbage collected on the blocks of the passed notifier.
+func NewRoute(numHops int, notifier chainntnfs.ChainNotifier) (*Route,
+	error) {
+
+	if numHops < 1 || numHops > sphinx.NumMaxHops {
+		return nil, fmt.Errorf("route must have between 1 and %v "+
+			"hops", sphinx.NumMaxHops)
+	}
+
+	r := &Route{
+		Routers:  make([]*sphinx.Router, numHops),
+		NodeKeys: make([]*btcec.PrivateKey, numHops),
+		Logs:     make([]*persistlog.DecayedLog, numHops),
+		Trackers: make([]*mockchain.GCTracker, numHops),
+	}
+	for i := 0; i < numHops; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to generate random "+
+				"key for sphinx node: %v", err)
+		}
+
+		tracker := mockchain.NewGCTracker()
+		d := &persistlog.DecayedLog{
+			Notifier: notifier,
+			OnPrune:  tracker.OnPrune,
+			OnError:  tracker.OnError,
+		}
+
+		r.NodeKeys[i] = privKey
+		r.Logs[i] = d
+		r.Trackers[i] = tracker
+		r.Routers[i] = sphinx.NewRouterWithLog(privKey,
+			&chaincfg.MainNetParams, d)
+	}
+
+	return r, nil
+}
+
+// PubKeys returns the public onion keys of the hops of the Route.
+func (r *Route) PubKeys() []*btcec.PublicKey {
+	pubKeys := make([]*btcec.PublicKey, len(r.NodeKeys))
+	for i, privKey := range r.NodeKeys {
+		pubKeys[i] = privKey.PubKey()
+	}
+
+	return pubKeys
+}
+
+// Start starts the replay log of every hop, storing the database of each
+// within its own subdirectory of the passed directory.
+func (r *Route) Start(dir string) error {
+	for i, d := range r.Logs {
+		hopDir := filepath.Join(dir, fmt.Sprintf("hop%d", i))
+		if err := d.Start(hopDir); err != nil {
+			r.Stop()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop stops the replay log of every hop.
+func (r *Route) Stop() {
+	for _, d := range r.Logs {
+		d.Stop()
+	}
+}
+
+// WaitForHeight blocks until the replay log of every hop has been garbage
+// collected at the passed height or above, or the timeout elapses.
+func (r *Route) WaitForHeight(height uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for i, tracker := range r.Trackers {
+		err := tracker.WaitForHeight(height, deadline.Sub(time.Now()))
+		if err != nil {
+			return fmt.Errorf("hop %v: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// NewPacket creates an onion packet carrying the passed hop data along the
+// Route, using a fresh random session key.
+func (r *Route) NewPacket(hopsData []sphinx.HopData,
+	assocData []byte) (*sphinx.OnionPacket, error) {
+
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate session key: %v",
+			err)
+	}
+
+	return sphinx.NewOnionPacket(r.PubKeys(), sessionKey, hopsData,
+		assocData)
+}
+
+// Forward processes the passed packet at every hop of the Route in turn,
+// returning the processed packet of each hop. An error is returned if a hop
+// rejects the packet, or if the packet exits the Route early.
+func (r *Route) Forward(packet *sphinx.OnionPacket,
+	assocData []byte) ([]*sphinx.ProcessedPacket, error) {
+
+	processed := make([]*sphinx.ProcessedPacket, 0, len(r.Routers))
+	for i, router := range r.Routers {
+		p, err := router.ProcessOnionPacket(packet, assocData)
+		if err != nil {
+			return processed, fmt.Errorf("hop %v: %v", i, err)
+		}
+		processed = append(processed, p)
+
+		if p.Action == sphinx.ExitNode {
+			if i != len(r.Routers)-1 {
+				return processed, fmt.Errorf("packet exited at "+
+					"hop %v of %v", i, len(r.Routers))
+			}
+			break
+		}
+
+		packet = p.NextPacket
+	}
+
+	return processed, nil
+}
+
+// HopsData returns the hop data of a route of numHops hops, whose outgoing
+// CLTVs are the passed CLTV. The next address of each hop is filled with its
+// index, and its forward amount is its index.
+func HopsData(numHops int, cltv uint32) []sphinx.HopData {
+	hopsData := make([]sphinx.HopData, numHops)
+	for i := range hopsData {
+		hopsData[i] = sphinx.HopData{
+			Realm:         0x00,
+			ForwardAmount: uint64(i),
+			OutgoingCltv:  cltv,
+		}
+		copy(hopsData[i].NextAddress[:], bytes.Repeat([]byte{byte(i)}, 8))
+	}
+
+	return hopsData
+}
@@ -0,0 +1,66 @@
+package sphinxtest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Crypt-iQ/lightning-onion/mockchain"
+)
+
+// TestRouteForward checks that a packet is forwarded along the whole Route,
+// that its replay is rejected, and that the replay logs are garbage collected
+// once its CLTV has expired.
+func TestRouteForward(t *testing.T) {
+	const (
+		numHops = 3
+		cltv    = 1000
+	)
+
+	notifier := mockchain.NewNotifier(cltv - 10)
+	route, err := NewRoute(numHops, notifier)
+	if err != nil {
+		t.Fatalf("unable to create route: %v", err)
+	}
+
+	if err := route.Start("routedir"); err != nil {
+		t.Fatalf("unable to start route: %v", err)
+	}
+	defer os.RemoveAll("routedir")
+	defer route.Stop()
+
+	packet, err := route.NewPacket(HopsData(numHops, cltv), nil)
+	if err != nil {
+		t.Fatalf("unable to create packet: %v", err)
+	}
+
+	processed, err := route.Forward(packet, nil)
+	if err != nil {
+		t.Fatalf("unable to forward packet: %v", err)
+	}
+	if len(processed) != numHops {
+		t.Fatalf("expected %v processed packets, got %v", numHops,
+			len(processed))
+	}
+
+	if _, err := route.Forward(packet, nil); err == nil {
+		t.Fatalf("replayed packet should be rejected")
+	}
+
+	height := notifier.MineBlocks(11)
+	if err := route.WaitForHeight(uint32(height), 5*time.Second); err != nil {
+		t.Fatalf("unable to wait for garbage collection: %v", err)
+	}
+
+	for i, d := range route.Logs {
+		stats, err := d.Stats()
+		if err != nil {
+			t.Fatalf("unable to retrieve stats: %v", err)
+		}
+		if stats.NumEntries != 0 {
+			t.Fatalf("hop %v: expected expired entry to be "+
+				"collected, %v entries left", i,
+				stats.NumEntries)
+		}
+	}
+}